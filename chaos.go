@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	// The default interval in ms to change the network.
+	chaosDefaultInterval = 1000
+	// The max transitions kept in the history of chaos.
+	chaosMaxHistory = 100
+)
+
+// ChaosBound is the range of a parameter to vary, the min and max are inclusive.
+type ChaosBound struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	// The max change of each transition in walk mode, default to 10% of the range.
+	Step float64 `json:"step,omitempty"`
+}
+
+func (v *ChaosBound) String() string {
+	return fmt.Sprintf("%v-%v/%v", v.Min, v.Max, v.Step)
+}
+
+// ChaosRequest is the chaos of network, which varies the loss, delay and rate randomly within the bounds every
+// interval, for example, the loss in [0, 10]% and the delay in [50, 400]ms.
+type ChaosRequest struct {
+	Iface         string `json:"iface"`
+	Protocol      string `json:"protocol"`
+	Direction     string `json:"direction"`
+	IdentifyKey   string `json:"identifyKey"`
+	IdentifyValue string `json:"identifyValue"`
+	// The api listen port to exclude, default to API_LISTEN.
+	API string `json:"api,omitempty"`
+	// The mode, walk to change from the current value by a random step, or uniform to resample in the bounds.
+	Mode string `json:"mode"`
+	// The interval in ms to change, default to 1000, at least 100.
+	Interval int `json:"interval,omitempty"`
+	// The duration in seconds of chaos, 0 to run until stopped.
+	Duration int `json:"duration,omitempty"`
+	// The seed of random, to reproduce the chaos, default to the time.
+	Seed int64 `json:"seed,omitempty"`
+	// The bounds of loss in %, delay in ms and rate in kbps, at least one.
+	Loss  *ChaosBound `json:"loss,omitempty"`
+	Delay *ChaosBound `json:"delay,omitempty"`
+	Rate  *ChaosBound `json:"rate,omitempty"`
+}
+
+func (v *ChaosRequest) String() string {
+	return fmt.Sprintf("iface=%v, direction=%v, identify=%v/%v, mode=%v, interval=%vms, duration=%vs, loss=%v, "+
+		"delay=%v, rate=%v",
+		v.Iface, v.Direction, v.IdentifyKey, v.IdentifyValue, v.Mode, v.Interval, v.Duration, v.Loss, v.Delay, v.Rate,
+	)
+}
+
+// request converts the values to the request of rule.
+func (v *ChaosRequest) request(values *ChaosValues) *NetworkRequest {
+	return &NetworkRequest{
+		Iface: v.Iface, Protocol: v.Protocol, Direction: v.Direction,
+		IdentifyKey: v.IdentifyKey, IdentifyValue: v.IdentifyValue, API: v.API,
+		Strategies: values.strategies(v),
+	}
+}
+
+// Validate checks the bounds, and the filter by the values of lower bounds.
+func (v *ChaosRequest) Validate() error {
+	if v.Mode != "walk" && v.Mode != "uniform" {
+		return errors.Errorf("invalid mode=%v", v.Mode)
+	}
+	if v.Interval < 0 || (v.Interval > 0 && v.Interval < jobMinInterval) {
+		return errors.Errorf("invalid interval=%v, should be at least %vms", v.Interval, jobMinInterval)
+	}
+	if v.Duration < 0 {
+		return errors.Errorf("invalid duration=%v", v.Duration)
+	}
+	if v.Loss == nil && v.Delay == nil && v.Rate == nil {
+		return errors.New("no loss, delay or rate")
+	}
+
+	for name, bound := range map[string]*ChaosBound{"loss": v.Loss, "delay": v.Delay, "rate": v.Rate} {
+		if bound == nil {
+			continue
+		}
+		if bound.Min < 0 || bound.Max < bound.Min || bound.Step < 0 {
+			return errors.Errorf("invalid %v=%v", name, bound)
+		}
+	}
+	if v.Loss != nil && v.Loss.Max > 100 {
+		return errors.Errorf("invalid loss=%v, should in [0, 100]", v.Loss)
+	}
+	if v.Rate != nil && v.Rate.Min <= 0 {
+		return errors.Errorf("invalid rate=%v, should be positive", v.Rate)
+	}
+
+	values := &ChaosValues{}
+	for _, p := range []struct {
+		bound *ChaosBound
+		value *float64
+	}{{v.Loss, &values.Loss}, {v.Delay, &values.Delay}, {v.Rate, &values.Rate}} {
+		if p.bound != nil {
+			*p.value = p.bound.Min
+		}
+	}
+	return v.request(values).Options().Validate()
+}
+
+// ChaosValues is the values of a transition, the loss in %, delay in ms and rate in kbps.
+type ChaosValues struct {
+	At    time.Time `json:"at"`
+	Loss  float64   `json:"loss,omitempty"`
+	Delay float64   `json:"delay,omitempty"`
+	Rate  float64   `json:"rate,omitempty"`
+}
+
+func (v *ChaosValues) String() string {
+	return fmt.Sprintf("loss=%v%%, delay=%vms, rate=%vkbps", v.Loss, v.Delay, v.Rate)
+}
+
+// strategies converts the values to the strategies, for the parameters with bounds.
+func (v *ChaosValues) strategies(req *ChaosRequest) []*NetworkStrategy {
+	var strategies []*NetworkStrategy
+	if req.Loss != nil {
+		strategies = append(strategies, &NetworkStrategy{Strategy: "loss", Loss: v.Loss})
+	}
+	if req.Delay != nil {
+		strategies = append(strategies, &NetworkStrategy{Strategy: "delay", Delay: v.Delay})
+	}
+	if req.Rate != nil {
+		strategies = append(strategies, &NetworkStrategy{Strategy: "rate", Rate: v.Rate})
+	}
+	return strategies
+}
+
+// Chaos is a running chaos, which owns a rule of the filter, to apply the values of transitions.
+type Chaos struct {
+	networkJob
+	Request *ChaosRequest `json:"request"`
+	// The seed of random, which is from request or the time.
+	Seed int64 `json:"seed"`
+	// The number of transitions, and the last transitions in the order of time.
+	Transitions int            `json:"transitions"`
+	History     []*ChaosValues `json:"history"`
+
+	random *rand.Rand
+	// The interval of transitions, and the time to end, zero if until stopped.
+	interval time.Duration
+	end      time.Time
+	// The values of current transition.
+	values *ChaosValues
+}
+
+// NewChaos checks the request, to make sure the chaos never fails for bad request after started.
+func NewChaos(req *ChaosRequest) (*Chaos, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	seed := req.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	interval := time.Duration(req.Interval) * time.Millisecond
+	if interval == 0 {
+		interval = chaosDefaultInterval * time.Millisecond
+	}
+
+	return &Chaos{
+		networkJob: networkJob{kind: "chaos", iface: req.Iface, direction: req.Direction},
+		Request:    req, Seed: seed, History: []*ChaosValues{}, random: rand.New(rand.NewSource(seed)),
+		interval: interval, values: &ChaosValues{},
+	}, nil
+}
+
+func (v *Chaos) String() string {
+	return fmt.Sprintf("id=%v, %v, seed=%v, transitions=%v", v.ID, v.Request, v.Seed, v.Transitions)
+}
+
+// sample returns the values of next transition. For walk, the first values are uniform, and each value changes by
+// a random step, which is reflected at the bounds.
+func (v *Chaos) sample(last *ChaosValues) *ChaosValues {
+	values := &ChaosValues{At: time.Now()}
+	for _, p := range []struct {
+		bound      *ChaosBound
+		last, next *float64
+	}{
+		{v.Request.Loss, &last.Loss, &values.Loss},
+		{v.Request.Delay, &last.Delay, &values.Delay},
+		{v.Request.Rate, &last.Rate, &values.Rate},
+	} {
+		bound := p.bound
+		if bound == nil {
+			continue
+		}
+
+		value := bound.Min + v.random.Float64()*(bound.Max-bound.Min)
+		if v.Request.Mode == "walk" && v.Transitions > 0 {
+			step := bound.Step
+			if step == 0 {
+				step = (bound.Max - bound.Min) / 10
+			}
+
+			value = *p.last + (v.random.Float64()*2-1)*step
+			if value > bound.Max {
+				value = 2*bound.Max - value
+			}
+			if value < bound.Min {
+				value = 2*bound.Min - value
+			}
+			value = math.Max(bound.Min, math.Min(bound.Max, value))
+		}
+
+		// Round to 2 decimals, which is enough for tc.
+		*p.next = math.Round(value*100) / 100
+	}
+	return values
+}
+
+// next samples the values of next transition every interval, until the duration of chaos.
+func (v *Chaos) next(at time.Time) (time.Duration, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.Request.Duration > 0 && v.end.IsZero() {
+		v.end = at.Add(time.Duration(v.Request.Duration) * time.Second)
+	}
+	if !v.end.IsZero() && !at.Before(v.end) {
+		return 0, false
+	}
+
+	v.values = v.sample(v.values)
+	return v.interval, true
+}
+
+// apply applies the values to the rule of chaos. The chaos fails if the rule can't be updated, rather than setup
+// the interface again, which overwrites other rules of it.
+func (v *Chaos) apply(ctx context.Context) error {
+	values := v.values
+	if err := v.applyRule(ctx, v.Request.request(values)); err != nil {
+		return errors.Wrapf(err, "transition %v", values)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.Transitions++
+	if v.History = append(v.History, values); len(v.History) > chaosMaxHistory {
+		v.History = v.History[len(v.History)-chaosMaxHistory:]
+	}
+	logger.Tf(ctx, "Chaos %v transition %v at %v, %v",
+		v.ID, v.Transitions, values.At.Format(time.RFC3339Nano), values,
+	)
+	return nil
+}
+
+// TcChaosStart starts a chaos by the JSON body, for example, a random walk of loss and delay every 2s:
+//
+//	{"iface": "lo", "protocol": "udp", "direction": "outgoing", "identifyKey": "serverPort", "identifyValue": "8000",
+//	"mode": "walk", "interval": 2000, "seed": 1, "loss": {"min": 0, "max": 10, "step": 1},
+//	"delay": {"min": 50, "max": 400, "step": 20}}
+func TcChaosStart(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	req := &ChaosRequest{}
+	defer r.Body.Close()
+	if b, err := ioutil.ReadAll(r.Body); err != nil {
+		return errors.Wrapf(err, "read body")
+	} else if err := json.Unmarshal(b, req); err != nil {
+		return errors.Wrapf(err, "parse body %v", string(b))
+	}
+
+	chaos, err := NewChaos(req)
+	if err != nil {
+		return err
+	}
+	if err := jobs.Start(ctx, chaos); err != nil {
+		return err
+	}
+
+	return writeJob(ctx, w, r, chaos)
+}
+
+// TcChaosStop stops the chaos, and responses after the rule of chaos is deleted.
+func TcChaosStop(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	return transitJob(ctx, w, r, "chaos", jobStopped, jobRunning)
+}
+
+// TcChaosStatus responses the chaos by id, or all chaos if no id.
+func TcChaosStatus(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	return statusJob(ctx, w, r, "chaos", "chaos")
+}
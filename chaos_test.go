@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestChaosRequestValidate(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		interval int
+		ok       bool
+	}{
+		{"default", 0, true},
+		{"negative", -1, false},
+		{"too small", 10, false},
+		{"min", jobMinInterval, true},
+		{"large", 60000, true},
+	} {
+		req := &ChaosRequest{
+			Iface: "lo", Protocol: "all", Direction: "outgoing", IdentifyKey: "all", Mode: "uniform",
+			Interval: c.interval, Rate: &ChaosBound{Min: 100, Max: 1000},
+		}
+		if err := req.Validate(); (err == nil) != c.ok {
+			t.Errorf("%v: expect ok=%v, actual err %v", c.name, c.ok, err)
+		}
+	}
+}
+
+// chaosFixedSource is the source of random, whose Float64 is always the value.
+type chaosFixedSource float64
+
+func (v chaosFixedSource) Int63() int64 {
+	return int64(float64(v) * (1 << 63))
+}
+
+func (v chaosFixedSource) Seed(seed int64) {
+}
+
+func TestChaosSample(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		mode        string
+		transitions int
+		step        float64
+		random      float64
+		last, value float64
+	}{
+		{"uniform", "uniform", 1, 2, 0.25, 9.5, 2.5},
+		{"walk first", "walk", 0, 2, 0.25, 9.5, 2.5},
+		{"walk", "walk", 1, 2, 0.75, 5, 6},
+		{"walk default step", "walk", 1, 0, 0.75, 5, 5.5},
+		{"reflect at max", "walk", 1, 2, 0.75, 9.5, 9.5},
+		{"reflect at min", "walk", 1, 2, 0.25, 0.5, 0.5},
+		{"round", "walk", 1, 1, 0.6, 5.001, 5.2},
+	} {
+		v := &Chaos{
+			Request:     &ChaosRequest{Mode: c.mode, Loss: &ChaosBound{Min: 0, Max: 10, Step: c.step}},
+			Transitions: c.transitions, random: rand.New(chaosFixedSource(c.random)),
+		}
+		if values := v.sample(&ChaosValues{Loss: c.last}); values.Loss != c.value || values.Delay != 0 {
+			t.Errorf("%v: expect %v, actual %v", c.name, c.value, values)
+		}
+	}
+}
+
+func TestChaosSampleBounds(t *testing.T) {
+	req := &ChaosRequest{
+		Mode: "walk", Loss: &ChaosBound{Min: 0, Max: 10, Step: 3}, Rate: &ChaosBound{Min: 100, Max: 200},
+	}
+	a := &Chaos{Request: req, random: rand.New(rand.NewSource(1))}
+	b := &Chaos{Request: req, random: rand.New(rand.NewSource(1))}
+
+	last := &ChaosValues{}
+	for i := 0; i < 1000; i++ {
+		values := a.sample(last)
+		if values.Loss < 0 || values.Loss > 10 || values.Rate < 100 || values.Rate > 200 {
+			t.Errorf("step %v: out of bounds %v", i, values)
+		}
+		if i > 0 && (values.Loss-last.Loss > 3.01 || last.Loss-values.Loss > 3.01) {
+			t.Errorf("step %v: expect step at most 3, actual %v to %v", i, last, values)
+		}
+		if values2 := b.sample(last); values2.Loss != values.Loss || values2.Rate != values.Rate {
+			t.Errorf("step %v: expect %v by the same seed, actual %v", i, values, values2)
+		}
+
+		last = values
+		a.Transitions, b.Transitions = a.Transitions+1, b.Transitions+1
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"time"
+)
+
+// The file in data directory to persist the pending expiries.
+const expiriesFile = "expiries.json"
+
+const (
+	// The interval to retry the failed revert, which is doubled by each failure, up to the max.
+	expiryRetryInterval    = 5 * time.Second
+	expiryMaxRetryInterval = 5 * time.Minute
+)
+
+// NetworkExpiry is a pending revert of a setup, rule or link with duration, which restores the previous state of
+// the interface when expired.
+type NetworkExpiry struct {
+	// The ID of rule or link which creates the expiry.
+	ID    string `json:"id"`
+	Iface string `json:"iface"`
+	// The time to revert.
+	ExpiresAt time.Time `json:"expiresAt"`
+	// The rules created, which are removed when expired.
+	Rules []*NetworkRule `json:"rules"`
+	// The rules overwritten, which are restored when expired.
+	Previous []*NetworkRule `json:"previous,omitempty"`
+	// The number of failed reverts and the last error, the revert is retried until ok.
+	Failures int    `json:"failures,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (v *NetworkExpiry) String() string {
+	return fmt.Sprintf("id=%v, iface=%v, expiresAt=%v, rules=%v, previous=%v, failures=%v",
+		v.ID, v.Iface, v.ExpiresAt.Format(time.RFC3339), len(v.Rules), len(v.Previous), v.Failures,
+	)
+}
+
+// retryAfter returns the backoff to retry the failed revert.
+func (v *NetworkExpiry) retryAfter() time.Duration {
+	backoff := expiryRetryInterval
+	for i := 1; i < v.Failures && backoff < expiryMaxRetryInterval; i++ {
+		backoff *= 2
+	}
+	if backoff > expiryMaxRetryInterval {
+		return expiryMaxRetryInterval
+	}
+	return backoff
+}
+
+// validateDuration checks the duration in seconds, 0 for no expiry.
+func validateDuration(duration int) error {
+	if duration < 0 {
+		return errors.Errorf("invalid duration=%v", duration)
+	}
+	return nil
+}
+
+// expire schedules to revert the rules after duration in seconds, the caller should hold the lock.
+func (v *ruleManager) expire(ctx context.Context, id string, duration int, created, previous []*NetworkRule) {
+	if duration <= 0 {
+		return
+	}
+
+	expiry := &NetworkExpiry{
+		ID: id, Iface: created[0].opts.iface, ExpiresAt: time.Now().Add(time.Duration(duration) * time.Second),
+		Rules: created, Previous: previous,
+	}
+	v.expiries = append(v.expiries, expiry)
+	v.schedule(ctx, expiry, time.Until(expiry.ExpiresAt))
+	v.saveExpiries(ctx)
+}
+
+// schedule starts the timer to revert the expiry after the delay, the caller should hold the lock.
+func (v *ruleManager) schedule(ctx context.Context, expiry *NetworkExpiry, delay time.Duration) {
+	if v.timers == nil {
+		v.timers = make(map[string]*time.Timer)
+	}
+
+	id := expiry.ID
+	v.timers[id] = time.AfterFunc(delay, func() {
+		v.revert(ctx, id)
+	})
+	logger.Tf(ctx, "Schedule expiry %v, delay=%v", expiry, delay)
+}
+
+// revert restores the previous state of the expiry, which is fired by timer. The expiry is kept if failed, and
+// retried with backoff, so the impairment never stays silently.
+func (v *ruleManager) revert(ctx context.Context, id string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var expiry *NetworkExpiry
+	for _, e := range v.expiries {
+		if e.ID == id {
+			expiry = e
+			break
+		}
+	}
+	delete(v.timers, id)
+	if expiry == nil {
+		return
+	}
+
+	if err := v.revertExpiry(ctx, expiry); err != nil {
+		expiry.Failures, expiry.Error = expiry.Failures+1, err.Error()
+		logger.Wf(ctx, "Revert expiry %v err %+v", expiry, err)
+
+		v.schedule(ctx, expiry, expiry.retryAfter())
+		v.saveExpiries(ctx)
+		return
+	}
+
+	for i, e := range v.expiries {
+		if e == expiry {
+			v.expiries = append(v.expiries[:i], v.expiries[i+1:]...)
+			break
+		}
+	}
+	v.commit(ctx, expiry.Iface)
+	logger.Tf(ctx, "Revert expiry %v ok", expiry)
+	v.saveExpiries(ctx)
+}
+
+// revertExpiry removes the rules created by the expiry, and restores the rules it overwrote. The other rules
+// created later are kept, and a restored rule is moved to a free slot if its slot is taken, or dropped if it
+// conflicts with them. The caller should hold the lock.
+func (v *ruleManager) revertExpiry(ctx context.Context, expiry *NetworkExpiry) error {
+	created := make(map[string]bool)
+	for _, rule := range expiry.Rules {
+		created[rule.ID] = true
+	}
+
+	var alive, others []*NetworkRule
+	for _, rule := range v.rulesOf(expiry.Iface) {
+		if created[rule.ID] {
+			alive = append(alive, rule)
+		} else {
+			others = append(others, rule)
+		}
+	}
+
+	// Ignore if the rules are already removed or overwritten by user.
+	if len(alive) == 0 {
+		return nil
+	}
+
+	if len(expiry.Previous) == 0 {
+		for _, rule := range alive {
+			if !isDarwin {
+				if err := shaper.DeleteRule(ctx, rule); err != nil {
+					return errors.Wrapf(err, "delete rule %v by %v", rule.ID, shaper.Name())
+				}
+			}
+			v.removeRule(rule.ID)
+		}
+		return nil
+	}
+
+	target, restored := others, []*NetworkRule{}
+	for _, rule := range expiry.Previous {
+		slot, err := freeSlot(target, rule.opts, rule.Slot)
+		if err != nil {
+			logger.Wf(ctx, "Ignore restore rule %v, err %v", rule, err)
+			continue
+		}
+
+		rule.Slot = slot
+		target, restored = append(target, rule), append(restored, rule)
+	}
+
+	if err := v.rollback(ctx, expiry.Iface, target); err != nil {
+		return err
+	}
+
+	for _, rule := range alive {
+		v.removeRule(rule.ID)
+	}
+	v.rules = append(v.rules, restored...)
+	return nil
+}
+
+// removeRule removes the rule by ID from the manager, the caller should hold the lock.
+func (v *ruleManager) removeRule(id string) {
+	for i, rule := range v.rules {
+		if rule.ID == id {
+			v.rules = append(v.rules[:i], v.rules[i+1:]...)
+			return
+		}
+	}
+}
+
+// cleanExpiries drops the expiries whose rules are all removed or overwritten, because there is nothing to
+// revert. The caller should hold the lock.
+func (v *ruleManager) cleanExpiries(ctx context.Context) {
+	var expiries []*NetworkExpiry
+	for _, expiry := range v.expiries {
+		var alive bool
+		for _, rule := range expiry.Rules {
+			alive = alive || v.getRule(rule.ID) != nil
+		}
+
+		if alive {
+			expiries = append(expiries, expiry)
+			continue
+		}
+
+		if timer, ok := v.timers[expiry.ID]; ok {
+			timer.Stop()
+			delete(v.timers, expiry.ID)
+		}
+		logger.Tf(ctx, "Drop expiry %v", expiry)
+	}
+
+	if len(expiries) != len(v.expiries) {
+		v.expiries = expiries
+		v.saveExpiries(ctx)
+	}
+}
+
+// saveExpiries persists the expiries, so they survive restart. The caller should hold the lock.
+func (v *ruleManager) saveExpiries(ctx context.Context) {
+	expiries := v.expiries
+	if expiries == nil {
+		expiries = []*NetworkExpiry{}
+	}
+
+	if err := saveJSON(expiriesFile, expiries); err != nil {
+		logger.Wf(ctx, "Save expiries err %+v", err)
+	}
+}
+
+// Expiries returns the pending expiries of the interface, or all if iface is empty.
+func (v *ruleManager) Expiries(iface string) []*NetworkExpiry {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	expiries := []*NetworkExpiry{}
+	for _, expiry := range v.expiries {
+		if iface == "" || expiry.Iface == iface {
+			expiries = append(expiries, expiry)
+		}
+	}
+	return expiries
+}
+
+// LoadExpiries loads the expiries persisted before restart, and reschedules them. The rules of expiries are still
+// in the kernel, so they are added back to the manager, to be reverted when expired.
+func (v *ruleManager) LoadExpiries(ctx context.Context) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var expiries []*NetworkExpiry
+	if ok, err := loadJSON(expiriesFile, &expiries); err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+
+	for _, expiry := range expiries {
+		for _, rule := range append(append([]*NetworkRule{}, expiry.Rules...), expiry.Previous...) {
+			if rule.Request == nil {
+				return errors.Errorf("no request of rule %v in expiry %v", rule.ID, expiry.ID)
+			}
+			rule.opts = rule.Request.Options()
+			v.reserveID(rule)
+		}
+
+		for _, rule := range expiry.Rules {
+			if v.getRule(rule.ID) == nil {
+				v.rules = append(v.rules, rule)
+			}
+		}
+
+		v.expiries = append(v.expiries, expiry)
+		v.schedule(ctx, expiry, time.Until(expiry.ExpiresAt))
+	}
+
+	logger.Tf(ctx, "Load %v expiries from %v", len(expiries), storeFile(expiriesFile))
+	return nil
+}
+
+// reserveID makes sure the new IDs never conflict with the ID of rule and link loaded. The caller should hold
+// the lock.
+func (v *ruleManager) reserveID(rule *NetworkRule) {
+	var id uint64
+	if _, err := fmt.Sscanf(rule.ID, "rule-%d", &id); err == nil && id > v.lastID {
+		v.lastID = id
+	}
+	if _, err := fmt.Sscanf(rule.Link, "link-%d", &id); err == nil && id > v.lastLinkID {
+		v.lastLinkID = id
+	}
+}
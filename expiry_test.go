@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNetworkExpiryRetryAfter(t *testing.T) {
+	for _, c := range []struct {
+		failures int
+		backoff  time.Duration
+	}{
+		{0, expiryRetryInterval},
+		{1, expiryRetryInterval},
+		{2, 2 * expiryRetryInterval},
+		{3, 4 * expiryRetryInterval},
+		{6, 32 * expiryRetryInterval},
+		{7, expiryMaxRetryInterval},
+		{100, expiryMaxRetryInterval},
+	} {
+		if backoff := (&NetworkExpiry{Failures: c.failures}).retryAfter(); backoff != c.backoff {
+			t.Errorf("failures=%v: expect %v, actual %v", c.failures, c.backoff, backoff)
+		}
+	}
+}
+
+func TestRevertExpiry(t *testing.T) {
+	// Revert the rules in memory only, without the shaper.
+	defer func(v bool) {
+		isDarwin = v
+	}(isDarwin)
+	isDarwin = true
+
+	rule := func(id, iface, value string, slot uint16) *NetworkRule {
+		return &NetworkRule{ID: id, Slot: slot, opts: &NetworkOptions{
+			iface: iface, protocol: "udp", direction: "outgoing", identifyKey: "serverPort", identifyValue: value,
+		}}
+	}
+
+	for _, c := range []struct {
+		name     string
+		rules    []*NetworkRule
+		created  []string
+		previous []*NetworkRule
+		// The rules after revert, in the format of id@slot.
+		reverted []string
+	}{
+		{
+			"removed by user",
+			[]*NetworkRule{rule("rule-2", "eth0", "9000", 2)},
+			[]string{"rule-1"}, []*NetworkRule{rule("rule-0", "eth0", "8000", 2)},
+			[]string{"rule-2@2"},
+		},
+		{
+			"no previous",
+			[]*NetworkRule{rule("rule-1", "eth0", "8000", 2), rule("rule-2", "eth0", "9000", 3),
+				rule("rule-3", "eth1", "8000", 2)},
+			[]string{"rule-1"}, nil,
+			[]string{"rule-2@3", "rule-3@2"},
+		},
+		{
+			"restore in slot",
+			[]*NetworkRule{rule("rule-1", "eth0", "8000", 2), rule("rule-2", "eth0", "9000", 3)},
+			[]string{"rule-1"}, []*NetworkRule{rule("rule-0", "eth0", "7000", 2)},
+			[]string{"rule-2@3", "rule-0@2"},
+		},
+		{
+			"relocate taken slot",
+			[]*NetworkRule{rule("rule-1", "eth0", "8000", 3), rule("rule-2", "eth0", "9000", 2)},
+			[]string{"rule-1"}, []*NetworkRule{rule("rule-0", "eth0", "7000", 2)},
+			[]string{"rule-2@2", "rule-0@3"},
+		},
+		{
+			"drop conflict",
+			[]*NetworkRule{rule("rule-1", "eth0", "8000", 2), rule("rule-2", "eth0", "9000", 3)},
+			[]string{"rule-1"}, []*NetworkRule{rule("rule-0", "eth0", "9000", 2), rule("rule-00", "eth0", "7000", 4)},
+			[]string{"rule-2@3", "rule-00@4"},
+		},
+	} {
+		expiry := &NetworkExpiry{ID: "rule-1", Iface: "eth0", Previous: c.previous}
+		for _, id := range c.created {
+			expiry.Rules = append(expiry.Rules, &NetworkRule{ID: id})
+		}
+
+		v := &ruleManager{rules: c.rules}
+		if err := v.revertExpiry(context.Background(), expiry); err != nil {
+			t.Errorf("%v: err %+v", c.name, err)
+			continue
+		}
+
+		var reverted []string
+		for _, rule := range v.rules {
+			reverted = append(reverted, fmt.Sprintf("%v@%v", rule.ID, rule.Slot))
+		}
+		if !reflect.DeepEqual(reverted, c.reverted) {
+			t.Errorf("%v: expect %v, actual %v", c.name, c.reverted, reverted)
+		}
+	}
+}
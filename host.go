@@ -0,0 +1,991 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The version of host snapshot document.
+const hostSnapshotVersion = 1
+
+// HostSnapshot is the tc state of all interfaces of host, including the ifb devices, and the rules of tc-ui, to
+// save a known-good setup and restore it later.
+type HostSnapshot struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	// The shaper when captured, for reference only, because the snapshot is captured and restored by netlink.
+	Shaper     string           `json:"shaper"`
+	Interfaces []*HostInterface `json:"interfaces"`
+	// The rules of tc-ui, which is the desired state after restore.
+	Rules []*NetworkRule `json:"rules"`
+}
+
+// HostInterface is the qdiscs, classes and filters of an interface. The default qdisc of kernel, whose handle is
+// 0, is ignored, so an interface without objects is restored to the default.
+type HostInterface struct {
+	Name string `json:"name"`
+	// The kind of link, ifb for the device to redirect the ingress traffic, which is created if not exists.
+	Kind    string        `json:"kind,omitempty"`
+	Qdiscs  []*HostQdisc  `json:"qdiscs"`
+	Classes []*HostClass  `json:"classes"`
+	Filters []*HostFilter `json:"filters"`
+}
+
+// HostQdisc is a qdisc, the htb, netem or ingress. The handle and parent are in tc syntax, for example, 1a1a: or
+// 1a1a:2 or root.
+type HostQdisc struct {
+	Kind   string `json:"kind"`
+	Handle string `json:"handle"`
+	Parent string `json:"parent"`
+	// For htb, the minor of default class.
+	Default uint16 `json:"default,omitempty"`
+	// For netem.
+	Netem *HostNetem `json:"netem,omitempty"`
+	// The reason if it can't be restored, for example, the kind is not supported.
+	Unsupported string `json:"unsupported,omitempty"`
+}
+
+// HostNetem is the parameters of netem, the rate and correlation is in %, and the time is in ms. Note that the
+// distribution is not dumped by kernel, so it's from the rule of tc-ui, or empty for uniform.
+type HostNetem struct {
+	Loss                 float64   `json:"loss,omitempty"`
+	LossCorrelation      float64   `json:"lossCorrelation,omitempty"`
+	LossModel            string    `json:"lossModel,omitempty"`
+	LossModelParams      []float64 `json:"lossModelParams,omitempty"`
+	Delay                float64   `json:"delay,omitempty"`
+	Jitter               float64   `json:"jitter,omitempty"`
+	DelayCorrelation     float64   `json:"delayCorrelation,omitempty"`
+	Distribution         string    `json:"distribution,omitempty"`
+	Duplicate            float64   `json:"duplicate,omitempty"`
+	DuplicateCorrelation float64   `json:"duplicateCorrelation,omitempty"`
+	Corrupt              float64   `json:"corrupt,omitempty"`
+	CorruptCorrelation   float64   `json:"corruptCorrelation,omitempty"`
+	Reorder              float64   `json:"reorder,omitempty"`
+	ReorderCorrelation   float64   `json:"reorderCorrelation,omitempty"`
+	Gap                  uint32    `json:"gap,omitempty"`
+}
+
+// HostClass is a htb class, the rate and ceil is in bits per second.
+type HostClass struct {
+	Kind    string `json:"kind"`
+	Classid string `json:"classid"`
+	Parent  string `json:"parent"`
+	Rate    uint64 `json:"rate"`
+	Ceil    uint64 `json:"ceil"`
+	// The buffer and cbuffer in psched ticks, for the burst and cburst.
+	Buffer  uint32 `json:"buffer"`
+	Cbuffer uint32 `json:"cbuffer"`
+	// The reason if it can't be restored, for example, the kind is not supported.
+	Unsupported string `json:"unsupported,omitempty"`
+}
+
+// HostFilter is a u32 filter, which classifies the matched packets to flowid, or redirects them to the ifb device.
+// The filters are in the order of handle, which is allocated by kernel in the order of creation.
+type HostFilter struct {
+	Kind     string        `json:"kind"`
+	Handle   string        `json:"handle"`
+	Parent   string        `json:"parent"`
+	Prio     uint16        `json:"prio"`
+	Protocol string        `json:"protocol"`
+	Keys     []*HostU32Key `json:"keys,omitempty"`
+	Flowid   string        `json:"flowid,omitempty"`
+	Redirect string        `json:"redirect,omitempty"`
+	// The reason if it can't be restored, for example, the action is not supported.
+	Unsupported string `json:"unsupported,omitempty"`
+
+	// The handle to sort the filters.
+	handle uint32
+}
+
+// HostU32Key is a key of u32 selector, the value and mask is in hex, for example, 0x0a000001/0xffffffff at 16.
+type HostU32Key struct {
+	Val  string `json:"val"`
+	Mask string `json:"mask"`
+	Off  int32  `json:"off"`
+}
+
+// tcParseHandle parses the handle in tc syntax, for example, 1a1a: or 1a1a:2 or root.
+func tcParseHandle(s string) (uint32, error) {
+	switch s {
+	case "root":
+		return tcHandleRoot, nil
+	case "ingress":
+		return tcHandleIngress, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, errors.Errorf("invalid handle %v", s)
+	}
+
+	var handle [2]uint64
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(part, 16, 16)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid handle %v", s)
+		}
+		handle[i] = v
+	}
+	return tcHandle(uint16(handle[0]), uint16(handle[1])), nil
+}
+
+// tcParseProtocol parses the ethernet protocol of filter in tc syntax.
+func tcParseProtocol(s string) (uint16, error) {
+	switch s {
+	case "all":
+		return tcProtocolAll, nil
+	case "ip":
+		return tcProtocolIPv4, nil
+	case "ipv6":
+		return tcProtocolIPv6, nil
+	}
+
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 16)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid protocol %v", s)
+	}
+	return uint16(v), nil
+}
+
+// SnapshotHost captures the qdiscs, classes and filters of all interfaces by netlink, with the rules.
+func (v *ruleManager) SnapshotHost(ctx context.Context) (*HostSnapshot, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	conn, err := nlDial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	snapshot, err := v.snapshotHost(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Tf(ctx, "Snapshot host, interfaces=%v, rules=%v", len(snapshot.Interfaces), len(snapshot.Rules))
+	return snapshot, nil
+}
+
+// snapshotHost captures the state of all interfaces, the caller should hold the lock.
+func (v *ruleManager) snapshotHost(conn *nlConn) (*HostSnapshot, error) {
+	interfaces, err := v.captureHost(conn, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HostSnapshot{
+		Version: hostSnapshotVersion, CreatedAt: time.Now(), Shaper: shaper.Name(),
+		Interfaces: interfaces, Rules: append([]*NetworkRule{}, v.rules...),
+	}, nil
+}
+
+// captureHost captures the qdiscs, classes and filters of the interfaces matched, or all interfaces if match is
+// nil, in the order of index. The caller should hold the lock.
+func (v *ruleManager) captureHost(conn *nlConn, match func(name string) bool) ([]*HostInterface, error) {
+	links, err := dumpHostLinks(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	// The distribution of netem is not dumped by kernel, so find it in the plan of rules, by dev and handle.
+	distributions := make(map[string]string)
+	for _, rule := range v.rules {
+		plan, err := buildTcPlan(rule.opts, rule.Slot)
+		if err != nil {
+			continue
+		}
+		for _, object := range plan.objects {
+			if o, ok := object.(*tcQdisc); ok && o.netem != nil && o.netem.distribution != "" {
+				distributions[fmt.Sprintf("%v/%v", o.dev, tcHandleString(o.handle))] = o.netem.distribution
+			}
+		}
+	}
+
+	qdiscs, err := conn.Execute(rtmGetQdisc, nlmFDump, nlTcmsg(0, 0, 0, 0))
+	if err != nil {
+		return nil, errors.Wrapf(err, "dump qdisc")
+	}
+
+	interfaces := []*HostInterface{}
+	for _, link := range links {
+		if match != nil && !match(link.name) {
+			continue
+		}
+
+		iface := &HostInterface{
+			Name: link.name, Kind: link.kind,
+			Qdiscs: []*HostQdisc{}, Classes: []*HostClass{}, Filters: []*HostFilter{},
+		}
+		if iface.Kind != "ifb" {
+			iface.Kind = ""
+		}
+
+		// The majors and handles of qdiscs, for the classes and filters under them.
+		majors := make(map[uint16]bool)
+		var parents []uint32
+		for _, b := range qdiscs {
+			h, attrs, err := nlParseTcmsg(b)
+			if err != nil {
+				return nil, err
+			}
+			if h.ifindex != link.index || h.handle == 0 {
+				continue
+			}
+
+			qdisc := &HostQdisc{
+				Kind: nlAttrString(nlFindAttr(attrs, tcaKind)), Handle: tcHandleString(h.handle),
+				Parent: tcHandleString(h.parent),
+			}
+			switch qdisc.Kind {
+			case "htb":
+				if glob := nlFindAttr(nlParseAttrs(nlFindAttr(attrs, tcaOptions)), tcaHtbInit); len(glob) >= 12 {
+					qdisc.Default = uint16(nativeEndian.Uint32(glob[8:]))
+				}
+			case "netem":
+				netem := nlParseNetemOptions(nlFindAttr(attrs, tcaOptions))
+				netem.distribution = distributions[fmt.Sprintf("%v/%v", link.name, qdisc.Handle)]
+				qdisc.Netem = newHostNetem(netem)
+			case "ingress":
+			default:
+				qdisc.Unsupported = fmt.Sprintf("qdisc kind %v", qdisc.Kind)
+			}
+			iface.Qdiscs = append(iface.Qdiscs, qdisc)
+
+			majors[uint16(h.handle>>16)] = true
+			parents = append(parents, h.handle)
+		}
+
+		if iface.Classes, err = dumpHostClasses(conn, link.index, majors); err != nil {
+			return nil, errors.Wrapf(err, "dump class of %v", link.name)
+		}
+
+		for _, parent := range parents {
+			filters, err := dumpHostFilters(conn, link.index, parent, links)
+			if err != nil {
+				return nil, errors.Wrapf(err, "dump filter %v of %v", tcHandleString(parent), link.name)
+			}
+			iface.Filters = append(iface.Filters, filters...)
+		}
+
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces, nil
+}
+
+// Unsupported returns the objects of interface which can't be restored, for example, a fq_codel qdisc.
+func (v *HostInterface) Unsupported() []string {
+	var unsupported []string
+	for _, q := range v.Qdiscs {
+		if q.Unsupported != "" {
+			unsupported = append(unsupported, q.Unsupported)
+		}
+	}
+	for _, c := range v.Classes {
+		if c.Unsupported != "" {
+			unsupported = append(unsupported, c.Unsupported)
+		}
+	}
+	for _, f := range v.Filters {
+		if f.Unsupported != "" {
+			unsupported = append(unsupported, f.Unsupported)
+		}
+	}
+	return unsupported
+}
+
+// HostDiff is a difference of an object between the expected and actual state of an interface.
+type HostDiff struct {
+	Iface string `json:"iface"`
+	// The object, qdisc, class or filter, and the ID of it, that is the handle of qdisc, the classid of class, or
+	// the parent, priority, protocol and keys of filter.
+	Object string `json:"object"`
+	ID     string `json:"id"`
+	// The change, missing if not found, unexpected if not expected, or changed.
+	Change string `json:"change"`
+	// The expected and actual object.
+	Expected interface{} `json:"expected,omitempty"`
+	Actual   interface{} `json:"actual,omitempty"`
+}
+
+func (v *HostDiff) String() string {
+	return fmt.Sprintf("%v %v %v of %v", v.Change, v.Object, v.ID, v.Iface)
+}
+
+// diffHostInterface compares the objects of interface, and returns the differences. The handle of filter is
+// ignored, because it's allocated by kernel.
+func diffHostInterface(name string, expected, actual *HostInterface) []*HostDiff {
+	type hostObject struct {
+		object, id string
+		value      interface{}
+	}
+	objectsOf := func(iface *HostInterface) []*hostObject {
+		var objects []*hostObject
+		if iface == nil {
+			return objects
+		}
+		for _, q := range iface.Qdiscs {
+			objects = append(objects, &hostObject{object: "qdisc", id: q.Handle, value: q})
+		}
+		for _, c := range iface.Classes {
+			objects = append(objects, &hostObject{object: "class", id: c.Classid, value: c})
+		}
+		for _, f := range iface.Filters {
+			r0 := *f
+			r0.Handle = ""
+			keys, _ := json.Marshal(f.Keys)
+			id := fmt.Sprintf("parent %v prio %v protocol %v keys %v", f.Parent, f.Prio, f.Protocol, string(keys))
+			objects = append(objects, &hostObject{object: "filter", id: id, value: &r0})
+		}
+		return objects
+	}
+
+	// Index the actual objects, and the filters of the same ID are matched in order.
+	key := func(o *hostObject) string {
+		return fmt.Sprintf("%v/%v", o.object, o.id)
+	}
+	actualObjects := objectsOf(actual)
+	actuals := make(map[string][]*hostObject)
+	for _, o := range actualObjects {
+		actuals[key(o)] = append(actuals[key(o)], o)
+	}
+
+	diffs := []*HostDiff{}
+	for _, e := range objectsOf(expected) {
+		matched := actuals[key(e)]
+		if len(matched) == 0 {
+			diffs = append(diffs, &HostDiff{Iface: name, Object: e.object, ID: e.id, Change: "missing", Expected: e.value})
+			continue
+		}
+
+		a := matched[0]
+		actuals[key(e)] = matched[1:]
+		eb, _ := json.Marshal(e.value)
+		ab, _ := json.Marshal(a.value)
+		if string(eb) != string(ab) {
+			diffs = append(diffs, &HostDiff{
+				Iface: name, Object: e.object, ID: e.id, Change: "changed", Expected: e.value, Actual: a.value,
+			})
+		}
+	}
+
+	for _, a := range actualObjects {
+		if matched := actuals[key(a)]; len(matched) > 0 && matched[0] == a {
+			actuals[key(a)] = matched[1:]
+			diffs = append(diffs, &HostDiff{Iface: name, Object: a.object, ID: a.id, Change: "unexpected", Actual: a.value})
+		}
+	}
+	return diffs
+}
+
+// hostLink is a link of host, with the kind of link info, for example, ifb.
+type hostLink struct {
+	index      int
+	name, kind string
+}
+
+// dumpHostLinks returns all links of host, in the order of index.
+func dumpHostLinks(conn *nlConn) ([]*hostLink, error) {
+	responses, err := conn.Execute(rtmGetLink, nlmFDump, nlIfinfomsg(0, 0, 0))
+	if err != nil {
+		return nil, errors.Wrapf(err, "dump link")
+	}
+
+	var links []*hostLink
+	for _, b := range responses {
+		if len(b) < 16 {
+			return nil, errors.Errorf("invalid ifinfomsg size %v", len(b))
+		}
+
+		attrs := nlParseAttrs(b[16:])
+		links = append(links, &hostLink{
+			index: int(int32(nativeEndian.Uint32(b[4:]))),
+			name:  nlAttrString(nlFindAttr(attrs, iflaIfname)),
+			kind:  nlAttrString(nlFindAttr(nlParseAttrs(nlFindAttr(attrs, iflaLinkinfo)), iflaInfoKind)),
+		})
+	}
+
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].index < links[j].index
+	})
+	return links, nil
+}
+
+// dumpHostClasses returns the classes of the qdiscs by majors.
+func dumpHostClasses(conn *nlConn, index int, majors map[uint16]bool) ([]*HostClass, error) {
+	responses, err := conn.Execute(rtmGetTClass, nlmFDump, nlTcmsg(index, 0, 0, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	classes := []*HostClass{}
+	for _, b := range responses {
+		h, attrs, err := nlParseTcmsg(b)
+		if err != nil {
+			return nil, err
+		}
+		if h.ifindex != index || !majors[uint16(h.handle>>16)] {
+			continue
+		}
+
+		class := &HostClass{
+			Kind: nlAttrString(nlFindAttr(attrs, tcaKind)), Classid: tcHandleString(h.handle),
+			Parent: tcHandleString(h.parent),
+		}
+		if class.Kind != "htb" {
+			class.Unsupported = fmt.Sprintf("class kind %v", class.Kind)
+			classes = append(classes, class)
+			continue
+		}
+
+		options := nlParseAttrs(nlFindAttr(attrs, tcaOptions))
+		if opt := nlFindAttr(options, tcaHtbParms); len(opt) >= 32 {
+			class.Rate, class.Ceil = uint64(nativeEndian.Uint32(opt[8:])), uint64(nativeEndian.Uint32(opt[20:]))
+			class.Buffer, class.Cbuffer = nativeEndian.Uint32(opt[24:]), nativeEndian.Uint32(opt[28:])
+		}
+		if d := nlFindAttr(options, tcaHtbRate64); len(d) == 8 {
+			class.Rate = nativeEndian.Uint64(d)
+		}
+		if d := nlFindAttr(options, tcaHtbCeil64); len(d) == 8 {
+			class.Ceil = nativeEndian.Uint64(d)
+		}
+		class.Rate, class.Ceil = class.Rate*8, class.Ceil*8
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+// dumpHostFilters returns the filters of the parent qdisc, and the ifb device is resolved by the links.
+func dumpHostFilters(conn *nlConn, index int, parent uint32, links []*hostLink) ([]*HostFilter, error) {
+	responses, err := conn.Execute(rtmGetTFilter, nlmFDump, nlTcmsg(index, 0, parent, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	filters := []*HostFilter{}
+	for _, b := range responses {
+		h, attrs, err := nlParseTcmsg(b)
+		if err != nil {
+			return nil, err
+		}
+
+		filter := &HostFilter{
+			Kind: nlAttrString(nlFindAttr(attrs, tcaKind)), Parent: tcHandleString(parent), Prio: uint16(h.info >> 16),
+			Protocol: tcProtocolString(nlHtons(uint16(h.info))), Handle: fmt.Sprintf("%x", h.handle), handle: h.handle,
+		}
+		if filter.Kind != "u32" {
+			filter.Unsupported = fmt.Sprintf("filter kind %v", filter.Kind)
+			filters = append(filters, filter)
+			continue
+		}
+
+		// Ignore the hash table node of u32.
+		options := nlFindAttr(attrs, tcaOptions)
+		keys, flowid := nlParseU32Options(options)
+		if keys == nil {
+			continue
+		}
+
+		filter.Flowid = tcHandleString(flowid)
+		for _, key := range keys {
+			filter.Keys = append(filter.Keys, &HostU32Key{
+				Val: fmt.Sprintf("0x%08x", key.val), Mask: fmt.Sprintf("0x%08x", key.mask), Off: key.off,
+			})
+		}
+
+		// Only the mirred action to redirect to ifb is supported.
+		for _, action := range nlParseAttrs(nlFindAttr(nlParseAttrs(options), tcaU32Act)) {
+			actionAttrs := nlParseAttrs(action.data)
+			kind := nlAttrString(nlFindAttr(actionAttrs, tcaActKind))
+			mirred := nlFindAttr(nlParseAttrs(nlFindAttr(actionAttrs, tcaActOptions)), tcaMirredParms)
+			if kind != "mirred" || len(mirred) < 28 || nativeEndian.Uint32(mirred[20:]) != tcaEgressRedir {
+				filter.Unsupported = fmt.Sprintf("action kind %v", kind)
+				break
+			}
+
+			redirectIndex := int(nativeEndian.Uint32(mirred[24:]))
+			for _, link := range links {
+				if link.index == redirectIndex {
+					filter.Redirect = link.name
+				}
+			}
+			if filter.Redirect == "" {
+				filter.Unsupported = fmt.Sprintf("redirect to ifindex %v", redirectIndex)
+			}
+		}
+
+		// The handle of u32 is in the syntax of htid:hash:node, for example, 800::800.
+		filter.Handle = strings.Replace(fmt.Sprintf("%x:%x:%x", h.handle>>20, h.handle>>12&0xff, h.handle&0xfff), ":0:", "::", 1)
+		filters = append(filters, filter)
+	}
+
+	sort.SliceStable(filters, func(i, j int) bool {
+		return filters[i].handle < filters[j].handle
+	})
+	return filters, nil
+}
+
+func newHostNetem(v *tcNetem) *HostNetem {
+	return &HostNetem{
+		Loss: v.loss, LossCorrelation: v.lossCorrelation, LossModel: v.lossModel, LossModelParams: v.lossModelParams,
+		Delay: v.delay, Jitter: v.jitter, DelayCorrelation: v.delayCorrelation, Distribution: v.distribution,
+		Duplicate: v.duplicate, DuplicateCorrelation: v.duplicateCorrelation,
+		Corrupt: v.corrupt, CorruptCorrelation: v.corruptCorrelation,
+		Reorder: v.reorder, ReorderCorrelation: v.reorderCorrelation, Gap: v.gap,
+	}
+}
+
+func (v *HostNetem) netem() *tcNetem {
+	return &tcNetem{
+		loss: v.Loss, lossCorrelation: v.LossCorrelation, lossModel: v.LossModel, lossModelParams: v.LossModelParams,
+		delay: v.Delay, jitter: v.Jitter, delayCorrelation: v.DelayCorrelation, distribution: v.Distribution,
+		duplicate: v.Duplicate, duplicateCorrelation: v.DuplicateCorrelation,
+		corrupt: v.Corrupt, corruptCorrelation: v.CorruptCorrelation,
+		reorder: v.Reorder, reorderCorrelation: v.ReorderCorrelation, gap: v.Gap,
+	}
+}
+
+// objects converts the interface to the objects to create in order, the root and ingress qdiscs, the classes
+// with the parent first, the other qdiscs, and the filters.
+func (v *HostInterface) objects() ([]interface{}, error) {
+	var roots, qdiscs []interface{}
+	for _, q := range v.Qdiscs {
+		if q.Unsupported != "" {
+			return nil, errors.Errorf("unsupported %v", q.Unsupported)
+		}
+
+		o := &tcQdisc{dev: v.Name, kind: q.Kind, defaultMinor: q.Default}
+		var err error
+		if o.handle, err = tcParseHandle(q.Handle); err != nil {
+			return nil, err
+		}
+		if o.parent, err = tcParseHandle(q.Parent); err != nil {
+			return nil, err
+		}
+
+		switch q.Kind {
+		case "htb", "ingress":
+		case "netem":
+			if q.Netem == nil {
+				return nil, errors.Errorf("no netem of qdisc %v", q.Handle)
+			}
+			if o.netem = q.Netem.netem(); o.netem.distribution != "" {
+				if _, err := nlNetemDistTable(o.netem.distribution); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, errors.Errorf("invalid qdisc kind %v", q.Kind)
+		}
+
+		if o.parent == tcHandleRoot || o.parent == tcHandleIngress {
+			roots = append(roots, o)
+		} else {
+			qdiscs = append(qdiscs, o)
+		}
+	}
+
+	var classes []*tcClass
+	for _, c := range v.Classes {
+		if c.Unsupported != "" {
+			return nil, errors.Errorf("unsupported %v", c.Unsupported)
+		}
+		if c.Kind != "htb" {
+			return nil, errors.Errorf("invalid class kind %v", c.Kind)
+		}
+		if c.Rate < 8 || c.Ceil < 8 {
+			return nil, errors.Errorf("invalid rate=%v, ceil=%v of class %v", c.Rate, c.Ceil, c.Classid)
+		}
+
+		o := &tcClass{dev: v.Name, rate: c.Rate / 8, ceil: c.Ceil / 8, buffers: []uint32{c.Buffer, c.Cbuffer}}
+		var err error
+		if o.classid, err = tcParseHandle(c.Classid); err != nil {
+			return nil, err
+		}
+		if o.parent, err = tcParseHandle(c.Parent); err != nil {
+			return nil, err
+		}
+		classes = append(classes, o)
+	}
+
+	// Sort the classes, so the parent class is created before its children.
+	objects := roots
+	created := make(map[uint32]bool)
+	for len(classes) > 0 {
+		var pending []*tcClass
+		for _, o := range classes {
+			if o.parent != tcHandleRoot && o.parent&0xffff != 0 && !created[o.parent] {
+				pending = append(pending, o)
+				continue
+			}
+			created[o.classid] = true
+			objects = append(objects, o)
+		}
+		if len(pending) == len(classes) {
+			return nil, errors.Errorf("no parent %v of class %v", tcHandleString(pending[0].parent),
+				tcHandleString(pending[0].classid))
+		}
+		classes = pending
+	}
+	objects = append(objects, qdiscs...)
+
+	for _, f := range v.Filters {
+		if f.Unsupported != "" {
+			return nil, errors.Errorf("unsupported %v", f.Unsupported)
+		}
+
+		o, err := f.filter(v.Name)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+	}
+
+	return objects, nil
+}
+
+// filter converts the u32 filter to the object of plan on the dev.
+func (v *HostFilter) filter(dev string) (*tcFilter, error) {
+	if v.Kind != "u32" {
+		return nil, errors.Errorf("invalid filter kind %v", v.Kind)
+	}
+
+	o := &tcFilter{dev: dev, prio: v.Prio, redirect: v.Redirect}
+	var err error
+	if o.parent, err = tcParseHandle(v.Parent); err != nil {
+		return nil, err
+	}
+	if o.protocol, err = tcParseProtocol(v.Protocol); err != nil {
+		return nil, err
+	}
+	if v.Flowid != "" {
+		if o.flowid, err = tcParseHandle(v.Flowid); err != nil {
+			return nil, err
+		}
+	}
+
+	o.keys = []tcU32Key{}
+	for _, k := range v.Keys {
+		val, err := strconv.ParseUint(strings.TrimPrefix(k.Val, "0x"), 16, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key val %v", k.Val)
+		}
+		mask, err := strconv.ParseUint(strings.TrimPrefix(k.Mask, "0x"), 16, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key mask %v", k.Mask)
+		}
+		o.keys = append(o.keys, tcU32Key{val: uint32(val), mask: uint32(mask), off: k.Off})
+	}
+	return o, nil
+}
+
+// RestoreHost rebuilds the qdiscs, classes and filters of the interfaces in snapshot, and replaces the rules by
+// the rules of snapshot. The interfaces not in snapshot are not touched, except the ifb devices which are
+// removed. If it fails, the interfaces are restored to the state before, and the error is NetworkApplyError.
+func (v *ruleManager) RestoreHost(ctx context.Context, snapshot *HostSnapshot) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if snapshot.Version != hostSnapshotVersion {
+		return errors.Errorf("invalid version=%v", snapshot.Version)
+	}
+
+	objects, err := snapshot.objects()
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for _, iface := range snapshot.Interfaces {
+		if iface.Kind == "" {
+			if _, err := net.InterfaceByName(iface.Name); err != nil {
+				return errors.Wrapf(err, "query iface %v", iface.Name)
+			}
+		}
+		names[iface.Name] = true
+	}
+
+	for _, rule := range snapshot.Rules {
+		if rule.Request == nil {
+			return errors.Errorf("no request of rule %v", rule.ID)
+		}
+		rule.opts = rule.Request.Options()
+		if err := rule.opts.Validate(); err != nil {
+			return errors.Wrapf(err, "rule %v", rule.ID)
+		}
+		if !names[rule.opts.iface] {
+			return errors.Errorf("no interface %v of rule %v", rule.opts.iface, rule.ID)
+		}
+	}
+
+	if isDarwin {
+		return errors.New("not supported on darwin")
+	}
+
+	conn, err := nlDial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Snapshot the interfaces to touch, to rollback if failed.
+	previous, err := v.snapshotHost(conn)
+	if err != nil {
+		return errors.Wrapf(err, "snapshot")
+	}
+	var touched []*HostInterface
+	for _, iface := range previous.Interfaces {
+		if names[iface.Name] || iface.Kind == "ifb" {
+			touched = append(touched, iface)
+		}
+	}
+	previous.Interfaces = touched
+
+	if err := v.applyHost(ctx, conn, snapshot, objects); err != nil {
+		rollback := &NetworkRollback{RolledBack: true, Restored: true}
+		if r0 := v.rollbackHost(ctx, conn, previous); r0 != nil {
+			rollback.Restored, rollback.Error = false, r0.Error()
+		}
+
+		logger.Wf(ctx, "Rollback host, restored=%v, err %v", rollback.Restored, err)
+		return &NetworkApplyError{Err: errors.Wrapf(err, "restore"), Rollback: rollback}
+	}
+
+	committed := make(map[string]bool)
+	for _, rule := range append(v.rules, snapshot.Rules...) {
+		committed[rule.opts.iface] = true
+	}
+
+	v.rules = snapshot.Rules
+	for _, rule := range v.rules {
+		v.reserveID(rule)
+	}
+	v.cleanExpiries(ctx)
+
+	for iface := range committed {
+		v.observe(ctx, iface)
+	}
+	v.saveRules(ctx)
+
+	logger.Tf(ctx, "Restore host, interfaces=%v, rules=%v", len(snapshot.Interfaces), len(snapshot.Rules))
+	return nil
+}
+
+// objects converts the interfaces of snapshot to the objects to create, by the name of interface.
+func (v *HostSnapshot) objects() (map[string][]interface{}, error) {
+	objects := make(map[string][]interface{})
+	for _, iface := range v.Interfaces {
+		if _, ok := objects[iface.Name]; ok || iface.Name == "" {
+			return nil, errors.Errorf("invalid interface name=%v", iface.Name)
+		}
+		if iface.Kind != "" && iface.Kind != "ifb" {
+			return nil, errors.Errorf("invalid kind=%v of interface %v", iface.Kind, iface.Name)
+		}
+
+		r0, err := iface.objects()
+		if err != nil {
+			return nil, errors.Wrapf(err, "interface %v", iface.Name)
+		}
+		objects[iface.Name] = r0
+	}
+	return objects, nil
+}
+
+// applyHost removes the qdiscs of the interfaces in snapshot, and creates the objects of them. The ifb devices
+// not in snapshot are removed, and the ones not exist are created. The caller should hold the lock.
+func (v *ruleManager) applyHost(ctx context.Context, conn *nlConn, snapshot *HostSnapshot, objects map[string][]interface{}) error {
+	links, err := dumpHostLinks(conn)
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		if _, ok := objects[link.name]; !ok && link.kind == "ifb" {
+			if _, err := conn.Execute(rtmDelLink, 0, nlIfinfomsg(link.index, 0, 0)); err != nil {
+				return errors.Wrapf(err, "delete link %v", link.name)
+			}
+		}
+	}
+
+	return v.rebuildHost(ctx, conn, snapshot.Interfaces, objects)
+}
+
+// rebuildHost removes the qdiscs of the interfaces, and creates the objects of them, the ifb devices are created if
+// not exist. The caller should hold the lock.
+func (v *ruleManager) rebuildHost(ctx context.Context, conn *nlConn, interfaces []*HostInterface, objects map[string][]interface{}) error {
+	nl := &netlinkShaper{}
+	for _, iface := range interfaces {
+		if _, err := net.InterfaceByName(iface.Name); err != nil && iface.Kind == "ifb" {
+			if err := nl.create(conn, &tcLink{name: iface.Name, kind: "ifb"}); err != nil {
+				return err
+			}
+		}
+		if err := nl.deleteQdisc(conn, iface.Name, tcHandleRoot, 0); err != nil {
+			return errors.Wrapf(err, "delete root of %v", iface.Name)
+		}
+		if err := nl.deleteQdisc(conn, iface.Name, tcHandleIngress, tcHandle(0xffff, 0)); err != nil {
+			return errors.Wrapf(err, "delete ingress of %v", iface.Name)
+		}
+	}
+
+	for _, iface := range interfaces {
+		for _, object := range objects[iface.Name] {
+			if err := nl.create(conn, object); err != nil {
+				return err
+			}
+		}
+	}
+
+	logger.Tf(ctx, "netlink rebuild host, interfaces=%v", len(interfaces))
+	return nil
+}
+
+// rollbackHost restores the interfaces to the previous state, and verifies the state is the same. The caller should
+// hold the lock.
+func (v *ruleManager) rollbackHost(ctx context.Context, conn *nlConn, previous *HostSnapshot) error {
+	objects, err := previous.objects()
+	if err != nil {
+		return err
+	}
+	if err := v.applyHost(ctx, conn, previous, objects); err != nil {
+		return err
+	}
+	return v.verifyHost(conn, previous.Interfaces)
+}
+
+// verifyHost captures the interfaces, and compares them with the expected state. The caller should hold the lock.
+func (v *ruleManager) verifyHost(conn *nlConn, expected []*HostInterface) error {
+	names := make(map[string]bool)
+	for _, iface := range expected {
+		names[iface.Name] = true
+	}
+
+	actual, err := v.captureHost(conn, func(name string) bool {
+		return names[name]
+	})
+	if err != nil {
+		return errors.Wrapf(err, "verify")
+	}
+
+	if diffs := diffHostStates(expected, actual); len(diffs) > 0 {
+		var r0 []string
+		for _, diff := range diffs {
+			r0 = append(r0, diff.String())
+		}
+		return errors.Errorf("state differs from snapshot, %v", strings.Join(r0, ", "))
+	}
+	return nil
+}
+
+// captureIfaces captures the interfaces with their ifb devices, that is the ones for incoming of tc-ui, and the ones
+// redirected to by the ingress filters, for example, created by tcconfig. It also returns all interfaces captured.
+// The caller should hold the lock.
+func (v *ruleManager) captureIfaces(conn *nlConn, ifaces []string) (captured, all []*HostInterface, err error) {
+	names := make(map[string]bool)
+	for _, iface := range ifaces {
+		ifb, err := tcIfbName(iface)
+		if err != nil {
+			return nil, nil, err
+		}
+		names[iface], names[ifb] = true, true
+	}
+
+	if all, err = v.captureHost(conn, nil); err != nil {
+		return nil, nil, err
+	}
+
+	for _, iface := range all {
+		if names[iface.Name] {
+			for _, f := range iface.Filters {
+				if f.Redirect != "" {
+					names[f.Redirect] = true
+				}
+			}
+		}
+	}
+
+	for _, iface := range all {
+		if names[iface.Name] {
+			captured = append(captured, iface)
+		}
+	}
+	return captured, all, nil
+}
+
+// diffHostStates compares the interfaces by name, and returns the differences of objects.
+func diffHostStates(expected, actual []*HostInterface) []*HostDiff {
+	actuals := make(map[string]*HostInterface)
+	for _, iface := range actual {
+		actuals[iface.Name] = iface
+	}
+
+	diffs := []*HostDiff{}
+	visited := make(map[string]bool)
+	for _, iface := range expected {
+		diffs = append(diffs, diffHostInterface(iface.Name, iface, actuals[iface.Name])...)
+		visited[iface.Name] = true
+	}
+	for _, iface := range actual {
+		if !visited[iface.Name] {
+			diffs = append(diffs, diffHostInterface(iface.Name, nil, iface)...)
+		}
+	}
+	return diffs
+}
+
+// TcSnapshot responses the tc state of all interfaces as a JSON document, to restore it later, for example:
+//
+//	curl http://localhost:2023/tc/api/v1/snapshot > lab.json
+func TcSnapshot(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	snapshot, err := rules.SnapshotHost(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "snapshot")
+	}
+
+	b, err := json.MarshalIndent(snapshot, "", "    ")
+	if err != nil {
+		return errors.Wrapf(err, "marshal snapshot")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	return err
+}
+
+// TcSnapshotRestore rebuilds the tc state by the JSON document of snapshot, for example:
+//
+//	curl http://localhost:2023/tc/api/v1/snapshot/restore -X POST -d @lab.json
+func TcSnapshotRestore(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	snapshot := &HostSnapshot{}
+	defer r.Body.Close()
+	if b, err := ioutil.ReadAll(r.Body); err != nil {
+		return errors.Wrapf(err, "read body")
+	} else if err := json.Unmarshal(b, snapshot); err != nil {
+		return errors.Wrapf(err, "parse body")
+	}
+
+	if err := rules.RestoreHost(ctx, snapshot); err != nil {
+		return err
+	}
+
+	ohttp.WriteData(ctx, w, r, &struct {
+		Interfaces int `json:"interfaces"`
+		Rules      int `json:"rules"`
+	}{
+		Interfaces: len(snapshot.Interfaces), Rules: len(snapshot.Rules),
+	})
+	return nil
+}
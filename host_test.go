@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffHostInterface(t *testing.T) {
+	// The interface with a htb qdisc, a class, a netem qdisc of class, and a filter to the class.
+	newIface := func() *HostInterface {
+		return &HostInterface{
+			Name: "eth0",
+			Qdiscs: []*HostQdisc{
+				{Kind: "htb", Handle: "1a1a:", Parent: "root", Default: 1},
+				{Kind: "netem", Handle: "1a1b:", Parent: "1a1a:2", Netem: &HostNetem{Loss: 10}},
+			},
+			Classes: []*HostClass{{Kind: "htb", Classid: "1a1a:2", Parent: "1a1a:", Rate: 8000, Ceil: 8000}},
+			Filters: []*HostFilter{{
+				Kind: "u32", Handle: "800::800", Parent: "1a1a:", Prio: 1, Protocol: "ip", Flowid: "1a1a:2",
+				Keys: []*HostU32Key{{Val: "0x1f400000", Mask: "0xffff0000", Off: 20}},
+			}},
+		}
+	}
+	const filter = `filter parent 1a1a: prio 1 protocol ip keys [{"val":"0x1f400000","mask":"0xffff0000","off":20}]`
+
+	for _, c := range []struct {
+		name             string
+		expected, actual func() *HostInterface
+		diffs            []string
+	}{
+		{"same", newIface, newIface, []string{}},
+		{
+			// The handle of filter is allocated by kernel, so it's ignored.
+			"filter handle", newIface,
+			func() *HostInterface {
+				v := newIface()
+				v.Filters[0].Handle = "800::801"
+				return v
+			},
+			[]string{},
+		},
+		{
+			"missing", newIface,
+			func() *HostInterface {
+				return nil
+			},
+			[]string{"missing qdisc 1a1a:", "missing qdisc 1a1b:", "missing class 1a1a:2", "missing " + filter},
+		},
+		{
+			"unexpected",
+			func() *HostInterface {
+				return &HostInterface{Name: "eth0"}
+			},
+			newIface,
+			[]string{"unexpected qdisc 1a1a:", "unexpected qdisc 1a1b:", "unexpected class 1a1a:2", "unexpected " + filter},
+		},
+		{
+			"changed", newIface,
+			func() *HostInterface {
+				v := newIface()
+				v.Qdiscs[1].Netem.Loss, v.Classes[0].Rate, v.Filters[0].Flowid = 20, 16000, "1a1a:3"
+				return v
+			},
+			[]string{"changed qdisc 1a1b:", "changed class 1a1a:2", "changed " + filter},
+		},
+		{
+			// The filters of the same parent, priority, protocol and keys are matched in order.
+			"duplicated filter",
+			func() *HostInterface {
+				v := newIface()
+				v.Filters = append(v.Filters, v.Filters[0])
+				return v
+			},
+			newIface,
+			[]string{"missing " + filter},
+		},
+		{
+			"replaced qdisc", newIface,
+			func() *HostInterface {
+				v := newIface()
+				v.Qdiscs[1].Handle = "1a1c:"
+				return v
+			},
+			[]string{"missing qdisc 1a1b:", "unexpected qdisc 1a1c:"},
+		},
+	} {
+		diffs := []string{}
+		for _, d := range diffHostInterface("eth0", c.expected(), c.actual()) {
+			if d.Iface != "eth0" {
+				t.Errorf("%v: invalid iface %v", c.name, d.Iface)
+			}
+			diffs = append(diffs, d.Change+" "+d.Object+" "+d.ID)
+		}
+		if !reflect.DeepEqual(diffs, c.diffs) {
+			t.Errorf("%v: expect %v, actual %v", c.name, c.diffs, diffs)
+		}
+	}
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The directions in the setting of tcconfig, in the order to import and export.
+var tcconfigDirections = []string{"incoming", "outgoing"}
+
+// chromeCondition is a custom throttling profile of Chrome DevTools, the throughput in bytes/s, the latency is the
+// round trip time in ms, and the packet loss in %.
+type chromeCondition struct {
+	Title      string  `json:"title"`
+	Download   float64 `json:"download"`
+	Upload     float64 `json:"upload"`
+	Latency    float64 `json:"latency"`
+	PacketLoss float64 `json:"packetLoss"`
+}
+
+// parseChromeProfiles parses the custom throttling of Chrome DevTools, which is an array of conditions, or one
+// condition, or the preferences with customNetworkConditions, which might be an array in a JSON string.
+func parseChromeProfiles(content []byte) ([]*NetworkProfile, error) {
+	var conditions []*chromeCondition
+	if text := strings.TrimSpace(string(content)); strings.HasPrefix(text, "[") {
+		if err := json.Unmarshal(content, &conditions); err != nil {
+			return nil, errors.Wrapf(err, "parse conditions")
+		}
+	} else {
+		var preferences map[string]json.RawMessage
+		if err := json.Unmarshal(content, &preferences); err != nil {
+			return nil, errors.Wrapf(err, "parse preferences")
+		}
+
+		if raw, ok := preferences["customNetworkConditions"]; !ok {
+			condition := &chromeCondition{}
+			if err := json.Unmarshal(content, condition); err != nil {
+				return nil, errors.Wrapf(err, "parse condition")
+			}
+			conditions = append(conditions, condition)
+		} else {
+			// The preferences of DevTools stores the conditions as a JSON string.
+			var s string
+			if err := json.Unmarshal(raw, &s); err == nil {
+				raw = json.RawMessage(s)
+			}
+			if err := json.Unmarshal(raw, &conditions); err != nil {
+				return nil, errors.Wrapf(err, "parse customNetworkConditions")
+			}
+		}
+	}
+
+	var imported []*NetworkProfile
+	for i, condition := range conditions {
+		profile := &NetworkProfile{
+			Name:        importedProfileName(condition.Title, fmt.Sprintf("chrome-%v", i+1)),
+			Description: fmt.Sprintf("Imported from Chrome DevTools %v", condition.Title),
+		}
+
+		// The latency is added to the round trip, so each direction takes half of it.
+		build := func(throughput float64) []*NetworkStrategy {
+			var strategies []*NetworkStrategy
+			if throughput > 0 {
+				strategies = append(strategies, &NetworkStrategy{Strategy: "rate", Rate: throughput * 8 / 1000})
+			}
+			if condition.Latency > 0 {
+				strategies = append(strategies, &NetworkStrategy{Strategy: "delay", Delay: condition.Latency / 2})
+			}
+			if condition.PacketLoss > 0 {
+				strategies = append(strategies, &NetworkStrategy{Strategy: "loss", Loss: condition.PacketLoss})
+			}
+			return strategies
+		}
+		profile.Downlink, profile.Uplink = build(condition.Download), build(condition.Upload)
+		imported = append(imported, profile)
+	}
+	return imported, nil
+}
+
+// The keys of a profile in the plist of Network Link Conditioner.
+var nlcProfileKeys = []string{
+	"DownlinkBandwidth", "DownlinkDelay", "DownlinkPacketLossRatio",
+	"UplinkBandwidth", "UplinkDelay", "UplinkPacketLossRatio",
+}
+
+// parseNLCProfiles parses the XML plist exported from Network Link Conditioner of Apple, which is a profile, or a
+// dict of profiles by name, for example, the Profiles in com.apple.network.prefPaneSimulate.plist. The name is for
+// the profile without a name.
+func parseNLCProfiles(content []byte, name string) ([]*NetworkProfile, error) {
+	if strings.HasPrefix(string(content), "bplist") {
+		return nil, errors.New("binary plist, please convert by plutil -convert xml1")
+	}
+
+	value, err := parsePlist(content)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse plist")
+	}
+
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("plist is not a dict")
+	}
+
+	var imported []*NetworkProfile
+	var collect func(dict map[string]interface{}, name string) error
+	collect = func(dict map[string]interface{}, name string) error {
+		for _, key := range nlcProfileKeys {
+			if _, ok := dict[key]; ok {
+				profile, err := nlcProfile(dict, name)
+				if err != nil {
+					return errors.Wrapf(err, "profile %v", name)
+				}
+				imported = append(imported, profile)
+				return nil
+			}
+		}
+
+		for _, key := range sortedKeys(dict) {
+			if child, ok := dict[key].(map[string]interface{}); ok {
+				if err := collect(child, key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := collect(dict, name); err != nil {
+		return nil, err
+	}
+
+	if len(imported) == 0 {
+		return nil, errors.New("no profile in plist")
+	}
+	return imported, nil
+}
+
+// The kbps of the bandwidth unit of Network Link Conditioner, 0 for bps, 1 for Kbps and 2 for Mbps.
+var nlcBandwidthUnits = []float64{0.001, 1, 1000}
+
+// nlcProfile converts the profile of Network Link Conditioner, the bandwidth unit is default to Kbps, the delay in
+// ms, and the packet loss is a ratio.
+func nlcProfile(dict map[string]interface{}, name string) (*NetworkProfile, error) {
+	number := func(key string) float64 {
+		if v, ok := dict[key].(float64); ok {
+			return v
+		}
+		return 0
+	}
+
+	build := func(prefix string) ([]*NetworkStrategy, error) {
+		var strategies []*NetworkStrategy
+		if bandwidth := number(prefix + "Bandwidth"); bandwidth > 0 {
+			unit := 1
+			if _, ok := dict[prefix+"BandwidthUnit"]; ok {
+				unit = int(number(prefix + "BandwidthUnit"))
+			}
+			if unit < 0 || unit >= len(nlcBandwidthUnits) {
+				return nil, errors.Errorf("invalid %vBandwidthUnit=%v", prefix, unit)
+			}
+			strategies = append(strategies, &NetworkStrategy{Strategy: "rate", Rate: bandwidth * nlcBandwidthUnits[unit]})
+		}
+		if delay := number(prefix + "Delay"); delay > 0 {
+			strategies = append(strategies, &NetworkStrategy{Strategy: "delay", Delay: delay})
+		}
+		if loss := number(prefix + "PacketLossRatio"); loss > 0 {
+			strategies = append(strategies, &NetworkStrategy{Strategy: "loss", Loss: loss * 100})
+		}
+		return strategies, nil
+	}
+
+	profile := &NetworkProfile{
+		Name:        importedProfileName(name, "nlc"),
+		Description: fmt.Sprintf("Imported from Network Link Conditioner %v", name),
+	}
+
+	var err error
+	if profile.Uplink, err = build("Uplink"); err != nil {
+		return nil, err
+	}
+	if profile.Downlink, err = build("Downlink"); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// parsePlist parses the XML plist to the values of Go, that is, the dict to map, the array to slice, the integer
+// and real to float64, the true and false to bool, and others to string.
+func parsePlist(content []byte) (interface{}, error) {
+	d := xml.NewDecoder(strings.NewReader(string(content)))
+	for {
+		start, err := nextPlistElement(d)
+		if err != nil {
+			return nil, err
+		}
+		if start == nil {
+			return nil, errors.New("no value")
+		}
+		if start.Name.Local != "plist" {
+			return decodePlistValue(d, start)
+		}
+	}
+}
+
+// nextPlistElement returns the next start element, or nil if the parent ends.
+func nextPlistElement(d *xml.Decoder) (*xml.StartElement, error) {
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			return &t, nil
+		case xml.EndElement:
+			return nil, nil
+		}
+	}
+}
+
+func decodePlistValue(d *xml.Decoder, start *xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "dict":
+		dict := make(map[string]interface{})
+		for {
+			key, err := nextPlistElement(d)
+			if err != nil || key == nil {
+				return dict, err
+			}
+			if key.Name.Local != "key" {
+				return nil, errors.Errorf("invalid element %v in dict", key.Name.Local)
+			}
+
+			var name string
+			if err := d.DecodeElement(&name, key); err != nil {
+				return nil, errors.Wrapf(err, "decode key")
+			}
+
+			value, err := nextPlistElement(d)
+			if err != nil {
+				return nil, err
+			}
+			if value == nil {
+				return nil, errors.Errorf("no value of key %v", name)
+			}
+			if dict[name], err = decodePlistValue(d, value); err != nil {
+				return nil, errors.Wrapf(err, "decode %v", name)
+			}
+		}
+	case "array":
+		array := []interface{}{}
+		for {
+			element, err := nextPlistElement(d)
+			if err != nil || element == nil {
+				return array, err
+			}
+			value, err := decodePlistValue(d, element)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+	case "true", "false":
+		if err := d.Skip(); err != nil {
+			return nil, err
+		}
+		return start.Name.Local == "true", nil
+	case "integer", "real":
+		var s string
+		if err := d.DecodeElement(&s, start); err != nil {
+			return nil, err
+		}
+		return strconv.ParseFloat(strings.TrimSpace(s), 64)
+	default:
+		var s string
+		if err := d.DecodeElement(&s, start); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+}
+
+var importedNameRegexp = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// importedProfileName converts the title of other tools to the name of profile, or the fallback if empty.
+func importedProfileName(title, fallback string) string {
+	name := strings.Trim(importedNameRegexp.ReplaceAllString(title, "-"), "-._")
+	if name == "" {
+		return fallback
+	}
+	return name
+}
+
+// parseTcconfigSetting parses the setting of tcconfig, which is the output of tcshow and the input of tcset
+// --import-setting, to the requests of rules, for example:
+//
+//	{"eth0": {"outgoing": {"dst-network=192.168.0.10/32, protocol=ip": {"delay": "10.0ms", "rate": "250Kbps"}},
+//	"incoming": {}}}
+func parseTcconfigSetting(content []byte) ([]*NetworkRequest, error) {
+	var setting map[string]map[string]map[string]map[string]interface{}
+	if err := json.Unmarshal(content, &setting); err != nil {
+		return nil, errors.Wrapf(err, "parse setting")
+	}
+
+	var ifaces []string
+	for iface := range setting {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+
+	var reqs []*NetworkRequest
+	for _, iface := range ifaces {
+		for direction := range setting[iface] {
+			if direction != "incoming" && direction != "outgoing" {
+				return nil, errors.Errorf("invalid direction=%v of iface=%v", direction, iface)
+			}
+		}
+
+		for _, direction := range tcconfigDirections {
+			filters := setting[iface][direction]
+
+			var keys []string
+			for key := range filters {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			for _, key := range keys {
+				req := &NetworkRequest{Iface: iface, Protocol: "ip", Direction: direction}
+				if err := parseTcconfigFilter(req, key); err != nil {
+					return nil, errors.Wrapf(err, "iface=%v, direction=%v, filter=%v", iface, direction, key)
+				}
+
+				strategies, err := parseTcconfigParams(filters[key])
+				if err != nil {
+					return nil, errors.Wrapf(err, "iface=%v, direction=%v, filter=%v", iface, direction, key)
+				}
+				req.Strategies = strategies
+				reqs = append(reqs, req)
+			}
+		}
+	}
+	return reqs, nil
+}
+
+// parseTcconfigFilter parses the filter of tcconfig to the identifyKey and identifyValue of request, for example,
+// dst-network=192.168.0.10/32, protocol=ip.
+func parseTcconfigFilter(req *NetworkRequest, filter string) error {
+	req.IdentifyKey = "all"
+	for _, field := range strings.Split(filter, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("invalid filter %v", field)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		// The tcconfig doesn't filter by protocol, it's always ip.
+		if key == "protocol" {
+			continue
+		}
+
+		var identifyKey string
+		for _, k := range []string{"serverPort", "clientIp", "clientPort"} {
+			if tcconfigFilterKey(&NetworkOptions{direction: req.Direction, identifyKey: k}) == key {
+				identifyKey = k
+			}
+		}
+		if identifyKey == "" {
+			return errors.Errorf("invalid filter %v for direction=%v", key, req.Direction)
+		}
+		if req.IdentifyKey != "all" {
+			return errors.Errorf("only one filter allowed, %v and %v", req.IdentifyKey, identifyKey)
+		}
+		req.IdentifyKey, req.IdentifyValue = identifyKey, value
+	}
+	return nil
+}
+
+var tcconfigValueRegexp = regexp.MustCompile(`^([0-9.]+)\s*([A-Za-z%/]*)$`)
+
+// parseTcconfigParams parses the shaping parameters of tcconfig to the strategies, the rate in bps, Kbps, Mbps
+// or Gbps, the delay in us, ms or sec, and others in %.
+func parseTcconfigParams(params map[string]interface{}) ([]*NetworkStrategy, error) {
+	parse := func(key string) (float64, string, error) {
+		value := strings.TrimSpace(fmt.Sprint(params[key]))
+		matches := tcconfigValueRegexp.FindStringSubmatch(value)
+		if matches == nil {
+			return 0, "", errors.Errorf("invalid %v=%v", key, value)
+		}
+		v, err := strconv.ParseFloat(matches[1], 64)
+		if err != nil {
+			return 0, "", errors.Wrapf(err, "parse %v=%v", key, value)
+		}
+		return v, strings.ToLower(matches[2]), nil
+	}
+
+	delay := &NetworkStrategy{Strategy: "delay"}
+	strategies := []*NetworkStrategy{delay}
+	for _, key := range sortedKeys(params) {
+		if key == "filter_id" {
+			continue
+		}
+		if key == "delay-distribution" {
+			delay.Distribution = fmt.Sprint(params[key])
+			continue
+		}
+
+		v, unit, err := parse(key)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key {
+		case "rate":
+			scales := map[string]float64{"bps": 0.001, "kbps": 1, "mbps": 1000, "gbps": 1000000,
+				"bit": 0.001, "kbit": 1, "mbit": 1000, "gbit": 1000000,
+			}
+			scale, ok := scales[strings.TrimSuffix(unit, "/s")]
+			if !ok {
+				return nil, errors.Errorf("invalid rate unit %v", unit)
+			}
+			strategies = append(strategies, &NetworkStrategy{Strategy: "rate", Rate: v * scale})
+		case "delay", "delay-distro":
+			scales := map[string]float64{"": 1, "ms": 1, "msec": 1, "us": 0.001, "usec": 0.001, "s": 1000, "sec": 1000}
+			scale, ok := scales[unit]
+			if !ok {
+				return nil, errors.Errorf("invalid %v unit %v", key, unit)
+			}
+			if key == "delay" {
+				delay.Delay = v * scale
+			} else {
+				delay.DelayDistro = v * scale
+			}
+		case "loss", "duplicate", "corrupt", "reordering":
+			if unit != "" && unit != "%" {
+				return nil, errors.Errorf("invalid %v unit %v", key, unit)
+			}
+			switch key {
+			case "loss":
+				strategies = append(strategies, &NetworkStrategy{Strategy: "loss", Loss: v})
+			case "duplicate":
+				strategies = append(strategies, &NetworkStrategy{Strategy: "duplicate", Duplicate: v})
+			case "corrupt":
+				strategies = append(strategies, &NetworkStrategy{Strategy: "corrupt", Corrupt: v})
+			case "reordering":
+				strategies = append(strategies, &NetworkStrategy{Strategy: "reorder", Reorder: v})
+			}
+		default:
+			return nil, errors.Errorf("invalid parameter %v", key)
+		}
+	}
+
+	// Remove the delay if not set, note that the distro requires delay.
+	if delay.Delay == 0 && delay.DelayDistro == 0 && delay.Distribution == "" {
+		strategies = strategies[1:]
+	}
+	if len(strategies) == 0 {
+		return nil, errors.New("no parameter")
+	}
+	return strategies, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// buildTcconfigSetting builds the setting of tcconfig from the rules, so it can be applied by tcset
+// --import-setting on a machine with tcconfig only. Note that the excluded API port is not in the setting, and the
+// setting doesn't filter by IP protocol, so the rule of tcp, udp or icmp is rejected, rather than match all IP
+// protocols silently.
+func buildTcconfigSetting(rules []*NetworkRule) (map[string]map[string]map[string]map[string]string, error) {
+	setting := make(map[string]map[string]map[string]map[string]string)
+	for _, rule := range rules {
+		opts := rule.opts
+		if tcIPProtocolOf(opts.protocol) != 0 {
+			return nil, errors.Errorf("rule %v: tcconfig can't filter protocol=%v", rule.ID, opts.protocol)
+		}
+
+		var params []string
+		for _, strategy := range opts.strategies {
+			if p, err := tcconfigStrategyParams(strategy); err != nil {
+				return nil, errors.Wrapf(err, "rule %v", rule.ID)
+			} else {
+				params = append(params, p...)
+			}
+		}
+
+		values, err := (&tcconfigShaper{}).identifyValues(opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rule %v", rule.ID)
+		}
+
+		if _, ok := setting[opts.iface]; !ok {
+			setting[opts.iface] = make(map[string]map[string]map[string]string)
+			for _, direction := range tcconfigDirections {
+				setting[opts.iface][direction] = make(map[string]map[string]string)
+			}
+		}
+
+		// Each value of filter is a rule in tcconfig, for example, dst-network=10.0.0.1/32, protocol=ip.
+		for _, value := range values {
+			filter := "protocol=ip"
+			if key := tcconfigFilterKey(opts); key != "" {
+				if opts.identifyKey == "clientIp" {
+					if ipnet, err := parseClientIP(value); err == nil {
+						value = ipnet.String()
+					}
+				}
+				filter = fmt.Sprintf("%v=%v, %v", key, value, filter)
+			}
+
+			if _, ok := setting[opts.iface][opts.direction][filter]; ok {
+				return nil, errors.Errorf("rule %v: duplicated filter %v", rule.ID, filter)
+			}
+
+			shaping := make(map[string]string)
+			for i := 0; i < len(params); i += 2 {
+				shaping[params[i]] = params[i+1]
+			}
+			setting[opts.iface][opts.direction][filter] = shaping
+		}
+	}
+	return setting, nil
+}
+
+// TcProfileImport imports the profiles of other tools by the body, the format is chrome for the custom throttling
+// JSON of Chrome DevTools, or nlc for the XML plist of Network Link Conditioner. The name is for the profile
+// without a name, and the existing profiles are updated if overwrite is true.
+func TcProfileImport(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	format, overwrite := q.Get("format"), q.Get("overwrite") == "true"
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errors.Wrapf(err, "read body")
+	}
+
+	var imported []*NetworkProfile
+	switch format {
+	case "chrome":
+		imported, err = parseChromeProfiles(b)
+	case "nlc":
+		imported, err = parseNLCProfiles(b, q.Get("name"))
+	default:
+		return errors.Errorf("invalid format=%v", format)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "parse %v", format)
+	}
+
+	if err := profiles.Import(ctx, imported, overwrite); err != nil {
+		return err
+	}
+
+	ohttp.WriteData(ctx, w, r, &struct {
+		Profiles []*NetworkProfile `json:"profiles"`
+	}{
+		Profiles: imported,
+	})
+	return nil
+}
+
+// TcImport imports the setting of tcconfig by the body, which overwrites the rules of the interfaces in it, or
+// rolls back if failed. The format is tcconfig, which is the default.
+func TcImport(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if format := r.URL.Query().Get("format"); format != "" && format != "tcconfig" {
+		return errors.Errorf("invalid format=%v", format)
+	}
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errors.Wrapf(err, "read body")
+	}
+
+	reqs, err := parseTcconfigSetting(b)
+	if err != nil {
+		return errors.Wrapf(err, "parse tcconfig")
+	}
+	if len(reqs) == 0 {
+		return errors.New("no rule in setting")
+	}
+
+	imported, err := rules.Import(ctx, reqs)
+	if err != nil {
+		return err
+	}
+
+	logger.Tf(ctx, "Import %v rules from tcconfig", len(imported))
+	ohttp.WriteData(ctx, w, r, &struct {
+		Rules []*NetworkRule `json:"rules"`
+	}{
+		Rules: imported,
+	})
+	return nil
+}
+
+// TcExport exports the rules of the interface, or all rules if iface is empty, to the setting of tcconfig, which is
+// written as is, so it can be applied by tcset --import-setting.
+func TcExport(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	if format := q.Get("format"); format != "" && format != "tcconfig" {
+		return errors.Errorf("invalid format=%v", format)
+	}
+
+	iface := q.Get("iface")
+	setting, err := buildTcconfigSetting(rules.List(iface))
+	if err != nil {
+		return errors.Wrapf(err, "export tcconfig")
+	}
+
+	b, err := json.MarshalIndent(setting, "", "    ")
+	if err != nil {
+		return errors.Wrapf(err, "marshal setting")
+	}
+
+	logger.Tf(ctx, "Export tcconfig for iface=%v, %v", iface, string(b))
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	return err
+}
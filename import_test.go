@@ -0,0 +1,225 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTcconfigSetting(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		setting  string
+		expected []*NetworkRequest
+	}{
+		{
+			"network", `{"eth0": {"outgoing": {"dst-network=192.168.0.10/32, protocol=ip": {"delay": "10.0ms",
+			"rate": "250Kbps"}}, "incoming": {}}}`,
+			[]*NetworkRequest{{
+				Iface: "eth0", Protocol: "ip", Direction: "outgoing",
+				IdentifyKey: "clientIp", IdentifyValue: "192.168.0.10/32",
+				Strategies: []*NetworkStrategy{{Strategy: "delay", Delay: 10}, {Strategy: "rate", Rate: 250}},
+			}},
+		},
+		{
+			// The interfaces are sorted, and the incoming is before outgoing.
+			"directions", `{"lo": {"outgoing": {"protocol=ip": {"loss": "1%"}}},
+			"eth0": {"outgoing": {"src-port=8000": {"loss": "2%", "filter_id": "800::800"}},
+			"incoming": {"dst-port=9000": {"loss": "3%"}, "src-network=10.0.0.0/8": {"loss": "4%"}}}}`,
+			[]*NetworkRequest{
+				{
+					Iface: "eth0", Protocol: "ip", Direction: "incoming", IdentifyKey: "serverPort", IdentifyValue: "9000",
+					Strategies: []*NetworkStrategy{{Strategy: "loss", Loss: 3}},
+				},
+				{
+					Iface: "eth0", Protocol: "ip", Direction: "incoming", IdentifyKey: "clientIp", IdentifyValue: "10.0.0.0/8",
+					Strategies: []*NetworkStrategy{{Strategy: "loss", Loss: 4}},
+				},
+				{
+					Iface: "eth0", Protocol: "ip", Direction: "outgoing", IdentifyKey: "serverPort", IdentifyValue: "8000",
+					Strategies: []*NetworkStrategy{{Strategy: "loss", Loss: 2}},
+				},
+				{
+					Iface: "lo", Protocol: "ip", Direction: "outgoing", IdentifyKey: "all",
+					Strategies: []*NetworkStrategy{{Strategy: "loss", Loss: 1}},
+				},
+			},
+		},
+		{"empty", `{"eth0": {"outgoing": {}, "incoming": {}}}`, nil},
+	} {
+		reqs, err := parseTcconfigSetting([]byte(c.setting))
+		if err != nil {
+			t.Errorf("%v: err %+v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(reqs, c.expected) {
+			t.Errorf("%v: expect %v, actual %v", c.name, c.expected, reqs)
+		}
+	}
+}
+
+func TestParseTcconfigSettingError(t *testing.T) {
+	for _, c := range []struct {
+		name, setting string
+	}{
+		{"json", `{"eth0": `},
+		{"direction", `{"eth0": {"both": {}}}`},
+		{"filter", `{"eth0": {"incoming": {"dst-network=10.0.0.1/32": {"loss": "1%"}}}}`},
+		{"filter value", `{"eth0": {"incoming": {"dst-port": {"loss": "1%"}}}}`},
+		{"two filters", `{"eth0": {"outgoing": {"src-port=8000, dst-network=10.0.0.1/32": {"loss": "1%"}}}}`},
+		{"no parameter", `{"eth0": {"outgoing": {"protocol=ip": {}}}}`},
+		{"parameter", `{"eth0": {"outgoing": {"protocol=ip": {"jitter": "1ms"}}}}`},
+	} {
+		if reqs, err := parseTcconfigSetting([]byte(c.setting)); err == nil {
+			t.Errorf("%v: expect error, actual %v", c.name, reqs)
+		}
+	}
+}
+
+func TestBuildTcconfigSetting(t *testing.T) {
+	rule := func(protocol, key, value string) []*NetworkRule {
+		req := &NetworkRequest{
+			Iface: "eth0", Protocol: protocol, Direction: "outgoing", IdentifyKey: key, IdentifyValue: value,
+			Strategies: []*NetworkStrategy{{Strategy: "rate", Rate: 1000}},
+		}
+		return []*NetworkRule{{ID: "1", Request: req, opts: req.Options()}}
+	}
+
+	for _, c := range []struct {
+		name    string
+		rules   []*NetworkRule
+		filter  string
+		success bool
+	}{
+		{"all", rule("all", "all", ""), "protocol=ip", true},
+		{"ip", rule("ip", "clientIp", "10.0.0.5"), "dst-network=10.0.0.5/32, protocol=ip", true},
+		{"tcp", rule("tcp", "all", ""), "", false},
+		{"udp", rule("udp", "serverPort", "8000"), "", false},
+		{"icmp", rule("icmp", "clientIp", "10.0.0.5"), "", false},
+	} {
+		setting, err := buildTcconfigSetting(c.rules)
+		if (err == nil) != c.success {
+			t.Errorf("%v: expect success=%v, actual err %v", c.name, c.success, err)
+		} else if _, ok := setting["eth0"]["outgoing"][c.filter]; c.success && !ok {
+			t.Errorf("%v: expect filter %v, actual %v", c.name, c.filter, setting)
+		}
+	}
+}
+
+func TestParseTcconfigParams(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		params   map[string]interface{}
+		expected []*NetworkStrategy
+	}{
+		{"rate in Mbps", map[string]interface{}{"rate": "1Mbps"}, []*NetworkStrategy{{Strategy: "rate", Rate: 1000}}},
+		{"rate in kbit/s", map[string]interface{}{"rate": "100Kbit/s"}, []*NetworkStrategy{{Strategy: "rate", Rate: 100}}},
+		{"rate in bps", map[string]interface{}{"rate": "500bps"}, []*NetworkStrategy{{Strategy: "rate", Rate: 0.5}}},
+		{"rate in Gbps", map[string]interface{}{"rate": "1 Gbps"}, []*NetworkStrategy{{Strategy: "rate", Rate: 1000000}}},
+		{"delay in sec", map[string]interface{}{"delay": "1sec"}, []*NetworkStrategy{{Strategy: "delay", Delay: 1000}}},
+		{"delay in us", map[string]interface{}{"delay": "500us"}, []*NetworkStrategy{{Strategy: "delay", Delay: 0.5}}},
+		{"delay in number", map[string]interface{}{"delay": 10}, []*NetworkStrategy{{Strategy: "delay", Delay: 10}}},
+		{
+			"delay distribution",
+			map[string]interface{}{"delay": "100ms", "delay-distro": "20ms", "delay-distribution": "normal"},
+			[]*NetworkStrategy{{Strategy: "delay", Delay: 100, DelayDistro: 20, Distribution: "normal"}},
+		},
+		{
+			// The delay is always the first, and others are sorted by key.
+			"all",
+			map[string]interface{}{
+				"reordering": "3%", "loss": "0.1%", "duplicate": "1", "corrupt": "2%", "delay": "10ms",
+				"filter_id": "800::800",
+			},
+			[]*NetworkStrategy{
+				{Strategy: "delay", Delay: 10}, {Strategy: "corrupt", Corrupt: 2}, {Strategy: "duplicate", Duplicate: 1},
+				{Strategy: "loss", Loss: 0.1}, {Strategy: "reorder", Reorder: 3},
+			},
+		},
+	} {
+		strategies, err := parseTcconfigParams(c.params)
+		if err != nil {
+			t.Errorf("%v: err %+v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(strategies, c.expected) {
+			t.Errorf("%v: expect %v, actual %v", c.name, c.expected, strategies)
+		}
+	}
+}
+
+func TestParseTcconfigParamsError(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		params map[string]interface{}
+	}{
+		{"empty", map[string]interface{}{}},
+		{"filter only", map[string]interface{}{"filter_id": "800::800"}},
+		{"rate unit", map[string]interface{}{"rate": "1Tbps"}},
+		{"delay unit", map[string]interface{}{"delay": "10min"}},
+		{"loss unit", map[string]interface{}{"loss": "5ms"}},
+		{"number", map[string]interface{}{"loss": "abc"}},
+		{"negative", map[string]interface{}{"loss": "-1%"}},
+		{"parameter", map[string]interface{}{"jitter": "1ms"}},
+	} {
+		if strategies, err := parseTcconfigParams(c.params); err == nil {
+			t.Errorf("%v: expect error, actual %v", c.name, strategies)
+		}
+	}
+}
+
+func TestParsePlist(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		content  string
+		expected interface{}
+	}{
+		{
+			"dict", `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Name</key><string>3G</string>
+	<key>Rate</key><integer>780</integer>
+	<key>Loss</key><real> 0.5 </real>
+	<key>On</key><true/>
+	<key>Off</key><false/>
+	<key>List</key><array><integer>1</integer><string>a</string><dict/></array>
+	<key>Empty</key><dict></dict>
+</dict>
+</plist>`,
+			map[string]interface{}{
+				"Name": "3G", "Rate": float64(780), "Loss": 0.5, "On": true, "Off": false,
+				"List": []interface{}{float64(1), "a", map[string]interface{}{}}, "Empty": map[string]interface{}{},
+			},
+		},
+		{"array", `<plist><array/></plist>`, []interface{}{}},
+		{"no plist", `<string>value</string>`, "value"},
+	} {
+		v, err := parsePlist([]byte(c.content))
+		if err != nil {
+			t.Errorf("%v: err %+v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, c.expected) {
+			t.Errorf("%v: expect %v, actual %v", c.name, c.expected, v)
+		}
+	}
+}
+
+func TestParsePlistError(t *testing.T) {
+	for _, c := range []struct {
+		name, content string
+	}{
+		{"empty", ``},
+		{"no value", `<plist></plist>`},
+		{"element in dict", `<plist><dict><string>a</string></dict></plist>`},
+		{"no value of key", `<plist><dict><key>a</key></dict></plist>`},
+		{"integer", `<plist><integer>abc</integer></plist>`},
+		{"value of key", `<plist><dict><key>a</key><real>x</real></dict></plist>`},
+		{"xml", `<plist><dict><key>a</key><string>b</dict></plist>`},
+	} {
+		if v, err := parsePlist([]byte(c.content)); err == nil {
+			t.Errorf("%v: expect error, actual %v", c.name, v)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	jobRunning  = "running"
+	jobPaused   = "paused"
+	jobStopped  = "stopped"
+	jobFinished = "finished"
+	jobFailed   = "failed"
+)
+
+// The min interval in ms between transitions of job, because each transition changes the rule in kernel, under the
+// lock of rules.
+const jobMinInterval = 100
+
+// networkJobMode is the mode of job, for example, scenario, outage or chaos, which decides the transitions of the
+// network. The fields changed by the mode should be protected by the lock of job.
+type networkJobMode interface {
+	fmt.Stringer
+	// job returns the common state of job.
+	job() *networkJob
+	// next prepares the transition scheduled at the time, and returns the duration to hold it, or false if the job
+	// is finished.
+	next(at time.Time) (time.Duration, bool)
+	// apply applies the transition prepared by next.
+	apply(ctx context.Context) error
+	// clean restores the network when the job is done.
+	clean(ctx context.Context) error
+}
+
+// networkJob is the common state of job, which changes the network by a goroutine, and is controlled by the API.
+type networkJob struct {
+	// The ID assigned by server.
+	ID string `json:"id"`
+	// The state, running, paused, stopped, finished or failed.
+	State string `json:"state"`
+	// The time of next transition.
+	NextAt time.Time `json:"nextAt"`
+	// The ID of rule owned by job, which is added by the job, and deleted when done.
+	Rule string `json:"rule,omitempty"`
+	// The error if failed.
+	Error string `json:"error,omitempty"`
+
+	// The kind of job, and the interface and direction changed by it.
+	kind, iface, direction string
+
+	// To notify the goroutine about the state changed by the API.
+	notify chan struct{}
+	// Closed when the goroutine is done, and the network is restored.
+	done chan struct{}
+	// The error if failed to restore the network when done.
+	cleanError error
+	lock       sync.Mutex
+}
+
+func (v *networkJob) job() *networkJob {
+	return v
+}
+
+// active whether the job is running or paused.
+func (v *networkJob) active() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.State == jobRunning || v.State == jobPaused
+}
+
+// transit changes the state from one to another, and notifies the goroutine.
+func (v *networkJob) transit(from []string, to string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, state := range from {
+		if v.State == state {
+			v.State = to
+			select {
+			case v.notify <- struct{}{}:
+			default:
+			}
+			return nil
+		}
+	}
+	return errors.Errorf("%v %v is %v", v.kind, v.ID, v.State)
+}
+
+// marshal marshals the snapshot of the job in mode, because the state is changed by the goroutine.
+func (v *networkJob) marshal(mode networkJobMode) (json.RawMessage, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return json.Marshal(mode)
+}
+
+// run applies the transitions of mode one by one, and always cleans the network when done. The transition is
+// scheduled from the previous one, so the time to apply never drifts the schedule.
+func (v *networkJob) run(ctx context.Context, mode networkJobMode) {
+	defer close(v.done)
+	defer func() {
+		err := mode.clean(ctx)
+
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		if err != nil {
+			v.State, v.Error, v.cleanError = jobFailed, err.Error(), err
+			logger.Wf(ctx, "Job %v clean err %+v", v.ID, err)
+		}
+		v.NextAt = time.Time{}
+		logger.Tf(ctx, "Job %v done, state=%v, %v", v.ID, v.State, mode)
+	}()
+
+	deadline := time.Now()
+	for {
+		hold, ok := mode.next(deadline)
+		if !ok {
+			break
+		}
+
+		if err := mode.apply(ctx); err != nil {
+			v.lock.Lock()
+			v.State, v.Error = jobFailed, err.Error()
+			v.lock.Unlock()
+			logger.Wf(ctx, "Job %v err %+v", v.ID, err)
+			return
+		}
+
+		if deadline, ok = v.wait(deadline.Add(hold)); !ok {
+			return
+		}
+	}
+
+	v.transit([]string{jobRunning, jobPaused}, jobFinished)
+}
+
+// wait waits until the deadline, which is delayed by pause. It returns the deadline, or false if stopped.
+func (v *networkJob) wait(deadline time.Time) (time.Time, bool) {
+	for {
+		v.lock.Lock()
+		v.NextAt = deadline
+		v.lock.Unlock()
+
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-timer.C:
+			return deadline, true
+		case <-v.notify:
+			timer.Stop()
+		}
+
+		v.lock.Lock()
+		state := v.State
+		v.lock.Unlock()
+
+		if state == jobStopped {
+			return deadline, false
+		}
+		if state != jobPaused {
+			continue
+		}
+
+		// Keep the network of transition when paused, and resume the rest of it.
+		remaining := time.Until(deadline)
+		for state == jobPaused {
+			<-v.notify
+
+			v.lock.Lock()
+			state = v.State
+			v.lock.Unlock()
+		}
+		if state == jobStopped {
+			return deadline, false
+		}
+		deadline = time.Now().Add(remaining)
+	}
+}
+
+// applyRule applies the strategies to the rule owned by job. The rule is added by the first transition, and
+// updated in place by others, so the queue is not flushed. It's deleted if no strategies, for clean network.
+func (v *networkJob) applyRule(ctx context.Context, req *NetworkRequest) error {
+	if len(req.Strategies) == 0 {
+		return v.deleteRule(ctx)
+	}
+
+	if v.Rule != "" {
+		if _, err := rules.Update(ctx, v.Rule, req.Strategies); err != nil {
+			return errors.Wrapf(err, "update rule %v", v.Rule)
+		}
+		return nil
+	}
+
+	rule, err := rules.AddByJob(ctx, v.ID, req)
+	if err != nil {
+		return errors.Wrapf(err, "add rule")
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.Rule = rule.ID
+	return nil
+}
+
+// deleteRule deletes the rule owned by job, without touching other rules of the interface. The rule which is already
+// deleted by others is ignored.
+func (v *networkJob) deleteRule(ctx context.Context) error {
+	if v.Rule == "" {
+		return nil
+	}
+
+	if rules.Get(v.Rule) != nil {
+		if _, err := rules.Delete(ctx, v.Rule); err != nil {
+			return errors.Wrapf(err, "delete rule %v", v.Rule)
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.Rule = ""
+	return nil
+}
+
+// clean deletes the rule owned by job when done.
+func (v *networkJob) clean(ctx context.Context) error {
+	return v.deleteRule(ctx)
+}
+
+// jobManager manages the jobs, at most one active job for each direction of an interface, so a job never changes
+// the rules of another one.
+type jobManager struct {
+	// The jobs in the order of creation.
+	jobs []networkJobMode
+	// The last number of ID for each kind.
+	lastIDs map[string]uint64
+	lock    sync.Mutex
+}
+
+var jobs = &jobManager{lastIDs: make(map[string]uint64)}
+
+// Start assigns the ID of job, and starts the goroutine to run it.
+func (v *jobManager) Start(ctx context.Context, mode networkJobMode) error {
+	job := mode.job()
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, m := range v.jobs {
+		if other := m.job(); other.iface == job.iface && other.direction == job.direction && other.active() {
+			return errors.Errorf("%v %v is active for iface=%v, direction=%v",
+				other.kind, other.ID, job.iface, job.direction,
+			)
+		}
+	}
+
+	v.lastIDs[job.kind]++
+	job.ID, job.State = fmt.Sprintf("%v-%v", job.kind, v.lastIDs[job.kind]), jobRunning
+	job.notify, job.done = make(chan struct{}, 1), make(chan struct{})
+	v.jobs = append(v.jobs, mode)
+
+	logger.Tf(ctx, "Start %v %v", job.kind, mode)
+	go job.run(ctx, mode)
+	return nil
+}
+
+// Get returns the job of kind by ID, or nil if not exists.
+func (v *jobManager) Get(kind, id string) networkJobMode {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, mode := range v.jobs {
+		if job := mode.job(); job.kind == kind && job.ID == id {
+			return mode
+		}
+	}
+	return nil
+}
+
+// List returns all jobs of kind.
+func (v *jobManager) List(kind string) []networkJobMode {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var modes []networkJobMode
+	for _, mode := range v.jobs {
+		if mode.job().kind == kind {
+			modes = append(modes, mode)
+		}
+	}
+	return modes
+}
+
+// writeJob responses the snapshot of job.
+func writeJob(ctx context.Context, w http.ResponseWriter, r *http.Request, mode networkJobMode) error {
+	b, err := mode.job().marshal(mode)
+	if err != nil {
+		return errors.Wrapf(err, "marshal %v", mode.job().ID)
+	}
+
+	ohttp.WriteData(ctx, w, r, b)
+	return nil
+}
+
+// transitJob changes the state of job of kind by id, and responses after the network is restored if stopped, or the
+// error if failed to restore.
+func transitJob(ctx context.Context, w http.ResponseWriter, r *http.Request, kind, to string, from ...string) error {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		return errors.New("no id")
+	}
+
+	mode := jobs.Get(kind, id)
+	if mode == nil {
+		return errors.Errorf("no %v %v", kind, id)
+	}
+
+	job := mode.job()
+	if err := job.transit(from, to); err != nil {
+		return err
+	}
+	if to == jobStopped {
+		<-job.done
+
+		job.lock.Lock()
+		err := job.cleanError
+		job.lock.Unlock()
+		if err != nil {
+			return errors.Wrapf(err, "clean %v", id)
+		}
+	}
+
+	logger.Tf(ctx, "Job %v is %v", id, to)
+	return writeJob(ctx, w, r, mode)
+}
+
+// statusJob responses the job of kind by id, or all jobs of kind in the field if no id.
+func statusJob(ctx context.Context, w http.ResponseWriter, r *http.Request, kind, field string) error {
+	id := r.URL.Query().Get("id")
+	if id != "" {
+		mode := jobs.Get(kind, id)
+		if mode == nil {
+			return errors.Errorf("no %v %v", kind, id)
+		}
+		return writeJob(ctx, w, r, mode)
+	}
+
+	snapshots := []json.RawMessage{}
+	for _, mode := range jobs.List(kind) {
+		b, err := mode.job().marshal(mode)
+		if err != nil {
+			return errors.Wrapf(err, "marshal %v", mode.job().ID)
+		}
+		snapshots = append(snapshots, b)
+	}
+
+	ohttp.WriteData(ctx, w, r, map[string][]json.RawMessage{field: snapshots})
+	return nil
+}
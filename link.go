@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io/ioutil"
+	"net/http"
+)
+
+// NetworkLinkRequest is the request of a link profile, with the impairments of both directions of a client, for
+// example, the uplink is 1mbps with 5% loss, and the downlink is 10mbps with 100ms delay.
+type NetworkLinkRequest struct {
+	Iface         string `json:"iface"`
+	Protocol      string `json:"protocol"`
+	IdentifyKey   string `json:"identifyKey"`
+	IdentifyValue string `json:"identifyValue"`
+	// The api listen port to exclude, default to API_LISTEN.
+	API string `json:"api,omitempty"`
+	// The duration in seconds to revert to the previous state, 0 to keep it until reset.
+	Duration int `json:"duration,omitempty"`
+	// The name of profile, which is expanded to the strategies of uplink and downlink.
+	Profile string `json:"profile,omitempty"`
+	// The strategies of uplink, which is the traffic from client, that is the incoming direction.
+	Uplink []*NetworkStrategy `json:"uplink"`
+	// The strategies of downlink, which is the traffic to client, that is the outgoing direction.
+	Downlink []*NetworkStrategy `json:"downlink"`
+}
+
+// Requests converts the link to the requests of uplink and downlink.
+func (v *NetworkLinkRequest) Requests() (uplink, downlink *NetworkRequest) {
+	build := func(direction string, strategies []*NetworkStrategy) *NetworkRequest {
+		return &NetworkRequest{
+			Iface: v.Iface, Protocol: v.Protocol, Direction: direction,
+			IdentifyKey: v.IdentifyKey, IdentifyValue: v.IdentifyValue, API: v.API,
+			Strategies: strategies,
+		}
+	}
+	return build("incoming", v.Uplink), build("outgoing", v.Downlink)
+}
+
+// NetworkLink is a link profile, which is a pair of rules applied as one unit.
+type NetworkLink struct {
+	// The ID assigned by server.
+	ID    string `json:"id"`
+	Iface string `json:"iface"`
+	// The rule of uplink, or nil if it's overwritten by other setup.
+	Uplink *NetworkRule `json:"uplink"`
+	// The rule of downlink, or nil if it's overwritten by other setup.
+	Downlink *NetworkRule `json:"downlink"`
+}
+
+// TcLink setups the uplink and downlink by the JSON body, for example:
+//
+//	{"iface": "lo", "protocol": "udp", "identifyKey": "serverPort", "identifyValue": "8000",
+//	"uplink": [{"strategy": "rate", "rate": 1000}, {"strategy": "loss", "loss": 5}],
+//	"downlink": [{"strategy": "rate", "rate": 10000}, {"strategy": "delay", "delay": 100}]}
+//
+// Both directions are overwritten, or neither if failed.
+func TcLink(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	req := &NetworkLinkRequest{}
+	defer r.Body.Close()
+	if b, err := ioutil.ReadAll(r.Body); err != nil {
+		return errors.Wrapf(err, "read body")
+	} else if err := json.Unmarshal(b, req); err != nil {
+		return errors.Wrapf(err, "parse body %v", string(b))
+	}
+
+	if req.Profile != "" {
+		if len(req.Uplink) > 0 || len(req.Downlink) > 0 {
+			return errors.Errorf("profile %v and strategies are exclusive", req.Profile)
+		}
+
+		profile := profiles.Get(req.Profile)
+		if profile == nil {
+			return errors.Errorf("no profile %v", req.Profile)
+		}
+
+		var err error
+		if req.Uplink, err = profile.StrategiesOf("incoming"); err != nil {
+			return err
+		}
+		if req.Downlink, err = profile.StrategiesOf("outgoing"); err != nil {
+			return err
+		}
+	}
+
+	for _, strategies := range [][]*NetworkStrategy{req.Uplink, req.Downlink} {
+		if err := applyPresets(strategies); err != nil {
+			return err
+		}
+	}
+
+	link, err := rules.Link(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	logger.Tf(ctx, "Setup link for iface=%v, link=%v, uplink=%v, downlink=%v",
+		req.Iface, link.ID, link.Uplink.ID, link.Downlink.ID,
+	)
+	ohttp.WriteData(ctx, w, r, link)
+	return nil
+}
@@ -61,12 +61,38 @@ func doMain(ctx context.Context) error {
 	setDefaultEnv("PROXY_ID0_ENABLED", "on")
 	setDefaultEnv("PROXY_ID0_MOUNT", "/restarter/")
 	setDefaultEnv("PROXY_ID0_BACKEND", "http://127.0.0.1:2024")
-	logger.Tf(ctx, "Load .env as NODE_ENV=%v, API_LISTEN=%v, UI_PORT(reactjs)=%v, IFACE_FILTER_IPV4=%v, IFACE_FILTER_IPV6=%v, PROXY0=%v/%v/%v",
+	setDefaultEnv("TC_SHAPER", "tcconfig")
+	setDefaultEnv("TC_DATA_DIR", "./data")
+	setDefaultEnv("TC_RECONCILE", "report")
+	setDefaultEnv("TC_RECONCILE_INTERVAL", "10")
+	logger.Tf(ctx, "Load .env as NODE_ENV=%v, API_LISTEN=%v, UI_PORT(reactjs)=%v, IFACE_FILTER_IPV4=%v, IFACE_FILTER_IPV6=%v, PROXY0=%v/%v/%v, TC_SHAPER=%v, TC_DATA_DIR=%v, TC_RECONCILE=%v/%vs",
 		os.Getenv("NODE_ENV"), os.Getenv("API_LISTEN"), os.Getenv("UI_PORT"), os.Getenv("IFACE_FILTER_IPV4"),
 		os.Getenv("IFACE_FILTER_IPV6"), os.Getenv("PROXY_ID0_ENABLED"), os.Getenv("PROXY_ID0_MOUNT"),
-		os.Getenv("PROXY_ID0_BACKEND"),
+		os.Getenv("PROXY_ID0_BACKEND"), os.Getenv("TC_SHAPER"), os.Getenv("TC_DATA_DIR"),
+		os.Getenv("TC_RECONCILE"), os.Getenv("TC_RECONCILE_INTERVAL"),
 	)
 
+	if r0, err := NewShaper(os.Getenv("TC_SHAPER")); err != nil {
+		return errors.Wrapf(err, "create shaper")
+	} else {
+		shaper = r0
+	}
+	logger.Tf(ctx, "Use shaper %v", shaper.Name())
+
+	if err := rules.LoadRules(ctx); err != nil {
+		return errors.Wrapf(err, "load rules")
+	}
+	if err := rules.LoadExpiries(ctx); err != nil {
+		return errors.Wrapf(err, "load expiries")
+	}
+	if err := profiles.Load(ctx); err != nil {
+		return errors.Wrapf(err, "load profiles")
+	}
+	if err := reconciler.Initialize(ctx); err != nil {
+		return errors.Wrapf(err, "initialize reconciler")
+	}
+	go reconciler.Run(ctx)
+
 	addr := fmt.Sprintf("%v", os.Getenv("API_LISTEN"))
 	if !strings.Contains(addr, ":") {
 		addr = fmt.Sprintf(":%v", addr)
@@ -87,6 +113,14 @@ func doMain(ctx context.Context) error {
 		}
 	})
 
+	ep = "/tc/api/v1/scan/stream"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcScanStream(ctx, w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
 	ep = "/tc/api/v1/config/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
@@ -99,15 +133,31 @@ func doMain(ctx context.Context) error {
 	logger.Tf(ctx, "Handle %v", ep)
 	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
 		if err := TcReset(logger.WithContext(ctx), w, r); err != nil {
+			writeApplyError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/config/script"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcScript(logger.WithContext(ctx), w, r); err != nil {
 			ohttp.WriteError(ctx, w, r, err)
 		}
 	})
 
+	ep = "/tc/api/v1/config/apply"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcApply(logger.WithContext(ctx), w, r); err != nil {
+			writeApplyError(ctx, w, r, err)
+		}
+	})
+
 	ep = "/tc/api/v1/config/setup"
 	logger.Tf(ctx, "Handle %v", ep)
 	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
 		if err := TcSetup(logger.WithContext(ctx), w, r); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			writeApplyError(ctx, w, r, err)
 		}
 	})
 
@@ -115,10 +165,234 @@ func doMain(ctx context.Context) error {
 	logger.Tf(ctx, "Handle %v", ep)
 	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
 		if err := TcSetup2(logger.WithContext(ctx), w, r); err != nil {
+			writeApplyError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/config/link"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcLink(logger.WithContext(ctx), w, r); err != nil {
+			writeApplyError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/config/rule/add"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcRuleAdd(logger.WithContext(ctx), w, r); err != nil {
+			writeApplyError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/config/rule/list"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcRuleList(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/config/rule/get"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcRuleGet(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/config/rule/delete"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcRuleDelete(logger.WithContext(ctx), w, r); err != nil {
+			writeApplyError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/scenario/start"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcScenarioStart(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/scenario/pause"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcScenarioPause(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/scenario/resume"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcScenarioResume(logger.WithContext(ctx), w, r); err != nil {
 			ohttp.WriteError(ctx, w, r, err)
 		}
 	})
 
+	ep = "/tc/api/v1/scenario/stop"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcScenarioStop(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/scenario/status"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcScenarioStatus(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/outage/start"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcOutageStart(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/outage/stop"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcOutageStop(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/outage/status"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcOutageStatus(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/chaos/start"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcChaosStart(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/chaos/stop"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcChaosStop(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/chaos/status"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcChaosStatus(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/profile/list"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcProfileList(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/profile/get"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcProfileGet(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/profile/create"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcProfileCreate(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/profile/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcProfileUpdate(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/profile/delete"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcProfileDelete(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/profile/import"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcProfileImport(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/config/import"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcImport(logger.WithContext(ctx), w, r); err != nil {
+			writeApplyError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/config/export"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcExport(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/config/plan"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcPlan(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/config/reconcile"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcReconcile(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/snapshot"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcSnapshot(logger.WithContext(ctx), w, r); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/tc/api/v1/snapshot/restore"
+	logger.Tf(ctx, "Handle %v", ep)
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := TcSnapshotRestore(logger.WithContext(ctx), w, r); err != nil {
+			writeApplyError(ctx, w, r, err)
+		}
+	})
+
 	ep = "/tc/api/v1/config/raw"
 	logger.Tf(ctx, "Handle %v", ep)
 	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"math"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// The rtnetlink message types and flags, see linux/rtnetlink.h and linux/netlink.h
+const (
+	nlmsgError = 0x2
+	nlmsgDone  = 0x3
+
+	nlmFRequest = 0x1
+	nlmFMulti   = 0x2
+	nlmFAck     = 0x4
+	nlmFDump    = 0x300
+	nlmFReplace = 0x100
+	nlmFExcl    = 0x200
+	nlmFCreate  = 0x400
+	// For NLMSG_ERROR, the extended ACK TLVs is present.
+	nlmFAckTlvs = 0x200
+	// For NLMSG_ERROR, the request payload is not included.
+	nlmFCapped = 0x100
+
+	rtmNewLink    = 16
+	rtmDelLink    = 17
+	rtmGetLink    = 18
+	rtmNewQdisc   = 36
+	rtmDelQdisc   = 37
+	rtmGetQdisc   = 38
+	rtmNewTClass  = 40
+	rtmDelTClass  = 41
+	rtmGetTClass  = 42
+	rtmNewTFilter = 44
+	rtmDelTFilter = 45
+	rtmGetTFilter = 46
+
+	nlmsgHeaderLen  = 16
+	nlmsgerrAttrMsg = 1
+)
+
+// The attributes of links and traffic control, see linux/if_link.h, linux/rtnetlink.h and linux/pkt_sched.h
+const (
+	iflaIfname   = 3
+	iflaLinkinfo = 18
+	iflaInfoKind = 1
+
+	tcaKind    = 1
+	tcaOptions = 2
+
+	tcaHtbParms  = 1
+	tcaHtbInit   = 2
+	tcaHtbRate64 = 6
+	tcaHtbCeil64 = 7
+
+	tcaNetemCorr      = 1
+	tcaNetemDelayDist = 2
+	tcaNetemReorder   = 3
+	tcaNetemCorrupt   = 4
+	tcaNetemLoss      = 5
+	tcaNetemLatency64 = 10
+	tcaNetemJitter64  = 11
+	netemLossGI       = 1
+	netemLossGE       = 2
+
+	tcaU32Classid = 1
+	tcaU32Sel     = 5
+	tcaU32Act     = 7
+	tcU32Terminal = 1
+
+	tcaActKind       = 1
+	tcaActOptions    = 2
+	tcaMirredParms   = 2
+	tcActStolen      = 4
+	tcaEgressRedir   = 1
+	tcHtbProtover    = 3
+	tcLinklayerEther = 1
+)
+
+// nativeEndian is the byte order of host, for the netlink messages.
+var nativeEndian binary.ByteOrder
+
+func init() {
+	v := uint16(1)
+	if *(*byte)(unsafe.Pointer(&v)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// nlAlign aligns the length to 4 bytes.
+func nlAlign(n int) int {
+	return (n + 3) &^ 3
+}
+
+// nlAttr encodes the netlink attribute, with padding.
+func nlAttr(typ uint16, data []byte) []byte {
+	b := make([]byte, nlAlign(4+len(data)))
+	nativeEndian.PutUint16(b[0:], uint16(4+len(data)))
+	nativeEndian.PutUint16(b[2:], typ)
+	copy(b[4:], data)
+	return b
+}
+
+// nlNest encodes the nested netlink attribute.
+func nlNest(typ uint16, attrs ...[]byte) []byte {
+	return nlAttr(typ, nlConcat(attrs...))
+}
+
+func nlString(typ uint16, v string) []byte {
+	return nlAttr(typ, append([]byte(v), 0))
+}
+
+func nlUint32(typ uint16, v uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return nlAttr(typ, b)
+}
+
+func nlUint64(typ uint16, v uint64) []byte {
+	b := make([]byte, 8)
+	nativeEndian.PutUint64(b, v)
+	return nlAttr(typ, b)
+}
+
+func nlConcat(parts ...[]byte) []byte {
+	var b []byte
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return b
+}
+
+// nlRawAttr is the parsed netlink attribute.
+type nlRawAttr struct {
+	typ  uint16
+	data []byte
+}
+
+// nlParseAttrs parses the netlink attributes, note that the nested flag is removed from type.
+func nlParseAttrs(b []byte) []nlRawAttr {
+	var attrs []nlRawAttr
+	for len(b) >= 4 {
+		size := int(nativeEndian.Uint16(b[0:]))
+		if size < 4 || size > len(b) {
+			break
+		}
+
+		attrs = append(attrs, nlRawAttr{typ: nativeEndian.Uint16(b[2:]) & 0x3fff, data: b[4:size]})
+		if n := nlAlign(size); n < len(b) {
+			b = b[n:]
+		} else {
+			break
+		}
+	}
+	return attrs
+}
+
+// nlFindAttr returns the data of the first attribute of the type, or nil if not found.
+func nlFindAttr(attrs []nlRawAttr, typ uint16) []byte {
+	for _, attr := range attrs {
+		if attr.typ == typ {
+			return attr.data
+		}
+	}
+	return nil
+}
+
+// nlAttrString parses the NUL-terminated string attribute.
+func nlAttrString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// nlTcmsg encodes the struct tcmsg, the header of traffic control messages.
+func nlTcmsg(ifindex int, handle, parent, info uint32) []byte {
+	b := make([]byte, 20)
+	b[0] = syscall.AF_UNSPEC
+	nativeEndian.PutUint32(b[4:], uint32(int32(ifindex)))
+	nativeEndian.PutUint32(b[8:], handle)
+	nativeEndian.PutUint32(b[12:], parent)
+	nativeEndian.PutUint32(b[16:], info)
+	return b
+}
+
+// nlTcmsgHeader is the parsed struct tcmsg.
+type nlTcmsgHeader struct {
+	ifindex              int
+	handle, parent, info uint32
+}
+
+func nlParseTcmsg(b []byte) (*nlTcmsgHeader, []nlRawAttr, error) {
+	if len(b) < 20 {
+		return nil, nil, errors.Errorf("invalid tcmsg size %v", len(b))
+	}
+	h := &nlTcmsgHeader{
+		ifindex: int(int32(nativeEndian.Uint32(b[4:]))),
+		handle:  nativeEndian.Uint32(b[8:]),
+		parent:  nativeEndian.Uint32(b[12:]),
+		info:    nativeEndian.Uint32(b[16:]),
+	}
+	return h, nlParseAttrs(b[20:]), nil
+}
+
+// nlIfinfomsg encodes the struct ifinfomsg, the header of link messages.
+func nlIfinfomsg(ifindex int, flags, change uint32) []byte {
+	b := make([]byte, 16)
+	b[0] = syscall.AF_UNSPEC
+	nativeEndian.PutUint32(b[4:], uint32(int32(ifindex)))
+	nativeEndian.PutUint32(b[8:], flags)
+	nativeEndian.PutUint32(b[12:], change)
+	return b
+}
+
+// nlHtons converts the protocol to network byte order, for tcmsg info of filter.
+func nlHtons(v uint16) uint16 {
+	return v<<8&0xff00 | v>>8
+}
+
+// nlPercent converts the percent to the probability of kernel, which is scaled to uint32.
+func nlPercent(v float64) uint32 {
+	if v >= 100 {
+		return 0xffffffff
+	}
+	return uint32(v / 100 * 0xffffffff)
+}
+
+// nlUnpercent converts the probability of kernel to percent.
+func nlUnpercent(v uint32) float64 {
+	return math.Round(float64(v)/0xffffffff*100*10000) / 10000
+}
+
+// nlTicks converts the nanoseconds to psched ticks, which is 64ns per tick for kernel 2.6.x+.
+func nlTicks(ns uint64) uint32 {
+	if ticks := ns >> 6; ticks < 0xffffffff {
+		return uint32(ticks)
+	}
+	return 0xffffffff
+}
+
+// nlRatespec encodes the struct tc_ratespec, with linklayer ethernet, so kernel doesn't require the rate table.
+func nlRatespec(b []byte, rate uint64) {
+	b[1] = tcLinklayerEther
+	if rate < 0xffffffff {
+		nativeEndian.PutUint32(b[8:], uint32(rate))
+	} else {
+		nativeEndian.PutUint32(b[8:], 0xffffffff)
+	}
+}
+
+// nlHtbQdiscOptions encodes the TCA_OPTIONS of htb qdisc.
+func nlHtbQdiscOptions(defaultMinor uint16) []byte {
+	glob := make([]byte, 20)
+	nativeEndian.PutUint32(glob[0:], tcHtbProtover)
+	nativeEndian.PutUint32(glob[4:], 10) // rate2quantum, the same as tc.
+	nativeEndian.PutUint32(glob[8:], uint32(defaultMinor))
+	return nlNest(tcaOptions, nlAttr(tcaHtbInit, glob))
+}
+
+// nlHtbClassOptions encodes the TCA_OPTIONS of htb class, the struct tc_htb_opt. The buffers is the buffer and
+// cbuffer, or nil to calculate by rate.
+func nlHtbClassOptions(rate, ceil uint64, buffers []uint32) []byte {
+	// The burst is rate/HZ + MTU, the same as tc, and the buffer is the time to send the burst.
+	bufferOf := func(rate uint64) uint32 {
+		burst := rate/1000 + 1600
+		return nlTicks(burst * 1000000000 / rate)
+	}
+
+	opt := make([]byte, 44)
+	nlRatespec(opt[0:], rate)
+	nlRatespec(opt[12:], ceil)
+	if len(buffers) == 2 {
+		nativeEndian.PutUint32(opt[24:], buffers[0])
+		nativeEndian.PutUint32(opt[28:], buffers[1])
+	} else {
+		nativeEndian.PutUint32(opt[24:], bufferOf(rate))
+		nativeEndian.PutUint32(opt[28:], bufferOf(ceil))
+	}
+
+	attrs := [][]byte{nlAttr(tcaHtbParms, opt)}
+	if rate >= 0xffffffff {
+		attrs = append(attrs, nlUint64(tcaHtbRate64, rate))
+	}
+	if ceil >= 0xffffffff {
+		attrs = append(attrs, nlUint64(tcaHtbCeil64, ceil))
+	}
+	return nlNest(tcaOptions, attrs...)
+}
+
+// nlNetemOptions encodes the TCA_OPTIONS of netem qdisc, which is the struct tc_netem_qopt followed by the
+// attributes, note that it's not a standard nested attribute.
+func nlNetemOptions(v *tcNetem) ([]byte, error) {
+	latency, jitter := uint64(v.delay*1000000), uint64(v.jitter*1000000)
+
+	// Like tc, the gap defaults to 1 for reorder, which means the first packet is delayed.
+	gap := v.gap
+	if v.reorder > 0 && gap == 0 {
+		gap = 1
+	}
+
+	qopt := make([]byte, 24)
+	nativeEndian.PutUint32(qopt[0:], nlTicks(latency))
+	nativeEndian.PutUint32(qopt[4:], 1000) // limit, the same as tc.
+	nativeEndian.PutUint32(qopt[8:], nlPercent(v.loss))
+	nativeEndian.PutUint32(qopt[12:], gap)
+	nativeEndian.PutUint32(qopt[16:], nlPercent(v.duplicate))
+	nativeEndian.PutUint32(qopt[20:], nlTicks(jitter))
+
+	probability := func(typ uint16, values ...float64) []byte {
+		b := make([]byte, 4*len(values))
+		for i, value := range values {
+			nativeEndian.PutUint32(b[4*i:], nlPercent(value))
+		}
+		return nlAttr(typ, b)
+	}
+
+	attrs := [][]byte{
+		qopt,
+		probability(tcaNetemCorr, v.delayCorrelation, v.lossCorrelation, v.duplicateCorrelation),
+		probability(tcaNetemReorder, v.reorder, v.reorderCorrelation),
+		probability(tcaNetemCorrupt, v.corrupt, v.corruptCorrelation),
+	}
+	if v.lossModel != "" {
+		if b, err := nlNetemLossModel(v); err != nil {
+			return nil, err
+		} else {
+			attrs = append(attrs, b)
+		}
+	}
+	if v.distribution != "" {
+		table, err := nlNetemDistTable(v.distribution)
+		if err != nil {
+			return nil, err
+		}
+
+		b := make([]byte, 2*len(table))
+		for i, value := range table {
+			nativeEndian.PutUint16(b[2*i:], uint16(value))
+		}
+		attrs = append(attrs, nlAttr(tcaNetemDelayDist, b))
+	}
+	attrs = append(attrs, nlUint64(tcaNetemLatency64, latency), nlUint64(tcaNetemJitter64, jitter))
+
+	return nlAttr(tcaOptions, nlConcat(attrs...)), nil
+}
+
+// nlParseNetemOptions parses the TCA_OPTIONS of netem qdisc, note that the distribution is not available,
+// because kernel doesn't dump the table.
+func nlParseNetemOptions(b []byte) *tcNetem {
+	v := &tcNetem{}
+	if len(b) < 24 {
+		return v
+	}
+
+	v.delay = float64(uint64(nativeEndian.Uint32(b[0:]))<<6) / 1000000
+	v.loss = nlUnpercent(nativeEndian.Uint32(b[8:]))
+	v.gap = nativeEndian.Uint32(b[12:])
+	v.duplicate = nlUnpercent(nativeEndian.Uint32(b[16:]))
+	v.jitter = float64(uint64(nativeEndian.Uint32(b[20:]))<<6) / 1000000
+
+	attrs := nlParseAttrs(b[nlAlign(24):])
+	if d := nlFindAttr(attrs, tcaNetemCorr); len(d) >= 12 {
+		v.delayCorrelation = nlUnpercent(nativeEndian.Uint32(d[0:]))
+		v.lossCorrelation = nlUnpercent(nativeEndian.Uint32(d[4:]))
+		v.duplicateCorrelation = nlUnpercent(nativeEndian.Uint32(d[8:]))
+	}
+	if d := nlFindAttr(attrs, tcaNetemReorder); len(d) >= 8 {
+		v.reorder = nlUnpercent(nativeEndian.Uint32(d[0:]))
+		v.reorderCorrelation = nlUnpercent(nativeEndian.Uint32(d[4:]))
+	}
+	if d := nlFindAttr(attrs, tcaNetemCorrupt); len(d) >= 8 {
+		v.corrupt = nlUnpercent(nativeEndian.Uint32(d[0:]))
+		v.corruptCorrelation = nlUnpercent(nativeEndian.Uint32(d[4:]))
+	}
+	if d := nlFindAttr(attrs, tcaNetemLatency64); len(d) == 8 {
+		v.delay = float64(int64(nativeEndian.Uint64(d))) / 1000000
+	}
+	if d := nlFindAttr(attrs, tcaNetemJitter64); len(d) == 8 {
+		v.jitter = float64(int64(nativeEndian.Uint64(d))) / 1000000
+	}
+
+	if d := nlFindAttr(attrs, tcaNetemLoss); len(d) > 0 {
+		nlParseNetemLossModel(v, d)
+	}
+
+	// Kernel sets the reorder to 100% if gap without reorder, so ignore the gap of tc defaults.
+	if v.reorder == 0 && v.gap == 1 {
+		v.gap = 0
+	}
+	return v
+}
+
+// nlNetemLossModel encodes the TCA_NETEM_LOSS of netem, which is the struct tc_netem_gimodel for 4-state
+// model, or tc_netem_gemodel for Gilbert-Elliott model.
+func nlNetemLossModel(v *tcNetem) ([]byte, error) {
+	percents := func(values ...float64) []byte {
+		b := make([]byte, 4*len(values))
+		for i, value := range values {
+			nativeEndian.PutUint32(b[4*i:], nlPercent(value))
+		}
+		return b
+	}
+
+	p := v.lossModelParams
+	switch {
+	case v.lossModel == "state" && len(p) == 5:
+		// Note that the order of kernel is p13, p31, p32, p14, p23.
+		return nlNest(tcaNetemLoss, nlAttr(netemLossGI, percents(p[0], p[1], p[2], p[4], p[3]))), nil
+	case v.lossModel == "gemodel" && len(p) == 4:
+		// Note that kernel uses h rather than 1-h, while 1-k as is.
+		return nlNest(tcaNetemLoss, nlAttr(netemLossGE, percents(p[0], p[1], 100-p[2], p[3]))), nil
+	default:
+		return nil, errors.Errorf("invalid loss model %v %v", v.lossModel, p)
+	}
+}
+
+// nlParseNetemLossModel parses the TCA_NETEM_LOSS of netem to the loss model.
+func nlParseNetemLossModel(v *tcNetem, b []byte) {
+	attrs := nlParseAttrs(b)
+	if d := nlFindAttr(attrs, netemLossGI); len(d) >= 20 {
+		var p [5]float64
+		for i := range p {
+			p[i] = nlUnpercent(nativeEndian.Uint32(d[4*i:]))
+		}
+		// Note that the order of kernel is p13, p31, p32, p14, p23.
+		v.lossModel, v.lossModelParams = "state", []float64{p[0], p[1], p[2], p[4], p[3]}
+	} else if d := nlFindAttr(attrs, netemLossGE); len(d) >= 16 {
+		p, r := nlUnpercent(nativeEndian.Uint32(d[0:])), nlUnpercent(nativeEndian.Uint32(d[4:]))
+		h, k1 := nlUnpercent(nativeEndian.Uint32(d[8:])), nlUnpercent(nativeEndian.Uint32(d[12:]))
+		v.lossModel, v.lossModelParams = "gemodel", []float64{p, r, math.Round((100-h)*10000) / 10000, k1}
+	}
+}
+
+// The distribution tables, which is generated as iproute2 netem/normal.c, pareto.c and paretonormal.c, so
+// we don't depend on the /usr/lib/tc/*.dist files.
+var nlNetemDistTables = make(map[string][]int16)
+var nlNetemDistLock sync.Mutex
+
+// nlNetemDistTable returns the table of distribution, scaled by NETEM_DIST_SCALE.
+func nlNetemDistTable(name string) ([]int16, error) {
+	nlNetemDistLock.Lock()
+	defer nlNetemDistLock.Unlock()
+
+	if table, ok := nlNetemDistTables[name]; ok {
+		return table, nil
+	}
+
+	const tableSize, tableFactor, paretoA = 16384, 8192, 3.0
+	clamp := func(v float64) int16 {
+		return int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, math.RoundToEven(v))))
+	}
+
+	// The inverse of normal CDF, the x of the probability i/tableSize.
+	normals := func() []float64 {
+		table := make([]float64, tableSize+1)
+		for x := -10.0; x < 10.05; x += .00005 {
+			i := int(math.RoundToEven(tableSize * (.5 + .5*math.Erf(x/math.Sqrt(2.0)))))
+			table[i] = x
+		}
+		return table
+	}
+	pareto := func(i int) float64 {
+		v := 1.0 / math.Pow(float64(i)/65536, 1.0/paretoA)
+		return math.Min((v-1.5)*(4.0/3.0)*tableFactor, 32767)
+	}
+
+	var table []int16
+	switch name {
+	case "normal":
+		normal := normals()
+		for i := 0; i < tableSize; i += 4 {
+			table = append(table, clamp(normal[i]*tableFactor))
+		}
+	case "pareto":
+		for i := 65536; i > 0; i -= 16 {
+			table = append(table, clamp(pareto(i)))
+		}
+	case "paretonormal":
+		normal := normals()
+		for i := 0; i < tableSize; i += 4 {
+			nv, pv := int(math.RoundToEven(normal[i]*tableFactor)), int(math.RoundToEven(pareto(65536-4*i)))
+			table = append(table, clamp(float64((nv+3*pv)/4)))
+		}
+	default:
+		return nil, errors.Errorf("invalid distribution %v", name)
+	}
+
+	nlNetemDistTables[name] = table
+	return table, nil
+}
+
+// nlU32Options encodes the TCA_OPTIONS of u32 filter, the struct tc_u32_sel with keys, and the optional
+// mirred action to redirect to the ifb device.
+func nlU32Options(f *tcFilter, redirectIndex int) []byte {
+	sel := make([]byte, 16+16*len(f.keys))
+	sel[0] = tcU32Terminal
+	sel[2] = byte(len(f.keys))
+	for i, key := range f.keys {
+		k := sel[16+16*i:]
+		binary.BigEndian.PutUint32(k[0:], key.mask)
+		binary.BigEndian.PutUint32(k[4:], key.val&key.mask)
+		nativeEndian.PutUint32(k[8:], uint32(key.off))
+	}
+
+	attrs := [][]byte{nlUint32(tcaU32Classid, f.flowid), nlAttr(tcaU32Sel, sel)}
+	if f.redirect != "" {
+		// The struct tc_mirred.
+		mirred := make([]byte, 28)
+		nativeEndian.PutUint32(mirred[8:], tcActStolen)
+		nativeEndian.PutUint32(mirred[20:], tcaEgressRedir)
+		nativeEndian.PutUint32(mirred[24:], uint32(redirectIndex))
+
+		attrs = append(attrs, nlNest(tcaU32Act, nlNest(1,
+			nlString(tcaActKind, "mirred"),
+			nlNest(tcaActOptions, nlAttr(tcaMirredParms, mirred)),
+		)))
+	}
+	return nlNest(tcaOptions, attrs...)
+}
+
+// nlParseU32Options parses the keys and classid of u32 filter, returns nil if it's not a filter node, for
+// example, the hash table node.
+func nlParseU32Options(b []byte) (keys []tcU32Key, flowid uint32) {
+	attrs := nlParseAttrs(b)
+	sel := nlFindAttr(attrs, tcaU32Sel)
+	if len(sel) < 16 {
+		return nil, 0
+	}
+	if d := nlFindAttr(attrs, tcaU32Classid); len(d) == 4 {
+		flowid = nativeEndian.Uint32(d)
+	}
+
+	for i := 0; i < int(sel[2]) && 16+16*(i+1) <= len(sel); i++ {
+		k := sel[16+16*i:]
+		keys = append(keys, tcU32Key{
+			mask: binary.BigEndian.Uint32(k[0:]), val: binary.BigEndian.Uint32(k[4:]),
+			off: int32(nativeEndian.Uint32(k[8:])),
+		})
+	}
+	if keys == nil {
+		keys = []tcU32Key{}
+	}
+	return keys, flowid
+}
+
+// nlError is the error of netlink request from kernel, with the errno and optional extended message.
+type nlError struct {
+	// The errno of kernel, for example, ENOENT.
+	Errno syscall.Errno
+	// The extended ACK message, for example, "Specified qdisc kind is unknown."
+	Message string
+}
+
+func (v *nlError) Error() string {
+	if v.Message != "" {
+		return fmt.Sprintf("%v, %v", v.Errno.Error(), v.Message)
+	}
+	return v.Errno.Error()
+}
+
+// nlIsNotExist whether the error is the object not exists, which is ignored when deleting it.
+func nlIsNotExist(err error) bool {
+	if r0, ok := errors.Cause(err).(*nlError); ok {
+		return r0.Errno == syscall.ENOENT || r0.Errno == syscall.EINVAL || r0.Errno == syscall.ENODEV
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"github.com/ossrs/go-oryx-lib/errors"
+	"syscall"
+)
+
+// nlConn is the rtnetlink socket to talk to kernel.
+type nlConn struct {
+	fd  int
+	seq uint32
+}
+
+func nlDial() (*nlConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open netlink")
+	}
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, errors.Wrapf(err, "bind netlink")
+	}
+
+	// Enable the extended ACK, for the error message, ignore the error for old kernels.
+	const solNetlink, netlinkExtAck = 270, 11
+	_ = syscall.SetsockoptInt(fd, solNetlink, netlinkExtAck, 1)
+
+	return &nlConn{fd: fd}, nil
+}
+
+func (v *nlConn) Close() error {
+	return syscall.Close(v.fd)
+}
+
+// Execute sends the request, and returns the payloads of responses. For request with flag NLM_F_DUMP, it
+// reads all the multipart responses, otherwise it waits for the ACK.
+func (v *nlConn) Execute(typ, flags uint16, payload []byte) ([][]byte, error) {
+	v.seq++
+	seq := v.seq
+
+	flags |= nlmFRequest
+	if flags&nlmFDump != nlmFDump {
+		flags |= nlmFAck
+	}
+
+	b := make([]byte, nlmsgHeaderLen, nlmsgHeaderLen+len(payload))
+	nativeEndian.PutUint32(b[0:], uint32(nlmsgHeaderLen+len(payload)))
+	nativeEndian.PutUint16(b[4:], typ)
+	nativeEndian.PutUint16(b[6:], flags)
+	nativeEndian.PutUint32(b[8:], seq)
+	b = append(b, payload...)
+
+	if err := syscall.Sendto(v.fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, errors.Wrapf(err, "send netlink")
+	}
+
+	var responses [][]byte
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := syscall.Recvfrom(v.fd, buf, 0)
+		if err != nil {
+			return nil, errors.Wrapf(err, "recv netlink")
+		}
+
+		for b := buf[:n]; len(b) >= nlmsgHeaderLen; {
+			size := int(nativeEndian.Uint32(b[0:]))
+			if size < nlmsgHeaderLen || size > len(b) {
+				return nil, errors.Errorf("invalid netlink message size %v", size)
+			}
+
+			msgType, msgFlags := nativeEndian.Uint16(b[4:]), nativeEndian.Uint16(b[6:])
+			msgSeq, data := nativeEndian.Uint32(b[8:]), b[nlmsgHeaderLen:size]
+			if n := nlAlign(size); n < len(b) {
+				b = b[n:]
+			} else {
+				b = nil
+			}
+
+			// Ignore the stale responses.
+			if msgSeq != seq {
+				continue
+			}
+
+			switch msgType {
+			case nlmsgDone:
+				return responses, nil
+			case nlmsgError:
+				if err := nlParseError(data, msgFlags); err != nil {
+					return nil, err
+				}
+				return responses, nil
+			}
+
+			responses = append(responses, append([]byte{}, data...))
+			if msgFlags&nlmFMulti == 0 && flags&nlmFDump != nlmFDump {
+				return responses, nil
+			}
+		}
+	}
+}
+
+// nlParseError parses the struct nlmsgerr, returns nil for ACK.
+func nlParseError(data []byte, flags uint16) error {
+	if len(data) < 4 {
+		return errors.Errorf("invalid netlink error size %v", len(data))
+	}
+
+	errno := int32(nativeEndian.Uint32(data[0:]))
+	if errno == 0 {
+		return nil
+	}
+
+	r0 := &nlError{Errno: syscall.Errno(-errno)}
+	if flags&nlmFAckTlvs == nlmFAckTlvs && len(data) >= 4+nlmsgHeaderLen {
+		// Skip the error code and the request, which has payload if not capped.
+		offset := 4 + nlmsgHeaderLen
+		if flags&nlmFCapped == 0 {
+			offset = 4 + int(nativeEndian.Uint32(data[4:]))
+		}
+		if offset = nlAlign(offset); offset <= len(data) {
+			if msg := nlFindAttr(nlParseAttrs(data[offset:]), nlmsgerrAttrMsg); msg != nil {
+				r0.Message = nlAttrString(msg)
+			}
+		}
+	}
+	return r0
+}
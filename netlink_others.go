@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"github.com/ossrs/go-oryx-lib/errors"
+	"runtime"
+)
+
+// nlConn is not supported for non-linux OS, such as darwin.
+type nlConn struct {
+}
+
+func nlDial() (*nlConn, error) {
+	return nil, errors.Errorf("netlink not supported for %v", runtime.GOOS)
+}
+
+func (v *nlConn) Close() error {
+	return nil
+}
+
+func (v *nlConn) Execute(typ, flags uint16, payload []byte) ([][]byte, error) {
+	return nil, errors.Errorf("netlink not supported for %v", runtime.GOOS)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNlPercent(t *testing.T) {
+	for _, c := range []struct {
+		percent float64
+		kernel  uint32
+	}{
+		{0, 0},
+		{50, 0x7fffffff},
+		{100, 0xffffffff},
+		{200, 0xffffffff},
+	} {
+		if v := nlPercent(c.percent); v != c.kernel {
+			t.Errorf("percent %v, expect %#x, actual %#x", c.percent, c.kernel, v)
+		}
+	}
+
+	for _, percent := range []float64{0, 0.1, 5, 33.3333, 99.99, 100} {
+		if v := nlUnpercent(nlPercent(percent)); v != percent {
+			t.Errorf("percent %v, actual %v", percent, v)
+		}
+	}
+}
+
+func TestNlNetemOptions(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		netem    *tcNetem
+		expected *tcNetem
+	}{
+		{"loss", &tcNetem{loss: 10, lossCorrelation: 25}, nil},
+		{"delay", &tcNetem{delay: 400, jitter: 100, delayCorrelation: 10}, nil},
+		{"delay in us", &tcNetem{delay: 0.5, jitter: 0.25}, nil},
+		{"duplicate and corrupt", &tcNetem{duplicate: 1, duplicateCorrelation: 2, corrupt: 3, corruptCorrelation: 4}, nil},
+		{"reorder with gap", &tcNetem{delay: 10, reorder: 25, reorderCorrelation: 50, gap: 5}, nil},
+		// Like tc, the reorder without gap delays the first packet, by gap 1.
+		{"reorder", &tcNetem{delay: 10, reorder: 25}, &tcNetem{delay: 10, reorder: 25, gap: 1}},
+		// The distribution is not dumped by kernel.
+		{"distribution", &tcNetem{delay: 100, jitter: 20, distribution: "normal"}, &tcNetem{delay: 100, jitter: 20}},
+		{"state", &tcNetem{lossModel: "state", lossModelParams: []float64{1, 2, 3, 4, 5}}, nil},
+		{"gemodel", &tcNetem{lossModel: "gemodel", lossModelParams: []float64{1, 10, 70, 0.1}}, nil},
+	} {
+		b, err := nlNetemOptions(c.netem)
+		if err != nil {
+			t.Errorf("%v: encode err %+v", c.name, err)
+			continue
+		}
+
+		options := nlFindAttr(nlParseAttrs(b), tcaOptions)
+		if options == nil {
+			t.Errorf("%v: no options", c.name)
+			continue
+		}
+
+		expected := c.expected
+		if expected == nil {
+			expected = c.netem
+		}
+		if v := nlParseNetemOptions(options); !reflect.DeepEqual(v, expected) {
+			t.Errorf("%v: expect %+v, actual %+v", c.name, expected, v)
+		}
+	}
+}
+
+func TestNlNetemOptionsError(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		netem *tcNetem
+	}{
+		{"state params", &tcNetem{lossModel: "state", lossModelParams: []float64{1, 2}}},
+		{"gemodel params", &tcNetem{lossModel: "gemodel", lossModelParams: []float64{1, 2, 3, 4, 5}}},
+		{"loss model", &tcNetem{lossModel: "bursty", lossModelParams: []float64{1}}},
+		{"distribution", &tcNetem{delay: 100, jitter: 20, distribution: "gaussian"}},
+	} {
+		if _, err := nlNetemOptions(c.netem); err == nil {
+			t.Errorf("%v: expect error", c.name)
+		}
+	}
+}
+
+func TestNlU32Options(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		filter   *tcFilter
+		expected []tcU32Key
+	}{
+		{"no keys", &tcFilter{flowid: 0x1a1a0001, keys: []tcU32Key{}}, []tcU32Key{}},
+		{
+			"protocol and port",
+			&tcFilter{flowid: 0x1a1a0002, keys: []tcU32Key{
+				{val: 0x00110000, mask: 0x00ff0000, off: 8}, {val: 0x1f400000, mask: 0xffff0000, off: 20},
+			}},
+			[]tcU32Key{{val: 0x00110000, mask: 0x00ff0000, off: 8}, {val: 0x1f400000, mask: 0xffff0000, off: 20}},
+		},
+		{
+			// The value is masked, like kernel.
+			"masked value",
+			&tcFilter{flowid: 0x1a1a0003, keys: []tcU32Key{{val: 0x0a000001, mask: 0xffffff00, off: 12}}},
+			[]tcU32Key{{val: 0x0a000000, mask: 0xffffff00, off: 12}},
+		},
+		{
+			"negative offset",
+			&tcFilter{flowid: 0x1a1a0004, keys: []tcU32Key{{val: 0x86dd, mask: 0xffff, off: -4}}},
+			[]tcU32Key{{val: 0x86dd, mask: 0xffff, off: -4}},
+		},
+	} {
+		options := nlFindAttr(nlParseAttrs(nlU32Options(c.filter, 0)), tcaOptions)
+		keys, flowid := nlParseU32Options(options)
+		if !reflect.DeepEqual(keys, c.expected) {
+			t.Errorf("%v: expect keys %v, actual %v", c.name, c.expected, keys)
+		}
+		if flowid != c.filter.flowid {
+			t.Errorf("%v: expect flowid %#x, actual %#x", c.name, c.filter.flowid, flowid)
+		}
+		if nlFindAttr(nlParseAttrs(options), tcaU32Act) != nil {
+			t.Errorf("%v: unexpected action", c.name)
+		}
+	}
+}
+
+func TestNlU32OptionsRedirect(t *testing.T) {
+	filter := &tcFilter{keys: []tcU32Key{{val: 0, mask: 0, off: 0}}, redirect: "ifb0"}
+	options := nlFindAttr(nlParseAttrs(nlU32Options(filter, 7)), tcaOptions)
+
+	act := nlFindAttr(nlParseAttrs(options), tcaU32Act)
+	if act == nil {
+		t.Fatalf("no action")
+	}
+	action := nlFindAttr(nlParseAttrs(act), 1)
+	if kind := nlAttrString(nlFindAttr(nlParseAttrs(action), tcaActKind)); kind != "mirred" {
+		t.Errorf("expect mirred, actual %v", kind)
+	}
+
+	parms := nlFindAttr(nlParseAttrs(nlFindAttr(nlParseAttrs(action), tcaActOptions)), tcaMirredParms)
+	if len(parms) != 28 {
+		t.Fatalf("invalid mirred %v", parms)
+	}
+	if v := nativeEndian.Uint32(parms[20:]); v != tcaEgressRedir {
+		t.Errorf("expect egress redirect, actual %v", v)
+	}
+	if v := nativeEndian.Uint32(parms[24:]); v != 7 {
+		t.Errorf("expect ifindex 7, actual %v", v)
+	}
+}
+
+func TestNlParseU32OptionsNode(t *testing.T) {
+	// The hash table node has no selector.
+	if keys, flowid := nlParseU32Options(nlUint32(tcaU32Classid, 1)); keys != nil || flowid != 0 {
+		t.Errorf("expect no keys, actual %v, %v", keys, flowid)
+	}
+}
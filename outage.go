@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// OutageRequest is the schedule to switch a rule between its strategies and a full blackhole, periodically, for
+// example, 2s outage every 20s, or randomly, for example, 1s to 5s outage with a mean gap of 60s.
+type OutageRequest struct {
+	// The ID of rule to blackhole, which keeps its strategies out of outage.
+	Rule string `json:"rule"`
+	// The mode, periodic or random.
+	Mode string `json:"mode"`
+	// If periodic, the duration in ms of outage, in each period in ms.
+	Duration int `json:"duration,omitempty"`
+	Period   int `json:"period,omitempty"`
+	// If random, the duration in ms of outage is uniform in [minDuration, maxDuration], and the gap in ms between
+	// outages is exponential with the mean.
+	MinDuration int `json:"minDuration,omitempty"`
+	MaxDuration int `json:"maxDuration,omitempty"`
+	MeanGap     int `json:"meanGap,omitempty"`
+	// The seed of random mode, to reproduce the outages, default to the time.
+	Seed int64 `json:"seed,omitempty"`
+	// The number of outages to inject, 0 for unlimited until stopped.
+	Count int `json:"count,omitempty"`
+}
+
+func (v *OutageRequest) String() string {
+	if v.Mode == "random" {
+		return fmt.Sprintf("rule=%v, mode=%v, duration=%v-%vms, gap=%vms, count=%v",
+			v.Rule, v.Mode, v.MinDuration, v.MaxDuration, v.MeanGap, v.Count,
+		)
+	}
+	return fmt.Sprintf("rule=%v, mode=%v, duration=%vms, period=%vms, count=%v",
+		v.Rule, v.Mode, v.Duration, v.Period, v.Count,
+	)
+}
+
+// Validate checks the schedule of outages.
+func (v *OutageRequest) Validate() error {
+	if v.Rule == "" {
+		return errors.New("no rule")
+	}
+	if v.Count < 0 {
+		return errors.Errorf("invalid count=%v", v.Count)
+	}
+
+	switch v.Mode {
+	case "periodic":
+		if v.Duration <= 0 {
+			return errors.Errorf("invalid duration=%v", v.Duration)
+		}
+		if v.Period <= v.Duration {
+			return errors.Errorf("period=%v should be greater than duration=%v", v.Period, v.Duration)
+		}
+	case "random":
+		if v.MinDuration <= 0 || v.MaxDuration < v.MinDuration {
+			return errors.Errorf("invalid duration=%v-%v", v.MinDuration, v.MaxDuration)
+		}
+		if v.MeanGap <= 0 {
+			return errors.Errorf("invalid meanGap=%v", v.MeanGap)
+		}
+	default:
+		return errors.Errorf("invalid mode=%v", v.Mode)
+	}
+	return nil
+}
+
+// The strategies of blackhole, which drops all packets.
+var outageBlackhole = []*NetworkStrategy{{Strategy: "loss", Loss: 100}}
+
+// isOutageBlackhole whether the strategies are the blackhole of outage, which is applied by the outage itself.
+func isOutageBlackhole(strategies []*NetworkStrategy) bool {
+	return len(strategies) == 1 && strategies[0] == outageBlackhole[0]
+}
+
+// outageDowntime is the total downtime, which includes the outage in progress, in ms.
+type outageDowntime struct {
+	// The downtime of ended outages.
+	total time.Duration
+	// The time when the outage in progress is started, zero if none.
+	since time.Time
+}
+
+func (v outageDowntime) milliseconds() int64 {
+	downtime := v.total
+	if !v.since.IsZero() {
+		downtime += time.Since(v.since)
+	}
+	return int64(downtime / time.Millisecond)
+}
+
+func (v outageDowntime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.milliseconds())
+}
+
+// Outage is a running schedule of outages, which switches an existing rule between its strategies and blackhole.
+type Outage struct {
+	networkJob
+	Request *OutageRequest `json:"request"`
+	// The seed of random, which is from request or the time.
+	Seed int64 `json:"seed"`
+	// Whether the rule is blackholed now.
+	Blackhole bool `json:"blackhole"`
+	// The number of outages injected, and the total downtime in ms.
+	Outages  int            `json:"outages"`
+	Downtime outageDowntime `json:"downtime"`
+
+	// The strategies of rule before the current outage, to restore.
+	strategies []*NetworkStrategy
+	// Whether to blackhole the rule by the next transition, or restore it.
+	blackhole bool
+	// Whether the gap before the next outage is scheduled, and the duration of it.
+	scheduled bool
+	duration  time.Duration
+	random    *rand.Rand
+}
+
+// NewOutage checks the request and the rule, to make sure the outage never fails for bad request after started.
+func NewOutage(req *OutageRequest) (*Outage, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	rule := rules.Get(req.Rule)
+	if rule == nil {
+		return nil, errors.Errorf("no rule %v", req.Rule)
+	}
+
+	seed := req.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return &Outage{
+		networkJob: networkJob{kind: "outage", iface: rule.Request.Iface, direction: rule.Request.Direction},
+		Request:    req, Seed: seed, random: rand.New(rand.NewSource(seed)),
+	}, nil
+}
+
+func (v *Outage) String() string {
+	return fmt.Sprintf("id=%v, %v, seed=%v, outages=%v, downtime=%vms",
+		v.ID, v.Request, v.Seed, v.Outages, v.Downtime.milliseconds(),
+	)
+}
+
+// schedule returns the gap before the next outage, and the duration of it.
+func (v *Outage) schedule() (gap, duration time.Duration) {
+	req := v.Request
+	if req.Mode == "periodic" {
+		return time.Duration(req.Period-req.Duration) * time.Millisecond, time.Duration(req.Duration) * time.Millisecond
+	}
+
+	gap = time.Duration(v.random.ExpFloat64() * float64(req.MeanGap) * float64(time.Millisecond))
+	duration = time.Duration(req.MinDuration+v.random.Intn(req.MaxDuration-req.MinDuration+1)) * time.Millisecond
+	return
+}
+
+// next keeps the strategies of rule for the gap before the next outage, then blackholes the rule for the duration
+// of outage, until the count of outages.
+func (v *Outage) next(at time.Time) (time.Duration, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	last := v.Request.Count > 0 && v.Outages >= v.Request.Count
+	if !v.Blackhole && last {
+		return 0, false
+	}
+
+	if !v.Blackhole && v.scheduled {
+		v.blackhole, v.scheduled = true, false
+		return v.duration, true
+	}
+
+	v.blackhole = false
+	if last {
+		return 0, true
+	}
+
+	var gap time.Duration
+	gap, v.duration = v.schedule()
+	v.scheduled = true
+	return gap, true
+}
+
+// apply switches the rule to blackhole, or restores it, by updating it in place.
+func (v *Outage) apply(ctx context.Context) error {
+	v.lock.Lock()
+	blackhole, current := v.blackhole, v.Blackhole
+	v.lock.Unlock()
+
+	if blackhole == current {
+		return nil
+	}
+	if !blackhole {
+		return v.restore(ctx)
+	}
+
+	// Always blackhole the current strategies of rule, which may be changed between outages.
+	rule := rules.Get(v.Request.Rule)
+	if rule == nil {
+		return errors.Errorf("no rule %v", v.Request.Rule)
+	}
+	strategies := rule.Request.Strategies
+
+	// Persist the strategies to restore, in case of tc-ui restarts during the outage.
+	if _, err := rules.UpdateTemporarily(ctx, v.Request.Rule, outageBlackhole, strategies); err != nil {
+		return err
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.strategies, v.Blackhole = strategies, true
+	v.Outages++
+	v.Downtime.since = time.Now()
+	logger.Tf(ctx, "Outage %v blackhole, outages=%v, downtime=%vms", v.ID, v.Outages, v.Downtime.milliseconds())
+	return nil
+}
+
+// restore switches the rule back to the strategies before the outage. If the rule is changed during the outage, its
+// current strategies are kept.
+func (v *Outage) restore(ctx context.Context) error {
+	rule := rules.Get(v.Request.Rule)
+	if rule == nil {
+		return errors.Errorf("no rule %v", v.Request.Rule)
+	}
+
+	if isOutageBlackhole(rule.Request.Strategies) {
+		if _, err := rules.Update(ctx, v.Request.Rule, v.strategies); err != nil {
+			return err
+		}
+	} else {
+		logger.Wf(ctx, "Outage %v keep strategies %v, changed during outage", v.ID, rule.Request.Strategies)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.Blackhole = false
+	v.Downtime.total += time.Since(v.Downtime.since)
+	v.Downtime.since = time.Time{}
+	logger.Tf(ctx, "Outage %v restore, outages=%v, downtime=%vms", v.ID, v.Outages, v.Downtime.milliseconds())
+	return nil
+}
+
+// clean restores the rule if it's blackholed when done, while the rule which is already deleted is ignored.
+func (v *Outage) clean(ctx context.Context) error {
+	v.lock.Lock()
+	blackhole := v.Blackhole
+	v.lock.Unlock()
+
+	if !blackhole || rules.Get(v.Request.Rule) == nil {
+		return nil
+	}
+	if err := v.restore(ctx); err != nil {
+		return errors.Wrapf(err, "restore rule %v", v.Request.Rule)
+	}
+	return nil
+}
+
+// TcOutageStart starts the outages of a rule by the JSON body, for example, 2s outage every 20s:
+//
+//	{"rule": "rule-1", "mode": "periodic", "duration": 2000, "period": 20000}
+//
+// Or random outages of 1s to 5s, with a mean gap of 60s:
+//
+//	{"rule": "rule-1", "mode": "random", "minDuration": 1000, "maxDuration": 5000, "meanGap": 60000, "seed": 1}
+func TcOutageStart(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	req := &OutageRequest{}
+	defer r.Body.Close()
+	if b, err := ioutil.ReadAll(r.Body); err != nil {
+		return errors.Wrapf(err, "read body")
+	} else if err := json.Unmarshal(b, req); err != nil {
+		return errors.Wrapf(err, "parse body %v", string(b))
+	}
+
+	outage, err := NewOutage(req)
+	if err != nil {
+		return err
+	}
+	if err := jobs.Start(ctx, outage); err != nil {
+		return err
+	}
+
+	return writeJob(ctx, w, r, outage)
+}
+
+// TcOutageStop stops the outages, and responses after the rule is restored to its strategies.
+func TcOutageStop(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	return transitJob(ctx, w, r, "outage", jobStopped, jobRunning)
+}
+
+// TcOutageStatus responses the outage by id, or all outages if no id.
+func TcOutageStatus(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	return statusJob(ctx, w, r, "outage", "outages")
+}
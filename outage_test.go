@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestOutageRequestValidate(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		req  *OutageRequest
+		ok   bool
+	}{
+		{"periodic", &OutageRequest{Rule: "rule-1", Mode: "periodic", Duration: 2000, Period: 20000}, true},
+		{"random", &OutageRequest{Rule: "rule-1", Mode: "random", MinDuration: 1000, MaxDuration: 5000, MeanGap: 60000},
+			true,
+		},
+		{"no rule", &OutageRequest{Mode: "periodic", Duration: 2000, Period: 20000}, false},
+		{"count", &OutageRequest{Rule: "rule-1", Mode: "periodic", Duration: 2000, Period: 20000, Count: -1}, false},
+		{"mode", &OutageRequest{Rule: "rule-1", Mode: "burst", Duration: 2000, Period: 20000}, false},
+		{"duration", &OutageRequest{Rule: "rule-1", Mode: "periodic", Period: 20000}, false},
+		{"period", &OutageRequest{Rule: "rule-1", Mode: "periodic", Duration: 2000, Period: 2000}, false},
+		{"random duration", &OutageRequest{Rule: "rule-1", Mode: "random", MinDuration: 5000, MaxDuration: 1000,
+			MeanGap: 60000}, false,
+		},
+		{"gap", &OutageRequest{Rule: "rule-1", Mode: "random", MinDuration: 1000, MaxDuration: 5000}, false},
+	} {
+		if err := c.req.Validate(); (err == nil) != c.ok {
+			t.Errorf("%v: expect ok=%v, actual err %v", c.name, c.ok, err)
+		}
+	}
+}
+
+func TestOutageNext(t *testing.T) {
+	v := &Outage{Request: &OutageRequest{Rule: "rule-1", Mode: "periodic", Duration: 2000, Period: 20000, Count: 2}}
+
+	for i, c := range []struct {
+		delay     time.Duration
+		blackhole bool
+		ok        bool
+	}{
+		{18 * time.Second, false, true},
+		{2 * time.Second, true, true},
+		{18 * time.Second, false, true},
+		{2 * time.Second, true, true},
+		// Restore the rule after the last outage, then done.
+		{0, false, true},
+		{0, false, false},
+	} {
+		delay, ok := v.next(time.Now())
+		if delay != c.delay || v.blackhole != c.blackhole || ok != c.ok {
+			t.Errorf("step %v: expect %v/%v/%v, actual %v/%v/%v",
+				i, c.delay, c.blackhole, c.ok, delay, v.blackhole, ok,
+			)
+		}
+
+		// Apply the transition, without the rule.
+		if v.blackhole && !v.Blackhole {
+			v.Outages++
+		}
+		v.Blackhole = v.blackhole
+	}
+	if v.Outages != 2 {
+		t.Errorf("expect 2 outages, actual %v", v.Outages)
+	}
+}
+
+func TestOutageScheduleRandom(t *testing.T) {
+	req := &OutageRequest{Rule: "rule-1", Mode: "random", MinDuration: 1000, MaxDuration: 5000, MeanGap: 60000}
+	a := &Outage{Request: req, random: rand.New(rand.NewSource(1))}
+	b := &Outage{Request: req, random: rand.New(rand.NewSource(1))}
+
+	for i := 0; i < 1000; i++ {
+		gap, duration := a.schedule()
+		if gap < 0 || duration < time.Second || duration > 5*time.Second {
+			t.Errorf("step %v: invalid gap=%v, duration=%v", i, gap, duration)
+		}
+		if gap2, duration2 := b.schedule(); gap2 != gap || duration2 != duration {
+			t.Errorf("step %v: expect %v/%v by the same seed, actual %v/%v", i, gap, duration, gap2, duration2)
+		}
+	}
+}
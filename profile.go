@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// The file in data directory to persist the profiles created by user.
+const profilesFile = "profiles.json"
+
+// NetworkProfile is a named network condition, with the strategies of both directions, for example, 3G is
+// 1.6mbps downlink and 768kbps uplink with 150ms delay.
+type NetworkProfile struct {
+	// The name of profile, which is case-insensitive.
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Whether built-in preset, which is read-only.
+	Builtin bool `json:"builtin,omitempty"`
+	// The strategies of uplink, which is the traffic from client, that is the incoming direction.
+	Uplink []*NetworkStrategy `json:"uplink,omitempty"`
+	// The strategies of downlink, which is the traffic to client, that is the outgoing direction.
+	Downlink []*NetworkStrategy `json:"downlink,omitempty"`
+}
+
+// StrategiesOf returns a copy of the strategies of direction, so the rule never changes with the profile.
+func (v *NetworkProfile) StrategiesOf(direction string) ([]*NetworkStrategy, error) {
+	strategies := v.Downlink
+	if direction == "incoming" {
+		strategies = v.Uplink
+	}
+	if len(strategies) == 0 {
+		return nil, errors.Errorf("profile %v has no strategy for direction=%v", v.Name, direction)
+	}
+
+	var copied []*NetworkStrategy
+	for _, strategy := range strategies {
+		s := *strategy
+		copied = append(copied, &s)
+	}
+	return copied, nil
+}
+
+var profileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Validate checks the name and strategies of profile.
+func (v *NetworkProfile) Validate() error {
+	if v.Name == "" {
+		return errors.New("no name")
+	}
+	if !profileNameRegexp.MatchString(v.Name) {
+		return errors.Errorf("invalid name=%v", v.Name)
+	}
+	if len(v.Uplink) == 0 && len(v.Downlink) == 0 {
+		return errors.Errorf("no uplink or downlink of profile %v", v.Name)
+	}
+
+	for direction, strategies := range map[string][]*NetworkStrategy{"uplink": v.Uplink, "downlink": v.Downlink} {
+		if len(strategies) == 0 {
+			continue
+		}
+		if err := applyPresets(strategies); err != nil {
+			return errors.Wrapf(err, "%v of profile %v", direction, v.Name)
+		}
+		if err := validateStrategies(strategies); err != nil {
+			return errors.Wrapf(err, "%v of profile %v", direction, v.Name)
+		}
+	}
+	return nil
+}
+
+// builtinProfiles are the presets of typical networks, the rate in kbps, and the delay in ms of one direction.
+var builtinProfiles = []*NetworkProfile{
+	{
+		Name: "2G", Description: "EDGE, 250kbps down, 50kbps up, 300ms delay",
+		Downlink: []*NetworkStrategy{{Strategy: "rate", Rate: 250}, {Strategy: "delay", Delay: 300}},
+		Uplink:   []*NetworkStrategy{{Strategy: "rate", Rate: 50}, {Strategy: "delay", Delay: 300}},
+	},
+	{
+		Name: "3G", Description: "HSPA, 1.6mbps down, 768kbps up, 150ms delay",
+		Downlink: []*NetworkStrategy{{Strategy: "rate", Rate: 1600}, {Strategy: "delay", Delay: 150}},
+		Uplink:   []*NetworkStrategy{{Strategy: "rate", Rate: 768}, {Strategy: "delay", Delay: 150}},
+	},
+	{
+		Name: "4G", Description: "12mbps down, 5mbps up, 50ms delay",
+		Downlink: []*NetworkStrategy{{Strategy: "rate", Rate: 12000}, {Strategy: "delay", Delay: 50}},
+		Uplink:   []*NetworkStrategy{{Strategy: "rate", Rate: 5000}, {Strategy: "delay", Delay: 50}},
+	},
+	{
+		Name: "LTE-lossy", Description: "10mbps down, 4mbps up, 60ms delay with 20ms jitter, 3% loss",
+		Downlink: []*NetworkStrategy{
+			{Strategy: "rate", Rate: 10000}, {Strategy: "delay", Delay: 60, DelayDistro: 20}, {Strategy: "loss", Loss: 3},
+		},
+		Uplink: []*NetworkStrategy{
+			{Strategy: "rate", Rate: 4000}, {Strategy: "delay", Delay: 60, DelayDistro: 20}, {Strategy: "loss", Loss: 3},
+		},
+	},
+	{
+		Name: "satellite", Description: "Geostationary, 15mbps down, 3mbps up, 300ms delay, 0.5% loss",
+		Downlink: []*NetworkStrategy{
+			{Strategy: "rate", Rate: 15000}, {Strategy: "delay", Delay: 300}, {Strategy: "loss", Loss: 0.5},
+		},
+		Uplink: []*NetworkStrategy{
+			{Strategy: "rate", Rate: 3000}, {Strategy: "delay", Delay: 300}, {Strategy: "loss", Loss: 0.5},
+		},
+	},
+	{
+		Name: "congested-WiFi", Description: "2mbps down, 1mbps up, 40ms delay with 30ms jitter, 5% loss",
+		Downlink: []*NetworkStrategy{
+			{Strategy: "rate", Rate: 2000}, {Strategy: "delay", Delay: 40, DelayDistro: 30}, {Strategy: "loss", Loss: 5},
+		},
+		Uplink: []*NetworkStrategy{
+			{Strategy: "rate", Rate: 1000}, {Strategy: "delay", Delay: 40, DelayDistro: 30}, {Strategy: "loss", Loss: 5},
+		},
+	},
+}
+
+func init() {
+	for _, profile := range builtinProfiles {
+		profile.Builtin = true
+	}
+}
+
+// profileManager manages the profiles created by user, and the built-in presets.
+type profileManager struct {
+	// The profiles created by user, in the order of creation.
+	profiles []*NetworkProfile
+	lock     sync.Mutex
+}
+
+var profiles = &profileManager{}
+
+// Load loads the profiles created by user from disk.
+func (v *profileManager) Load(ctx context.Context) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if _, err := loadJSON(profilesFile, &v.profiles); err != nil {
+		return err
+	}
+
+	logger.Tf(ctx, "Load %v profiles from %v", len(v.profiles), storeFile(profilesFile))
+	return nil
+}
+
+// save persists the profiles created by user, then replaces them in memory, so they are unchanged if failed to save.
+// The caller should hold the lock.
+func (v *profileManager) save(profiles []*NetworkProfile) error {
+	if profiles == nil {
+		profiles = []*NetworkProfile{}
+	}
+	if err := saveJSON(profilesFile, profiles); err != nil {
+		return err
+	}
+
+	v.profiles = profiles
+	return nil
+}
+
+// find returns the index of profile created by user, or -1. The caller should hold the lock.
+func (v *profileManager) find(name string) int {
+	for i, profile := range v.profiles {
+		if strings.EqualFold(profile.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get returns the profile by name, the built-in preset first, or nil if not exists.
+func (v *profileManager) Get(name string) *NetworkProfile {
+	for _, profile := range builtinProfiles {
+		if strings.EqualFold(profile.Name, name) {
+			return profile
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if i := v.find(name); i >= 0 {
+		return v.profiles[i]
+	}
+	return nil
+}
+
+// List returns the built-in presets and the profiles created by user.
+func (v *profileManager) List() []*NetworkProfile {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return append(append([]*NetworkProfile{}, builtinProfiles...), v.profiles...)
+}
+
+// Create creates a profile, or updates the existing one if update, which is never a built-in preset.
+func (v *profileManager) Create(ctx context.Context, profile *NetworkProfile, update bool) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	for _, builtin := range builtinProfiles {
+		if strings.EqualFold(builtin.Name, profile.Name) {
+			return errors.Errorf("profile %v is built-in", builtin.Name)
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	profile.Builtin = false
+	profiles := append([]*NetworkProfile{}, v.profiles...)
+	if i := v.find(profile.Name); i >= 0 && !update {
+		return errors.Errorf("profile %v exists", profile.Name)
+	} else if i < 0 && update {
+		return errors.Errorf("no profile %v", profile.Name)
+	} else if i >= 0 {
+		profiles[i] = profile
+	} else {
+		profiles = append(profiles, profile)
+	}
+
+	if err := v.save(profiles); err != nil {
+		return err
+	}
+
+	logger.Tf(ctx, "Save profile %v, update=%v, uplink=%v, downlink=%v", profile.Name, update, profile.Uplink, profile.Downlink)
+	return nil
+}
+
+// Import creates the profiles converted from other tools, and updates the existing ones if overwrite. All or none
+// of the profiles are saved.
+func (v *profileManager) Import(ctx context.Context, imported []*NetworkProfile, overwrite bool) error {
+	names := make(map[string]bool)
+	for _, profile := range imported {
+		if err := profile.Validate(); err != nil {
+			return err
+		}
+		for _, builtin := range builtinProfiles {
+			if strings.EqualFold(builtin.Name, profile.Name) {
+				return errors.Errorf("profile %v is built-in", builtin.Name)
+			}
+		}
+		if name := strings.ToLower(profile.Name); names[name] {
+			return errors.Errorf("duplicated profile %v", profile.Name)
+		} else {
+			names[name] = true
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, profile := range imported {
+		if i := v.find(profile.Name); i >= 0 && !overwrite {
+			return errors.Errorf("profile %v exists", profile.Name)
+		}
+	}
+
+	// The names imported are unique, so the index found in the profiles before import is the same in the copy.
+	profiles := append([]*NetworkProfile{}, v.profiles...)
+	for _, profile := range imported {
+		profile.Builtin = false
+		if i := v.find(profile.Name); i >= 0 {
+			profiles[i] = profile
+		} else {
+			profiles = append(profiles, profile)
+		}
+	}
+
+	if err := v.save(profiles); err != nil {
+		return err
+	}
+
+	logger.Tf(ctx, "Import %v profiles, overwrite=%v", len(imported), overwrite)
+	return nil
+}
+
+// Delete removes the profile created by user.
+func (v *profileManager) Delete(ctx context.Context, name string) (*NetworkProfile, error) {
+	for _, builtin := range builtinProfiles {
+		if strings.EqualFold(builtin.Name, name) {
+			return nil, errors.Errorf("profile %v is built-in", builtin.Name)
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	i := v.find(name)
+	if i < 0 {
+		return nil, errors.Errorf("no profile %v", name)
+	}
+
+	profile := v.profiles[i]
+	profiles := append(append([]*NetworkProfile{}, v.profiles[:i]...), v.profiles[i+1:]...)
+	if err := v.save(profiles); err != nil {
+		return nil, err
+	}
+
+	logger.Tf(ctx, "Delete profile %v", profile.Name)
+	return profile, nil
+}
+
+// expandProfile fills the strategies of request by its profile, for the direction of request.
+func expandProfile(req *NetworkRequest) error {
+	if req.Profile == "" {
+		return nil
+	}
+	if len(req.Strategies) > 0 {
+		return errors.Errorf("profile %v and strategies are exclusive", req.Profile)
+	}
+
+	profile := profiles.Get(req.Profile)
+	if profile == nil {
+		return errors.Errorf("no profile %v", req.Profile)
+	}
+
+	strategies, err := profile.StrategiesOf(req.Direction)
+	if err != nil {
+		return err
+	}
+	req.Strategies = strategies
+	return nil
+}
+
+func TcProfileList(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ohttp.WriteData(ctx, w, r, &struct {
+		Profiles []*NetworkProfile `json:"profiles"`
+	}{
+		Profiles: profiles.List(),
+	})
+	return nil
+}
+
+func TcProfileGet(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		return errors.New("no name")
+	}
+
+	profile := profiles.Get(name)
+	if profile == nil {
+		return errors.Errorf("no profile %v", name)
+	}
+
+	ohttp.WriteData(ctx, w, r, profile)
+	return nil
+}
+
+// TcProfileCreate creates a profile by the JSON body, for example:
+//
+//	{"name": "my-3g", "uplink": [{"strategy": "rate", "rate": 500}],
+//	"downlink": [{"strategy": "rate", "rate": 1000}, {"strategy": "delay", "delay": 200}]}
+func TcProfileCreate(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	return saveProfile(ctx, w, r, false)
+}
+
+// TcProfileUpdate replaces the profile by the JSON body, which is the same as create.
+func TcProfileUpdate(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	return saveProfile(ctx, w, r, true)
+}
+
+func saveProfile(ctx context.Context, w http.ResponseWriter, r *http.Request, update bool) error {
+	profile := &NetworkProfile{}
+	defer r.Body.Close()
+	if b, err := ioutil.ReadAll(r.Body); err != nil {
+		return errors.Wrapf(err, "read body")
+	} else if err := json.Unmarshal(b, profile); err != nil {
+		return errors.Wrapf(err, "parse body %v", string(b))
+	}
+
+	if err := profiles.Create(ctx, profile, update); err != nil {
+		return err
+	}
+
+	ohttp.WriteData(ctx, w, r, profile)
+	return nil
+}
+
+func TcProfileDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		return errors.New("no name")
+	}
+
+	profile, err := profiles.Delete(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	ohttp.WriteData(ctx, w, r, profile)
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestProfileManagerSaveError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tc-ui")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The data dir is a file, so the profiles can't be saved.
+	file := path.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("TC_DATA_DIR", os.Getenv("TC_DATA_DIR"))
+	os.Setenv("TC_DATA_DIR", path.Join(file, "data"))
+
+	profile := func(name string, rate float64) *NetworkProfile {
+		return &NetworkProfile{Name: name, Downlink: []*NetworkStrategy{{Strategy: "rate", Rate: rate}}}
+	}
+	existing := []*NetworkProfile{profile("a", 100), profile("b", 200)}
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		name   string
+		change func(v *profileManager) error
+	}{
+		{"create", func(v *profileManager) error { return v.Create(ctx, profile("c", 300), false) }},
+		{"update", func(v *profileManager) error { return v.Create(ctx, profile("a", 300), true) }},
+		{"import", func(v *profileManager) error {
+			return v.Import(ctx, []*NetworkProfile{profile("b", 300), profile("c", 300)}, true)
+		}},
+		{"delete", func(v *profileManager) error {
+			_, err := v.Delete(ctx, "a")
+			return err
+		}},
+	} {
+		v := &profileManager{profiles: append([]*NetworkProfile{}, existing...)}
+		if err := c.change(v); err == nil {
+			t.Errorf("%v: expect error", c.name)
+		}
+		if !reflect.DeepEqual(v.profiles, existing) {
+			t.Errorf("%v: expect %v, actual %v", c.name, existing, v.profiles)
+		}
+	}
+}
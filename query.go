@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// NetworkQueryRule is a rule in the result of query, which is decoded from the qdiscs, classes and filters in
+// kernel, in the same shape as the body of apply, so it can be modified and written back.
+type NetworkQueryRule struct {
+	// The ID of rule, and the link profile if the rule is a direction of link, empty if the rule is not managed by
+	// tc-ui, for example, set by tcset.
+	ID   string `json:"id"`
+	Link string `json:"link,omitempty"`
+	// The device and class of rule, the ifb device for incoming.
+	Dev   string `json:"dev"`
+	Class string `json:"class"`
+	// The request decoded, without the profile and duration.
+	*NetworkRequest
+	// The reason if some filter can't be decoded, for example, matching both IP and port.
+	Error string `json:"error,omitempty"`
+
+	// The alternatives of u32 keys of the filters, to match the rule of tc-ui.
+	alternatives []string
+}
+
+// NetworkQuery is the state of an interface, the rules applied and the raw state queried by shaper.
+type NetworkQuery struct {
+	Iface  string `json:"iface"`
+	Shaper string `json:"shaper"`
+	// The command and raw output of shaper, for example, tcshow for tcconfig.
+	Cmd    string `json:"cmd"`
+	Output string `json:"output"`
+	// Whether the qdiscs, classes and filters differ from the ones recorded when the rules are applied, so the
+	// rules might not be in effect, with the differences, see reconcile.
+	Drifted bool        `json:"drifted"`
+	Diffs   []*HostDiff `json:"diffs"`
+	// The rules in kernel, in the order of device and class.
+	Rules []*NetworkQueryRule `json:"rules"`
+	// The link profiles of iface, each with the rules of uplink and downlink.
+	Links []*NetworkLink `json:"links"`
+	// The pending expiries of iface, to revert the setup with duration.
+	Expiries []*NetworkExpiry `json:"expiries"`
+	// The reason if failed to query the interface, when querying all interfaces.
+	Error string `json:"error,omitempty"`
+}
+
+// Query queries the state of interface by shaper, with the rules of interface. The shaper is not queried if the os
+// is darwin.
+func (v *ruleManager) Query(ctx context.Context, iface string) (*NetworkQuery, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.query(ctx, iface)
+}
+
+// query queries the interface, the caller should hold the lock.
+func (v *ruleManager) query(ctx context.Context, iface string) (*NetworkQuery, error) {
+	query := &NetworkQuery{Iface: iface, Shaper: shaper.Name(), Diffs: []*HostDiff{}, Rules: []*NetworkQueryRule{}}
+	if isDarwin {
+		return query, nil
+	}
+
+	var err error
+	if query.Cmd, query.Output, err = shaper.Query(ctx, iface); err != nil {
+		return nil, errors.Wrapf(err, "query %v by %v", iface, shaper.Name())
+	}
+
+	conn, err := nlDial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	captured, _, err := v.captureIfaces(conn, []string{iface})
+	if err != nil {
+		return nil, errors.Wrapf(err, "capture %v", iface)
+	}
+
+	if expected, ok := v.states[iface]; len(v.rulesOf(iface)) > 0 {
+		if query.Diffs = diffHostStates(expected, captured); !ok || len(query.Diffs) > 0 {
+			query.Drifted = true
+		}
+	}
+
+	query.Rules = decodeHostRules(iface, captured, v.rulesOf(iface))
+	return query, nil
+}
+
+// decodeHostRules decodes the rules of interface from the kernel objects, each rule is a htb class with the filters
+// classifying to it, and the netem under it. The rules of tc-ui are matched by the keys of filters.
+func decodeHostRules(iface string, interfaces []*HostInterface, managed []*NetworkRule) []*NetworkQueryRule {
+	// The ifb devices redirected to by the ingress filters of iface are for incoming.
+	directions := map[string]string{iface: "outgoing"}
+	for _, dev := range interfaces {
+		for _, f := range dev.Filters {
+			if dev.Name == iface && f.Redirect != "" {
+				directions[f.Redirect] = "incoming"
+			}
+		}
+	}
+
+	decoded := []*NetworkQueryRule{}
+	for _, dev := range interfaces {
+		direction := directions[dev.Name]
+		if direction == "" {
+			continue
+		}
+
+		defaults := make(map[string]bool)
+		for _, q := range dev.Qdiscs {
+			if handle, err := tcParseHandle(q.Handle); err == nil && q.Kind == "htb" {
+				defaults[tcHandleString(handle|uint32(q.Default))] = true
+			}
+		}
+
+		for _, c := range dev.Classes {
+			if defaults[c.Classid] {
+				continue
+			}
+
+			rule := &NetworkQueryRule{
+				Dev: dev.Name, Class: c.Classid, NetworkRequest: &NetworkRequest{
+					Iface: iface, Protocol: "ip", Direction: direction, IdentifyKey: "all",
+					Strategies: []*NetworkStrategy{},
+				},
+			}
+
+			var filters []*HostFilter
+			for _, f := range dev.Filters {
+				if f.Flowid == c.Classid && f.Redirect == "" && f.Unsupported == "" {
+					filters = append(filters, f)
+				}
+			}
+			if len(filters) == 0 {
+				continue
+			}
+			if err := rule.decodeFilters(filters); err != nil {
+				rule.Error = err.Error()
+			}
+
+			var netem *HostNetem
+			for _, q := range dev.Qdiscs {
+				if q.Parent == c.Classid && q.Netem != nil {
+					netem = q.Netem
+				}
+			}
+			rule.decodeStrategies(c, netem)
+
+			decoded = append(decoded, rule)
+		}
+	}
+
+	// Match the rule of tc-ui, which has all the keys of the decoded filters. A rule might be more than one class,
+	// for example, tcconfig sets each value of the rule as a class, so prefer the rule not matched yet.
+	matches := func(rule *NetworkQueryRule, r *NetworkRule) bool {
+		if r.opts.direction != rule.Direction {
+			return false
+		}
+
+		expected := make(map[string]bool)
+		for _, ipv6 := range []bool{false, true} {
+			alternatives, _ := buildTcFilterKeys(r.opts, ipv6)
+			for _, keys := range alternatives {
+				expected[tcCanonicalKeys(keys)] = true
+			}
+		}
+
+		for _, alternative := range rule.alternatives {
+			if !expected[alternative] {
+				return false
+			}
+		}
+		return true
+	}
+
+	matched := make(map[string]bool)
+	for _, rule := range decoded {
+		var candidate *NetworkRule
+		for _, r := range managed {
+			if matches(rule, r) && (candidate == nil || matched[candidate.ID] && !matched[r.ID]) {
+				candidate = r
+			}
+		}
+		if candidate != nil {
+			matched[candidate.ID], rule.ID, rule.Link = true, candidate.ID, candidate.Link
+		}
+	}
+	return decoded
+}
+
+// tcCanonicalKeys formats the keys in order, ignoring the keys which match all, to compare the filters.
+func tcCanonicalKeys(keys []tcU32Key) string {
+	var r0 []string
+	for _, key := range keys {
+		if key.mask != 0 {
+			r0 = append(r0, fmt.Sprintf("%08x/%08x@%v", key.val&key.mask, key.mask, key.off))
+		}
+	}
+	sort.Strings(r0)
+	return strings.Join(r0, ",")
+}
+
+// decodeFilters decodes the protocol, identifyKey and identifyValue from the keys of filters.
+func (v *NetworkQueryRule) decodeFilters(filters []*HostFilter) error {
+	var protocol, identifyKey string
+	var ranges []*tcPortRange
+	var ipnets []string
+	visited := make(map[string]bool)
+
+	for _, f := range filters {
+		o, err := f.filter(v.Dev)
+		if err != nil {
+			return err
+		}
+		v.alternatives = append(v.alternatives, tcCanonicalKeys(o.keys))
+
+		fp, key, value, err := decodeTcFilterKeys(v.Direction, o.protocol == tcProtocolIPv6, o.keys)
+		if err != nil {
+			return errors.Wrapf(err, "filter %v", f.Handle)
+		}
+		if (protocol != "" && fp != protocol) || (identifyKey != "" && key != identifyKey) {
+			return errors.Errorf("filter %v mismatch protocol=%v, identifyKey=%v", f.Handle, fp, key)
+		}
+		protocol, identifyKey = fp, key
+
+		if r, ok := value.(*tcPortRange); ok {
+			ranges = append(ranges, r)
+		} else if ipnet, ok := value.(*net.IPNet); ok {
+			s := ipnet.String()
+			if ones, bits := ipnet.Mask.Size(); ones == bits {
+				s = ipnet.IP.String()
+			}
+			if !visited[s] {
+				visited[s] = true
+				ipnets = append(ipnets, s)
+			}
+		}
+	}
+
+	// Merge the blocks of port ranges, which are duplicated for IPv4 and IPv6.
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].from < ranges[j].from
+	})
+	var merged []*tcPortRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && uint32(r.from) <= uint32(merged[n-1].to)+1 {
+			if r.to > merged[n-1].to {
+				merged[n-1].to = r.to
+			}
+			continue
+		}
+		merged = append(merged, &tcPortRange{from: r.from, to: r.to})
+	}
+
+	values := ipnets
+	for _, r := range merged {
+		if r.from == r.to {
+			values = append(values, fmt.Sprintf("%v", r.from))
+		} else {
+			values = append(values, fmt.Sprintf("%v-%v", r.from, r.to))
+		}
+	}
+
+	v.Protocol, v.IdentifyKey, v.IdentifyValue = protocol, identifyKey, strings.Join(values, ",")
+	return nil
+}
+
+// decodeTcFilterKeys decodes the keys of a filter, built by buildTcFilterKeys or tcset, to the protocol and the
+// identifyKey with the value, which is a *tcPortRange or *net.IPNet, or nil for all.
+func decodeTcFilterKeys(direction string, ipv6 bool, keys []tcU32Key) (string, string, interface{}, error) {
+	protocolKey, portOff := tcU32IPProtocol(ipv6, 0), int32(tcU32IPv4PortOffset)
+	srcOff, dstOff, size := int32(tcU32IPv4SourceOffset), int32(tcU32IPv4DestOffset), int32(net.IPv4len)
+	if ipv6 {
+		portOff, srcOff, dstOff, size = tcU32IPv6PortOffset, tcU32IPv6SourceOffset, tcU32IPv6DestOffset, net.IPv6len
+	}
+
+	protocol := "ip"
+	var srcPort, dstPort *tcPortRange
+	src := &net.IPNet{IP: make(net.IP, size), Mask: make(net.IPMask, size)}
+	dst := &net.IPNet{IP: make(net.IP, size), Mask: make(net.IPMask, size)}
+	var hasSrc, hasDst bool
+
+	for _, key := range keys {
+		switch {
+		case key.mask == 0:
+		case key.off == protocolKey.off && key.mask == protocolKey.mask:
+			p := uint8(key.val >> 16)
+			if ipv6 {
+				p = uint8(key.val >> 8)
+			}
+			if protocol = tcIPProtocolString(p); protocol == "icmpv6" {
+				protocol = "icmp"
+			}
+		case key.off == portOff && key.mask&0xffff == 0:
+			srcPort = tcPortRangeOf(uint16(key.val>>16), uint16(key.mask>>16))
+		case key.off == portOff && key.mask>>16 == 0:
+			dstPort = tcPortRangeOf(uint16(key.val), uint16(key.mask))
+		case key.off >= srcOff && key.off+4 <= srcOff+size:
+			hasSrc = true
+			tcPutIPKey(src, key, key.off-srcOff)
+		case key.off >= dstOff && key.off+4 <= dstOff+size:
+			hasDst = true
+			tcPutIPKey(dst, key, key.off-dstOff)
+		default:
+			return "", "", nil, errors.Errorf("unknown key %08x/%08x at %v", key.val, key.mask, key.off)
+		}
+	}
+
+	// For outgoing, the server is the source, while for incoming the server is the destination.
+	serverPort, clientPort, clientIP, hasClientIP, hasServerIP := srcPort, dstPort, dst, hasDst, hasSrc
+	if direction == "incoming" {
+		serverPort, clientPort, clientIP, hasClientIP, hasServerIP = dstPort, srcPort, src, hasSrc, hasDst
+	}
+
+	identifyKey, value, matches := "all", interface{}(nil), 0
+	if serverPort != nil {
+		identifyKey, value, matches = "serverPort", serverPort, matches+1
+	}
+	if clientPort != nil {
+		identifyKey, value, matches = "clientPort", clientPort, matches+1
+	}
+	if hasClientIP {
+		identifyKey, value, matches = "clientIp", clientIP, matches+1
+	}
+	if hasServerIP {
+		return "", "", nil, errors.Errorf("match the IP of server for %v", direction)
+	}
+	if matches > 1 {
+		return "", "", nil, errors.New("match more than one of port and IP")
+	}
+
+	return protocol, identifyKey, value, nil
+}
+
+// tcPortRangeOf returns the range of port block by the mask, for example, 9000/0xfffc is 9000-9003.
+func tcPortRangeOf(port, mask uint16) *tcPortRange {
+	from := port & mask
+	return &tcPortRange{from: from, to: from | ^mask}
+}
+
+// tcPutIPKey puts the word of key to the address at offset.
+func tcPutIPKey(ipnet *net.IPNet, key tcU32Key, off int32) {
+	for i := int32(0); i < 4; i++ {
+		shift := uint(24 - 8*i)
+		ipnet.IP[off+i] = byte(key.val >> shift)
+		ipnet.Mask[off+i] = byte(key.mask >> shift)
+	}
+}
+
+// decodeStrategies decodes the strategies from the rate of class and the netem under it.
+func (v *NetworkQueryRule) decodeStrategies(c *HostClass, netem *HostNetem) {
+	if netem != nil && netem.LossModel == "state" && len(netem.LossModelParams) >= 5 {
+		p := netem.LossModelParams
+		v.Strategies = append(v.Strategies, &NetworkStrategy{
+			Strategy: "lossState", P13: p[0], P31: p[1], P32: p[2], P23: p[3], P14: p[4],
+		})
+	} else if netem != nil && netem.LossModel == "gemodel" && len(netem.LossModelParams) >= 4 {
+		p := netem.LossModelParams
+		v.Strategies = append(v.Strategies, &NetworkStrategy{
+			Strategy: "lossGemodel", P: p[0], R: p[1], LossBad: p[2], LossGood: p[3],
+		})
+	} else if netem != nil && netem.Loss > 0 {
+		v.Strategies = append(v.Strategies, &NetworkStrategy{
+			Strategy: "loss", Loss: netem.Loss, LossCorrelation: netem.LossCorrelation,
+		})
+	}
+
+	if netem != nil && (netem.Delay > 0 || netem.Jitter > 0) {
+		v.Strategies = append(v.Strategies, &NetworkStrategy{
+			Strategy: "delay", Delay: netem.Delay, DelayDistro: netem.Jitter, Distribution: netem.Distribution,
+			DelayCorrelation: netem.DelayCorrelation,
+		})
+	}
+
+	// The rate of class is in bits per second, while the rate strategy is in kbps.
+	if c.Rate < tcUnlimitedRate*8 {
+		v.Strategies = append(v.Strategies, &NetworkStrategy{Strategy: "rate", Rate: float64(c.Rate) / 1000})
+	}
+
+	if netem != nil && netem.Duplicate > 0 {
+		v.Strategies = append(v.Strategies, &NetworkStrategy{
+			Strategy: "duplicate", Duplicate: netem.Duplicate, DuplicateCorrelation: netem.DuplicateCorrelation,
+		})
+	}
+	if netem != nil && netem.Corrupt > 0 {
+		v.Strategies = append(v.Strategies, &NetworkStrategy{
+			Strategy: "corrupt", Corrupt: netem.Corrupt, CorruptCorrelation: netem.CorruptCorrelation,
+		})
+	}
+	if netem != nil && netem.Reorder > 0 {
+		v.Strategies = append(v.Strategies, &NetworkStrategy{
+			Strategy: "reorder", Reorder: netem.Reorder, ReorderCorrelation: netem.ReorderCorrelation, Gap: netem.Gap,
+		})
+	}
+}
+
+// QueryAll queries all interfaces, except the ifb devices created for incoming, in the order of system. The error of
+// an interface is in its query, rather than fails all interfaces.
+func (v *ruleManager) QueryAll(ctx context.Context) ([]*NetworkQuery, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, errors.Wrapf(err, "query interfaces")
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	queries := []*NetworkQuery{}
+	for _, iface := range ifaces {
+		if strings.HasPrefix(iface.Name, "tcifb") {
+			continue
+		}
+
+		// Continue to query other interfaces if failed, for example, the interface is removed during query.
+		query, err := v.query(ctx, iface.Name)
+		if err != nil {
+			logger.Wf(ctx, "Query %v err %+v", iface.Name, err)
+			query = &NetworkQuery{
+				Iface: iface.Name, Shaper: shaper.Name(), Diffs: []*HostDiff{}, Rules: []*NetworkQueryRule{},
+				Error: err.Error(),
+			}
+		}
+		queries = append(queries, query)
+	}
+	return queries, nil
+}
+
+// TcQuery responses the state of interface, or all interfaces if iface is empty, for example:
+//
+//	/tc/api/v1/config/query?iface=lo
+//	/tc/api/v1/config/query
+func TcQuery(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	iface := r.URL.Query().Get("iface")
+	if iface == "" {
+		logger.Tf(ctx, "Start query for all interfaces")
+
+		queries, err := rules.QueryAll(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, query := range queries {
+			query.Links, query.Expiries = rules.Links(query.Iface), rules.Expiries(query.Iface)
+		}
+
+		logger.Tf(ctx, "Query TC for %v interfaces, shaper=%v", len(queries), shaper.Name())
+		ohttp.WriteData(ctx, w, r, &struct {
+			Interfaces []*NetworkQuery `json:"interfaces"`
+		}{
+			Interfaces: queries,
+		})
+		return nil
+	}
+	logger.Tf(ctx, "Start query for iface=%v", iface)
+
+	query, err := rules.Query(ctx, iface)
+	if err != nil {
+		return err
+	}
+	query.Links, query.Expiries = rules.Links(iface), rules.Expiries(iface)
+
+	logger.Tf(ctx, "Query TC for iface=%v, shaper=%v, cmd=%v, rules=%v, drifted=%v, diffs=%v, %v",
+		iface, query.Shaper, query.Cmd, len(query.Rules), query.Drifted, len(query.Diffs), query.Output,
+	)
+	ohttp.WriteData(ctx, w, r, query)
+	return nil
+}
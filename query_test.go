@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeTcFilterKeys(t *testing.T) {
+	for _, c := range []struct {
+		name                  string
+		opts                  *NetworkOptions
+		ipv6                  bool
+		protocol, identifyKey string
+		values                []string
+	}{
+		{
+			"server port",
+			&NetworkOptions{protocol: "udp", direction: "outgoing", identifyKey: "serverPort", identifyValue: "8000"},
+			false, "udp", "serverPort", []string{"8000-8000"},
+		},
+		{
+			"client port block",
+			&NetworkOptions{protocol: "tcp", direction: "incoming", identifyKey: "clientPort", identifyValue: "9000-9003"},
+			false, "tcp", "clientPort", []string{"9000-9003"},
+		},
+		{
+			"server port range in IPv6",
+			&NetworkOptions{protocol: "udp", direction: "incoming", identifyKey: "serverPort", identifyValue: "8000-8002"},
+			true, "udp", "serverPort", []string{"8000-8001", "8002-8002"},
+		},
+		{
+			"client ip",
+			&NetworkOptions{protocol: "ip", direction: "outgoing", identifyKey: "clientIp", identifyValue: "10.0.0.0/8"},
+			false, "ip", "clientIp", []string{"10.0.0.0/8"},
+		},
+		{
+			// The icmpv6 is decoded as icmp, like the protocol option.
+			"client ip in IPv6",
+			&NetworkOptions{
+				protocol: "icmp", direction: "incoming", identifyKey: "clientIp",
+				identifyValue: "10.0.0.1,2001:db8::/32",
+			},
+			true, "icmp", "clientIp", []string{"2001:db8::/32"},
+		},
+		{
+			"all",
+			&NetworkOptions{protocol: "all", direction: "outgoing", identifyKey: "all"},
+			false, "ip", "all", []string{""},
+		},
+	} {
+		alternatives, err := buildTcFilterKeys(c.opts, c.ipv6)
+		if err != nil {
+			t.Errorf("%v: build err %+v", c.name, err)
+			continue
+		}
+
+		var values []string
+		for _, keys := range alternatives {
+			protocol, identifyKey, value, err := decodeTcFilterKeys(c.opts.direction, c.ipv6, keys)
+			if err != nil {
+				t.Errorf("%v: decode %v err %+v", c.name, keys, err)
+				continue
+			}
+			if protocol != c.protocol || identifyKey != c.identifyKey {
+				t.Errorf("%v: expect %v %v, actual %v %v", c.name, c.protocol, c.identifyKey, protocol, identifyKey)
+			}
+
+			if r, ok := value.(*tcPortRange); ok {
+				values = append(values, fmt.Sprintf("%v-%v", r.from, r.to))
+			} else if value != nil {
+				values = append(values, fmt.Sprintf("%v", value))
+			} else {
+				values = append(values, "")
+			}
+		}
+		if !reflect.DeepEqual(values, c.values) {
+			t.Errorf("%v: expect %v, actual %v", c.name, c.values, values)
+		}
+	}
+}
+
+func TestDecodeTcFilterKeysError(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("10.0.0.0/8")
+	for _, c := range []struct {
+		name      string
+		direction string
+		keys      []tcU32Key
+	}{
+		{"unknown key", "outgoing", []tcU32Key{{val: 0x45000000, mask: 0xff000000, off: 0}}},
+		// For outgoing, the source is the server.
+		{"server ip", "outgoing", tcU32SourceIP(ipnet)},
+		{"server ip of incoming", "incoming", tcU32DestIP(ipnet)},
+		{
+			"port and ip", "outgoing",
+			append([]tcU32Key{tcU32SourcePort(false, 8000, 0xffff)}, tcU32DestIP(ipnet)...),
+		},
+		{
+			"two ports", "incoming",
+			[]tcU32Key{tcU32SourcePort(false, 8000, 0xffff), tcU32DestPort(false, 9000, 0xffff)},
+		},
+	} {
+		if protocol, key, value, err := decodeTcFilterKeys(c.direction, false, c.keys); err == nil {
+			t.Errorf("%v: expect error, actual %v %v %v", c.name, protocol, key, value)
+		}
+	}
+}
+
+func TestTcCanonicalKeys(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		keys     []tcU32Key
+		expected string
+	}{
+		{"no keys", nil, ""},
+		{"match all", []tcU32Key{{}}, ""},
+		{"masked value", []tcU32Key{{val: 0x0a000001, mask: 0xff000000, off: 16}}, "0a000000/ff000000@16"},
+		{
+			// The order of keys is ignored, for the filters of tcset.
+			"sorted",
+			[]tcU32Key{{val: 0x1f400000, mask: 0xffff0000, off: 20}, {val: 0x00110000, mask: 0x00ff0000, off: 8}, {}},
+			"00110000/00ff0000@8,1f400000/ffff0000@20",
+		},
+	} {
+		if v := tcCanonicalKeys(c.keys); v != c.expected {
+			t.Errorf("%v: expect %v, actual %v", c.name, c.expected, v)
+		}
+	}
+}
+
+func TestTcPortRangeOf(t *testing.T) {
+	for _, c := range []struct {
+		port, mask uint16
+		from, to   uint16
+	}{
+		{8000, 0xffff, 8000, 8000},
+		{9000, 0xfffc, 9000, 9003},
+		{9001, 0xfffc, 9000, 9003},
+		{0, 0, 0, 65535},
+		{32768, 0x8000, 32768, 65535},
+	} {
+		if r := tcPortRangeOf(c.port, c.mask); r.from != c.from || r.to != c.to {
+			t.Errorf("%v/%#x: expect %v-%v, actual %v-%v", c.port, c.mask, c.from, c.to, r.from, r.to)
+		}
+	}
+}
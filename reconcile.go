@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The file in data directory to persist the desired state, that is the rules of all interfaces.
+const rulesFile = "rules.json"
+
+// networkDesiredState is the desired state persisted, to reapply the rules after restart.
+type networkDesiredState struct {
+	// The last number of rule and link ID, so the ID is never reused after restart.
+	LastID     uint64 `json:"lastId"`
+	LastLinkID uint64 `json:"lastLinkId"`
+	// The rules in the order of creation.
+	Rules []*NetworkRule `json:"rules"`
+	// The kernel objects captured after the rules are applied, by interface with its ifb devices, to detect the
+	// drift.
+	States map[string][]*HostInterface `json:"interfaces"`
+}
+
+// commit records the state of interfaces after the rules are changed, and persists the desired state. The caller
+// should hold the lock.
+func (v *ruleManager) commit(ctx context.Context, ifaces ...string) {
+	for _, iface := range ifaces {
+		v.observe(ctx, iface)
+	}
+	v.saveRules(ctx)
+}
+
+// observe captures the kernel objects of interface as the desired state, or forgets it if the interface has no
+// rules. The caller should hold the lock.
+func (v *ruleManager) observe(ctx context.Context, iface string) {
+	if v.states == nil {
+		v.states = make(map[string][]*HostInterface)
+	}
+
+	if isDarwin || len(v.rulesOf(iface)) == 0 {
+		delete(v.states, iface)
+		return
+	}
+
+	if captured, err := v.capture(iface); err != nil {
+		logger.Wf(ctx, "Observe %v err %+v", iface, err)
+		delete(v.states, iface)
+	} else {
+		v.states[iface] = captured
+	}
+}
+
+// capture captures the kernel objects of interface with its ifb devices, the caller should hold the lock.
+func (v *ruleManager) capture(iface string) ([]*HostInterface, error) {
+	conn, err := nlDial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	captured, _, err := v.captureIfaces(conn, []string{iface})
+	return captured, err
+}
+
+// saveRules persists the rules, so they are reapplied after restart. The caller should hold the lock.
+func (v *ruleManager) saveRules(ctx context.Context) {
+	state := &networkDesiredState{
+		LastID: v.lastID, LastLinkID: v.lastLinkID, Rules: v.rules, States: v.states,
+	}
+	if state.Rules == nil {
+		state.Rules = []*NetworkRule{}
+	}
+	if state.States == nil {
+		state.States = make(map[string][]*HostInterface)
+	}
+
+	if err := saveJSON(rulesFile, state); err != nil {
+		logger.Wf(ctx, "Save rules err %+v", err)
+	}
+}
+
+// LoadRules loads the rules persisted before restart, which should be reconciled to reapply them.
+func (v *ruleManager) LoadRules(ctx context.Context) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	state := &networkDesiredState{}
+	if ok, err := loadJSON(rulesFile, state); err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+
+	// The rules owned by jobs are dropped, and the rules changed temporarily by jobs are restored, because the jobs
+	// are gone, then the interfaces are reapplied.
+	var loaded []*NetworkRule
+	var ifaces []string
+	visited := make(map[string]bool)
+	for _, rule := range state.Rules {
+		if rule.Request == nil {
+			return errors.Errorf("no request of rule %v", rule.ID)
+		}
+		rule.opts = rule.Request.Options()
+		v.reserveID(rule)
+
+		if rule.Job == "" && rule.Restore == nil {
+			loaded = append(loaded, rule)
+			continue
+		}
+
+		if rule.Job != "" {
+			logger.Wf(ctx, "Drop rule %v of job %v", rule, rule.Job)
+		} else {
+			req := *rule.Request
+			req.Strategies = rule.Restore
+			rule.Request, rule.opts, rule.Restore = &req, req.Options(), nil
+			loaded = append(loaded, rule)
+			logger.Wf(ctx, "Restore rule %v", rule)
+		}
+		if !visited[rule.opts.iface] {
+			visited[rule.opts.iface] = true
+			ifaces = append(ifaces, rule.opts.iface)
+		}
+	}
+
+	v.rules, v.states = loaded, state.States
+	if state.LastID > v.lastID {
+		v.lastID = state.LastID
+	}
+	if state.LastLinkID > v.lastLinkID {
+		v.lastLinkID = state.LastLinkID
+	}
+
+	for _, iface := range ifaces {
+		if err := v.rollback(ctx, iface, v.rulesOf(iface)); err != nil {
+			// Forget the state, so the interface is reapplied by the reconciler.
+			logger.Wf(ctx, "Reapply %v err %+v", iface, err)
+			delete(v.states, iface)
+		} else {
+			v.observe(ctx, iface)
+		}
+	}
+	if len(ifaces) > 0 {
+		v.saveRules(ctx)
+	}
+
+	logger.Tf(ctx, "Load %v rules from %v", len(v.rules), storeFile(rulesFile))
+	return nil
+}
+
+// NetworkDrift is the difference between the actual state of interface and the desired one.
+type NetworkDrift struct {
+	Iface string    `json:"iface"`
+	At    time.Time `json:"at"`
+	// The number of rules of interface, which is the desired state.
+	Rules int `json:"rules"`
+	// The reason of drift, for example, the state differs or the interface is not found.
+	Reason string `json:"reason"`
+	// The differences of the kernel objects, between the ones recorded when the rules are applied and the actual.
+	Diffs []*HostDiff `json:"diffs,omitempty"`
+	// Whether the rules are reapplied, and the error if failed.
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (v *NetworkDrift) String() string {
+	return fmt.Sprintf("iface=%v, rules=%v, reason=%v, repaired=%v, error=%v",
+		v.Iface, v.Rules, v.Reason, v.Repaired, v.Error,
+	)
+}
+
+// Reconcile compares the actual state of the interfaces with rules against the desired state, and reapplies the
+// rules of the drifted interfaces if repair.
+func (v *ruleManager) Reconcile(ctx context.Context, repair bool) []*NetworkDrift {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	drifts := []*NetworkDrift{}
+	if isDarwin {
+		return drifts
+	}
+
+	var ifaces []string
+	visited := make(map[string]bool)
+	for _, rule := range v.rules {
+		if !visited[rule.opts.iface] {
+			visited[rule.opts.iface] = true
+			ifaces = append(ifaces, rule.opts.iface)
+		}
+	}
+
+	for _, iface := range ifaces {
+		expected, ok := v.states[iface]
+		drift := &NetworkDrift{Iface: iface, At: time.Now(), Rules: len(v.rulesOf(iface))}
+		if actual, err := v.capture(iface); err != nil {
+			drift.Reason = fmt.Sprintf("capture failed, %v", err)
+		} else if !ok {
+			drift.Reason = "no state recorded"
+		} else if drift.Diffs = diffHostStates(expected, actual); len(drift.Diffs) > 0 {
+			drift.Reason = "state differs"
+		} else {
+			continue
+		}
+
+		if repair {
+			if err := v.rollback(ctx, iface, v.rulesOf(iface)); err != nil {
+				drift.Error = err.Error()
+			} else {
+				drift.Repaired = true
+				v.observe(ctx, iface)
+			}
+		}
+
+		logger.Wf(ctx, "Drift %v", drift)
+		drifts = append(drifts, drift)
+	}
+
+	if len(drifts) > 0 && repair {
+		v.saveRules(ctx)
+	}
+	return drifts
+}
+
+const (
+	// Reapply the rules if drifted.
+	reconcileRepair = "repair"
+	// Only report the drift.
+	reconcileReport = "report"
+	// Disable the reconciler.
+	reconcileOff = "off"
+)
+
+// networkReconciler checks the drift of rules every interval, which is configured by env TC_RECONCILE and
+// TC_RECONCILE_INTERVAL.
+type networkReconciler struct {
+	// The mode, repair, report or off.
+	Mode string `json:"mode"`
+	// The interval in seconds.
+	Interval int `json:"interval"`
+	// The number of rounds, and the time of last round.
+	Rounds uint64    `json:"rounds"`
+	LastAt time.Time `json:"lastAt"`
+	// The total number of drifts detected and repaired.
+	Detected uint64 `json:"detected"`
+	Repaired uint64 `json:"repaired"`
+	// The drifts of last round.
+	Drifts []*NetworkDrift `json:"drifts"`
+
+	lock sync.Mutex
+}
+
+var reconciler = &networkReconciler{Drifts: []*NetworkDrift{}}
+
+// Initialize parses the env, and reapplies the rules loaded if drifted, whatever the mode, because the mode is only
+// for the periodic loop.
+func (v *networkReconciler) Initialize(ctx context.Context) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	switch v.Mode = os.Getenv("TC_RECONCILE"); v.Mode {
+	case reconcileRepair, reconcileReport, reconcileOff:
+	default:
+		return errors.Errorf("invalid TC_RECONCILE=%v", v.Mode)
+	}
+
+	if interval, err := strconv.Atoi(os.Getenv("TC_RECONCILE_INTERVAL")); err != nil || interval <= 0 {
+		return errors.Errorf("invalid TC_RECONCILE_INTERVAL=%v", os.Getenv("TC_RECONCILE_INTERVAL"))
+	} else {
+		v.Interval = interval
+	}
+
+	v.update(rules.Reconcile(ctx, true))
+	logger.Tf(ctx, "Reconcile mode=%v, interval=%vs, drifts=%v", v.Mode, v.Interval, len(v.Drifts))
+	return nil
+}
+
+// Run checks the drift every interval, until the context is done.
+func (v *networkReconciler) Run(ctx context.Context) {
+	if v.Mode == reconcileOff {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(v.Interval) * time.Second):
+			v.Reconcile(ctx)
+		}
+	}
+}
+
+// Reconcile checks the drift once, and repairs it if the mode is repair.
+func (v *networkReconciler) Reconcile(ctx context.Context) []*NetworkDrift {
+	drifts := rules.Reconcile(ctx, v.Mode == reconcileRepair)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.update(drifts)
+	return drifts
+}
+
+// update counts the drifts of a round, the caller should hold the lock.
+func (v *networkReconciler) update(drifts []*NetworkDrift) {
+	v.Rounds++
+	v.LastAt, v.Drifts = time.Now(), drifts
+	for _, drift := range drifts {
+		v.Detected++
+		if drift.Repaired {
+			v.Repaired++
+		}
+	}
+}
+
+// TcReconcile responses the status of reconciler, or checks the drift now if run=true, for example:
+//
+//	/tc/api/v1/config/reconcile?run=true
+func TcReconcile(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Query().Get("run") == "true" {
+		drifts := reconciler.Reconcile(ctx)
+		logger.Tf(ctx, "Reconcile by API, mode=%v, drifts=%v", reconciler.Mode, len(drifts))
+	}
+
+	reconciler.lock.Lock()
+	defer reconciler.lock.Unlock()
+	ohttp.WriteData(ctx, w, r, reconciler)
+	return nil
+}
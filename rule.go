@@ -0,0 +1,663 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NetworkRule is a rule of network condition, which coexists with other rules of the same interface, for
+// example, 300ms delay for one client and 10% loss for another.
+type NetworkRule struct {
+	// The ID assigned by server.
+	ID string `json:"id"`
+	// The slot in the HTB tree of the direction, see buildTcPlan.
+	Slot uint16 `json:"slot"`
+	// The request of rule, with the filter and strategies.
+	Request *NetworkRequest `json:"request"`
+	// The time when the rule is created.
+	CreatedAt time.Time `json:"createdAt"`
+	// The ID of link profile, if the rule is a direction of link.
+	Link string `json:"link,omitempty"`
+	// The ID of job which owns the rule, for example, a scenario. The rule is dropped on startup, because the job is
+	// gone and nobody removes it.
+	Job string `json:"job,omitempty"`
+	// The strategies to restore on startup, if the rule is changed temporarily by a job, for example, the blackhole
+	// of outage, because the job is gone and nobody restores it.
+	Restore []*NetworkStrategy `json:"restore,omitempty"`
+
+	// The options parsed from request.
+	opts *NetworkOptions
+}
+
+func (v *NetworkRule) String() string {
+	return fmt.Sprintf("id=%v, slot=%v, iface=%v, direction=%v, protocol=%v, identify=%v/%v, strategies=%v",
+		v.ID, v.Slot, v.opts.iface, v.opts.direction, v.opts.protocol, v.opts.identifyKey, v.opts.identifyValue,
+		v.opts.strategies,
+	)
+}
+
+// ruleManager manages the rules of all interfaces, and applies them by the shaper.
+type ruleManager struct {
+	// The rules in the order of creation.
+	rules []*NetworkRule
+	// The last number of ID.
+	lastID uint64
+	// The last number of link ID.
+	lastLinkID uint64
+	// The pending expiries, and the timers to revert them.
+	expiries []*NetworkExpiry
+	timers   map[string]*time.Timer
+	// The kernel objects of interfaces captured after the rules are applied, to detect the drift.
+	states map[string][]*HostInterface
+	lock   sync.Mutex
+}
+
+var rules = &ruleManager{}
+
+// Setup overwrites the rules of the direction by a new rule, which is the behavior of setup. If it fails, the
+// interface is restored to the snapshot before setup.
+func (v *ruleManager) Setup(ctx context.Context, req *NetworkRequest) (*NetworkRule, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if err := validateDuration(req.Duration); err != nil {
+		return nil, err
+	}
+
+	opts := req.Options()
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if err := v.transact(ctx, []string{opts.iface}, func() error {
+		return opts.Execute(ctx)
+	}); err != nil {
+		return nil, err
+	}
+
+	var others, previous []*NetworkRule
+	for _, rule := range v.rules {
+		if rule.opts.iface != opts.iface || rule.opts.direction != opts.direction {
+			others = append(others, rule)
+		} else {
+			previous = append(previous, rule)
+		}
+	}
+	v.rules = others
+	v.cleanExpiries(ctx)
+
+	rule := v.save(ctx, &NetworkRule{Slot: tcRuleMinor, Request: req, opts: opts})
+	v.expire(ctx, rule.ID, req.Duration, []*NetworkRule{rule}, previous)
+	v.commit(ctx, opts.iface)
+	return rule, nil
+}
+
+// Link overwrites the rules of both directions by a link profile. If any direction fails, the interface is
+// rolled back to the previous rules.
+func (v *ruleManager) Link(ctx context.Context, req *NetworkLinkRequest) (*NetworkLink, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if err := validateDuration(req.Duration); err != nil {
+		return nil, err
+	}
+
+	uplink, downlink := req.Requests()
+	upOpts, downOpts := uplink.Options(), downlink.Options()
+	if err := upOpts.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "uplink")
+	}
+	if err := downOpts.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "downlink")
+	}
+
+	previous := v.rulesOf(req.Iface)
+	if err := v.transact(ctx, []string{req.Iface}, func() error {
+		for _, opts := range []*NetworkOptions{upOpts, downOpts} {
+			if err := opts.Execute(ctx); err != nil {
+				return errors.Wrapf(err, "setup %v", opts.direction)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var others []*NetworkRule
+	for _, rule := range v.rules {
+		if rule.opts.iface != req.Iface {
+			others = append(others, rule)
+		}
+	}
+	v.rules = others
+	v.cleanExpiries(ctx)
+
+	v.lastLinkID++
+	link := &NetworkLink{ID: fmt.Sprintf("link-%v", v.lastLinkID), Iface: req.Iface}
+	link.Uplink = v.save(ctx, &NetworkRule{Slot: tcRuleMinor, Request: uplink, Link: link.ID, opts: upOpts})
+	link.Downlink = v.save(ctx, &NetworkRule{Slot: tcRuleMinor, Request: downlink, Link: link.ID, opts: downOpts})
+	v.expire(ctx, link.ID, req.Duration, []*NetworkRule{link.Uplink, link.Downlink}, previous)
+	v.commit(ctx, req.Iface)
+	return link, nil
+}
+
+// rollback restores the interface to the previous rules, by resetting it and adding the rules in their slots.
+func (v *ruleManager) rollback(ctx context.Context, iface string, previous []*NetworkRule) error {
+	if isDarwin {
+		return nil
+	}
+
+	if err := shaper.Reset(ctx, iface); err != nil {
+		return errors.Wrapf(err, "reset %v by %v", iface, shaper.Name())
+	}
+	for _, rule := range previous {
+		if err := shaper.AddRule(ctx, rule); err != nil {
+			return errors.Wrapf(err, "restore rule %v by %v", rule.ID, shaper.Name())
+		}
+	}
+
+	logger.Tf(ctx, "Rollback iface=%v to %v rules", iface, len(previous))
+	return nil
+}
+
+// Import overwrites the rules of the interfaces by the requests, for example, the setting of tcconfig. If any
+// rule fails, all the interfaces are rolled back to the previous rules.
+func (v *ruleManager) Import(ctx context.Context, reqs []*NetworkRequest) ([]*NetworkRule, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var ifaces []string
+	previous := make(map[string][]*NetworkRule)
+	var imported []*NetworkRule
+	for _, req := range reqs {
+		opts := req.Options()
+		if err := opts.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "iface=%v, direction=%v", req.Iface, req.Direction)
+		}
+
+		if _, ok := previous[req.Iface]; !ok {
+			previous[req.Iface] = v.rulesOf(req.Iface)
+			ifaces = append(ifaces, req.Iface)
+		}
+
+		slot, err := freeSlot(imported, opts, tcRuleMinor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "iface=%v, direction=%v", req.Iface, req.Direction)
+		}
+		imported = append(imported, &NetworkRule{Slot: slot, Request: req, opts: opts})
+	}
+
+	if err := v.transact(ctx, ifaces, func() error {
+		for _, iface := range ifaces {
+			if err := shaper.Reset(ctx, iface); err != nil {
+				return errors.Wrapf(err, "reset %v by %v", iface, shaper.Name())
+			}
+		}
+		for _, rule := range imported {
+			if err := shaper.AddRule(ctx, rule); err != nil {
+				return errors.Wrapf(err, "add rule by %v", shaper.Name())
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "import")
+	}
+
+	var others []*NetworkRule
+	for _, rule := range v.rules {
+		if _, ok := previous[rule.opts.iface]; !ok {
+			others = append(others, rule)
+		}
+	}
+	v.rules = others
+	v.cleanExpiries(ctx)
+
+	for _, rule := range imported {
+		v.save(ctx, rule)
+	}
+	v.commit(ctx, ifaces...)
+	return imported, nil
+}
+
+// rulesOf returns the rules of the interface, the caller should hold the lock.
+func (v *ruleManager) rulesOf(iface string) []*NetworkRule {
+	matched := []*NetworkRule{}
+	for _, rule := range v.rules {
+		if rule.opts.iface == iface {
+			matched = append(matched, rule)
+		}
+	}
+	return matched
+}
+
+// Add adds a new rule, besides the existing rules of the interface.
+func (v *ruleManager) Add(ctx context.Context, req *NetworkRequest) (*NetworkRule, error) {
+	return v.add(ctx, req, "")
+}
+
+// AddByJob adds a new rule owned by the job, which is dropped on startup.
+func (v *ruleManager) AddByJob(ctx context.Context, job string, req *NetworkRequest) (*NetworkRule, error) {
+	return v.add(ctx, req, job)
+}
+
+func (v *ruleManager) add(ctx context.Context, req *NetworkRequest, job string) (*NetworkRule, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if err := validateDuration(req.Duration); err != nil {
+		return nil, err
+	}
+
+	opts := req.Options()
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	slot, err := freeSlot(v.rules, opts, tcRuleMinor)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := &NetworkRule{Slot: slot, Request: req, Job: job, opts: opts}
+	if err := v.transact(ctx, []string{opts.iface}, func() error {
+		if err := shaper.AddRule(ctx, rule); err != nil {
+			return errors.Wrapf(err, "add rule by %v", shaper.Name())
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	rule = v.save(ctx, rule)
+	v.expire(ctx, rule.ID, req.Duration, []*NetworkRule{rule}, nil)
+	v.commit(ctx, opts.iface)
+	return rule, nil
+}
+
+// freeSlot allocates the slot for the rule in the direction, the preferred slot if it's free, or the first free
+// one. The rule with a filter overlapping an existing one is rejected, because only the first one takes effect.
+func freeSlot(rules []*NetworkRule, opts *NetworkOptions, prefer uint16) (uint16, error) {
+	slots := make(map[uint16]bool)
+	for _, rule := range rules {
+		if rule.opts.iface != opts.iface || rule.opts.direction != opts.direction {
+			continue
+		}
+		if filterOverlaps(rule.opts, opts) {
+			return 0, errors.Errorf("conflict with rule %v", rule.ID)
+		}
+		slots[rule.Slot] = true
+	}
+
+	if prefer >= tcRuleMinor && prefer <= tcRuleMaxMinor && !slots[prefer] {
+		return prefer, nil
+	}
+
+	slot := uint16(tcRuleMinor)
+	for slots[slot] {
+		slot++
+	}
+	if slot > tcRuleMaxMinor {
+		return 0, errors.Errorf("too many rules of iface=%v, direction=%v", opts.iface, opts.direction)
+	}
+	return slot, nil
+}
+
+// filterOverlaps returns whether the filters of options match some same traffic, by the same IP protocol, where ip
+// is all, and the same key with overlapping values, for example, clientIp 10.0.0.5 and 10.0.0.0/24, or serverPort
+// 8000 and 8000-8001. The values are compared as strings if failed to parse.
+func filterOverlaps(a, b *NetworkOptions) bool {
+	if tcIPProtocolOf(a.protocol) != tcIPProtocolOf(b.protocol) || a.identifyKey != b.identifyKey {
+		return false
+	}
+
+	switch a.identifyKey {
+	case "all":
+		return true
+	case "clientIp":
+		x, err := parseClientIPs(a.identifyValue)
+		if err != nil {
+			break
+		}
+		y, err := parseClientIPs(b.identifyValue)
+		if err != nil {
+			break
+		}
+		for _, i := range x {
+			for _, j := range y {
+				if i.Contains(j.IP) || j.Contains(i.IP) {
+					return true
+				}
+			}
+		}
+		return false
+	case "serverPort", "clientPort":
+		x, err := parsePortRanges(a.identifyValue)
+		if err != nil {
+			break
+		}
+		y, err := parsePortRanges(b.identifyValue)
+		if err != nil {
+			break
+		}
+		for _, i := range x {
+			for _, j := range y {
+				if i.from <= j.to && j.from <= i.to {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return a.identifyValue == b.identifyValue
+}
+
+// save assigns the ID and saves the rule, which is already applied.
+func (v *ruleManager) save(ctx context.Context, rule *NetworkRule) *NetworkRule {
+	v.lastID++
+	rule.ID, rule.CreatedAt = fmt.Sprintf("rule-%v", v.lastID), time.Now()
+	v.rules = append(v.rules, rule)
+
+	logger.Tf(ctx, "Create rule %v", rule)
+	return rule
+}
+
+// Update changes the strategies of the rule in place, without touching its filter and slot, so the queue is not
+// flushed as setup does.
+func (v *ruleManager) Update(ctx context.Context, id string, strategies []*NetworkStrategy) (*NetworkRule, error) {
+	return v.update(ctx, id, strategies, nil)
+}
+
+// UpdateTemporarily changes the strategies of the rule like Update, and persists the strategies to restore on
+// startup, for example, the strategies before the blackhole of outage.
+func (v *ruleManager) UpdateTemporarily(
+	ctx context.Context, id string, strategies, restore []*NetworkStrategy,
+) (*NetworkRule, error) {
+	return v.update(ctx, id, strategies, restore)
+}
+
+func (v *ruleManager) update(
+	ctx context.Context, id string, strategies, restore []*NetworkStrategy,
+) (*NetworkRule, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	rule := v.getRule(id)
+	if rule == nil {
+		return nil, errors.Errorf("no rule %v", id)
+	}
+
+	req := *rule.Request
+	req.Strategies = strategies
+	opts := req.Options()
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	updated := *rule
+	updated.Request, updated.opts = &req, opts
+	if err := v.transact(ctx, []string{opts.iface}, func() error {
+		if err := shaper.UpdateRule(ctx, &updated); err != nil {
+			return errors.Wrapf(err, "update rule %v by %v", id, shaper.Name())
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	rule.Request, rule.opts, rule.Restore = updated.Request, updated.opts, restore
+	// The transitions of the rule owned by job are not persisted, because it's dropped on startup.
+	if rule.Job != "" {
+		v.observe(ctx, opts.iface)
+	} else {
+		v.commit(ctx, opts.iface)
+	}
+	logger.Tf(ctx, "Update rule %v", rule)
+	return rule, nil
+}
+
+// Delete removes the rule by ID, without touching other rules of the interface.
+func (v *ruleManager) Delete(ctx context.Context, id string) (*NetworkRule, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for i, rule := range v.rules {
+		if rule.ID != id {
+			continue
+		}
+
+		if err := v.transact(ctx, []string{rule.opts.iface}, func() error {
+			if err := shaper.DeleteRule(ctx, rule); err != nil {
+				return errors.Wrapf(err, "delete rule %v by %v", id, shaper.Name())
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+
+		v.rules = append(v.rules[:i], v.rules[i+1:]...)
+		v.cleanExpiries(ctx)
+		v.commit(ctx, rule.opts.iface)
+		logger.Tf(ctx, "Delete rule %v", rule)
+		return rule, nil
+	}
+
+	return nil, errors.Errorf("no rule %v", id)
+}
+
+// NetworkScope is the scope of rules to remove from an interface, the empty fields match any rule.
+type NetworkScope struct {
+	ID        string `json:"id,omitempty"`
+	Direction string `json:"direction,omitempty"`
+	// The filter of rule, for example, clientIp and 10.0.0.5, which matches the rule with the same filter only,
+	// not the rule of a list or CIDR which contains it.
+	IdentifyKey   string `json:"identifyKey,omitempty"`
+	IdentifyValue string `json:"identifyValue,omitempty"`
+}
+
+func (v *NetworkScope) String() string {
+	return fmt.Sprintf("id=%v, direction=%v, identify=%v/%v", v.ID, v.Direction, v.IdentifyKey, v.IdentifyValue)
+}
+
+// Empty whether the scope matches all rules.
+func (v *NetworkScope) Empty() bool {
+	return v.ID == "" && v.Direction == "" && v.IdentifyKey == "" && v.IdentifyValue == ""
+}
+
+// Match whether the rule is in the scope.
+func (v *NetworkScope) Match(rule *NetworkRule) bool {
+	if v.ID != "" && v.ID != rule.ID {
+		return false
+	}
+	if v.Direction != "" && v.Direction != rule.opts.direction {
+		return false
+	}
+	if v.IdentifyKey != "" && v.IdentifyKey != rule.opts.identifyKey {
+		return false
+	}
+	if v.IdentifyValue != "" && strings.ReplaceAll(v.IdentifyValue, " ", "") != strings.ReplaceAll(rule.opts.identifyValue, " ", "") {
+		return false
+	}
+	return true
+}
+
+// Remove removes the rules of the interface in the scope, without touching other rules of the interface. If any
+// rule fails, the interface is restored to the snapshot before remove.
+func (v *ruleManager) Remove(ctx context.Context, iface string, scope *NetworkScope) ([]*NetworkRule, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var removed, others []*NetworkRule
+	for _, rule := range v.rules {
+		if rule.opts.iface == iface && scope.Match(rule) {
+			removed = append(removed, rule)
+		} else {
+			others = append(others, rule)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, errors.Errorf("no rule of %v in scope %v", iface, scope)
+	}
+
+	if err := v.transact(ctx, []string{iface}, func() error {
+		for _, rule := range removed {
+			if err := shaper.DeleteRule(ctx, rule); err != nil {
+				return errors.Wrapf(err, "delete rule %v by %v", rule.ID, shaper.Name())
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	v.rules = others
+	v.cleanExpiries(ctx)
+	v.commit(ctx, iface)
+	logger.Tf(ctx, "Remove %v rules of %v in scope %v", len(removed), iface, scope)
+	return removed, nil
+}
+
+// Reset removes all the rules of the interface.
+func (v *ruleManager) Reset(ctx context.Context, iface string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !isDarwin {
+		if err := shaper.Reset(ctx, iface); err != nil {
+			return errors.Wrapf(err, "reset %v by %v", iface, shaper.Name())
+		}
+	}
+
+	var others []*NetworkRule
+	for _, rule := range v.rules {
+		if rule.opts.iface != iface {
+			others = append(others, rule)
+		}
+	}
+	v.rules = others
+	v.cleanExpiries(ctx)
+	v.commit(ctx, iface)
+	return nil
+}
+
+// List returns the rules of the interface, or all rules if iface is empty.
+func (v *ruleManager) List(iface string) []*NetworkRule {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if iface != "" {
+		return v.rulesOf(iface)
+	}
+	return append([]*NetworkRule{}, v.rules...)
+}
+
+// Links returns the link profiles of the interface, with the rules of both directions.
+func (v *ruleManager) Links(iface string) []*NetworkLink {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	links := []*NetworkLink{}
+	indexes := make(map[string]*NetworkLink)
+	for _, rule := range v.rulesOf(iface) {
+		if rule.Link == "" {
+			continue
+		}
+
+		link, ok := indexes[rule.Link]
+		if !ok {
+			link = &NetworkLink{ID: rule.Link, Iface: iface}
+			indexes[rule.Link] = link
+			links = append(links, link)
+		}
+
+		if rule.opts.direction == "incoming" {
+			link.Uplink = rule
+		} else {
+			link.Downlink = rule
+		}
+	}
+	return links
+}
+
+// Get returns the rule by ID, or nil if not exists.
+func (v *ruleManager) Get(id string) *NetworkRule {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.getRule(id)
+}
+
+// getRule returns the rule by ID, or nil if not exists. The caller should hold the lock.
+func (v *ruleManager) getRule(id string) *NetworkRule {
+	for _, rule := range v.rules {
+		if rule.ID == id {
+			return rule
+		}
+	}
+	return nil
+}
+
+// TcRuleAdd adds a rule by the JSON body, which is the same as apply, but keeps the existing rules.
+func TcRuleAdd(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	req, err := readNetworkRequest(r)
+	if err != nil {
+		return err
+	}
+	if err := expandProfile(req); err != nil {
+		return err
+	}
+
+	rule, err := rules.Add(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	ohttp.WriteData(ctx, w, r, rule)
+	return nil
+}
+
+func TcRuleList(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	iface := r.URL.Query().Get("iface")
+
+	ohttp.WriteData(ctx, w, r, &struct {
+		Rules []*NetworkRule `json:"rules"`
+	}{
+		Rules: rules.List(iface),
+	})
+	return nil
+}
+
+func TcRuleGet(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		return errors.New("no id")
+	}
+
+	rule := rules.Get(id)
+	if rule == nil {
+		return errors.Errorf("no rule %v", id)
+	}
+
+	ohttp.WriteData(ctx, w, r, rule)
+	return nil
+}
+
+func TcRuleDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		return errors.New("no id")
+	}
+
+	rule, err := rules.Delete(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	ohttp.WriteData(ctx, w, r, rule)
+	return nil
+}
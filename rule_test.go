@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFilterOverlaps(t *testing.T) {
+	opts := func(protocol, key, value string) *NetworkOptions {
+		return &NetworkOptions{protocol: protocol, identifyKey: key, identifyValue: value}
+	}
+
+	for _, c := range []struct {
+		name     string
+		a, b     *NetworkOptions
+		overlaps bool
+	}{
+		{"all", opts("all", "all", ""), opts("all", "all", ""), true},
+		{"ip is all", opts("ip", "all", ""), opts("all", "all", ""), true},
+		{"protocols", opts("udp", "all", ""), opts("tcp", "all", ""), false},
+		{"keys", opts("all", "serverPort", "8000"), opts("all", "clientPort", "8000"), false},
+		{"same ip", opts("all", "clientIp", "10.0.0.5"), opts("all", "clientIp", "10.0.0.5"), true},
+		{"ip and cidr", opts("all", "clientIp", "10.0.0.5"), opts("all", "clientIp", "10.0.0.5/32"), true},
+		{"ip in cidr", opts("all", "clientIp", "10.0.0.5"), opts("all", "clientIp", "10.0.0.0/24"), true},
+		{"ip in list", opts("all", "clientIp", "10.0.0.5,10.0.1.5"), opts("all", "clientIp", "10.0.1.0/24"), true},
+		{"ips", opts("all", "clientIp", "10.0.0.5"), opts("all", "clientIp", "10.0.0.6"), false},
+		{"families", opts("all", "clientIp", "10.0.0.5"), opts("all", "clientIp", "::/0"), false},
+		{"ipv6", opts("all", "clientIp", "2001:db8::1"), opts("all", "clientIp", "2001:db8::/32"), true},
+		{"same port", opts("udp", "serverPort", "8000"), opts("udp", "serverPort", "8000"), true},
+		{"port in range", opts("udp", "serverPort", "8000"), opts("udp", "serverPort", "8000-8001"), true},
+		{"ranges", opts("udp", "serverPort", "8000-8010"), opts("udp", "serverPort", "8010-8020"), true},
+		{"ports", opts("udp", "serverPort", "8000,9000"), opts("udp", "serverPort", "8001-8999"), false},
+		{"invalid", opts("udp", "serverPort", "x"), opts("udp", "serverPort", "x"), true},
+	} {
+		if overlaps := filterOverlaps(c.a, c.b); overlaps != c.overlaps {
+			t.Errorf("%v: expect %v, actual %v", c.name, c.overlaps, overlaps)
+		}
+		if overlaps := filterOverlaps(c.b, c.a); overlaps != c.overlaps {
+			t.Errorf("%v reversed: expect %v, actual %v", c.name, c.overlaps, overlaps)
+		}
+	}
+}
+
+func TestFreeSlot(t *testing.T) {
+	rule := func(direction, value string, slot uint16) *NetworkRule {
+		return &NetworkRule{ID: value, Slot: slot, opts: &NetworkOptions{
+			iface: "eth0", protocol: "udp", direction: direction, identifyKey: "serverPort", identifyValue: value,
+		}}
+	}
+	rules := []*NetworkRule{rule("outgoing", "8000", tcRuleMinor), rule("outgoing", "9000", tcRuleMinor+2)}
+
+	for _, c := range []struct {
+		name   string
+		rule   *NetworkRule
+		prefer uint16
+		slot   uint16
+		ok     bool
+	}{
+		{"first free", rule("outgoing", "10000", 0), tcRuleMinor, tcRuleMinor + 1, true},
+		{"prefer", rule("outgoing", "10000", 0), tcRuleMinor + 3, tcRuleMinor + 3, true},
+		{"other direction", rule("incoming", "8000", 0), tcRuleMinor, tcRuleMinor, true},
+		{"conflict", rule("outgoing", "8000-8001", 0), tcRuleMinor, 0, false},
+	} {
+		slot, err := freeSlot(rules, c.rule.opts, c.prefer)
+		if (err == nil) != c.ok {
+			t.Errorf("%v: expect ok=%v, actual err %v", c.name, c.ok, err)
+		} else if slot != c.slot {
+			t.Errorf("%v: expect %v, actual %v", c.name, c.slot, slot)
+		}
+	}
+}
+
+func TestNetworkScopeMatch(t *testing.T) {
+	rule := &NetworkRule{ID: "rule-1", opts: &NetworkOptions{
+		iface: "eth0", protocol: "udp", direction: "incoming", identifyKey: "clientIp", identifyValue: "10.0.0.5, 10.0.0.6",
+	}}
+
+	for _, c := range []struct {
+		name  string
+		scope *NetworkScope
+		match bool
+	}{
+		{"empty", &NetworkScope{}, true},
+		{"id", &NetworkScope{ID: "rule-1"}, true},
+		{"other id", &NetworkScope{ID: "rule-2"}, false},
+		{"direction", &NetworkScope{Direction: "incoming"}, true},
+		{"other direction", &NetworkScope{Direction: "outgoing"}, false},
+		{"key", &NetworkScope{IdentifyKey: "clientIp"}, true},
+		{"other key", &NetworkScope{IdentifyKey: "serverPort"}, false},
+		{"filter", &NetworkScope{IdentifyKey: "clientIp", IdentifyValue: "10.0.0.5,10.0.0.6"}, true},
+		{"filter with spaces", &NetworkScope{IdentifyValue: " 10.0.0.5 ,10.0.0.6"}, true},
+		{"filter in list", &NetworkScope{IdentifyKey: "clientIp", IdentifyValue: "10.0.0.5"}, false},
+		{"all fields", &NetworkScope{ID: "rule-1", Direction: "incoming", IdentifyKey: "clientIp",
+			IdentifyValue: "10.0.0.5,10.0.0.6"}, true,
+		},
+		{"one field differs", &NetworkScope{ID: "rule-1", Direction: "outgoing", IdentifyKey: "clientIp"}, false},
+	} {
+		if match := c.scope.Match(rule); match != c.match {
+			t.Errorf("%v: expect %v, actual %v", c.name, c.match, match)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The interval to push the updates of streaming scan.
+const scanStreamInterval = time.Second
+
+// TcpdumpEndpointUpdate is the update of an endpoint in the last interval of streaming scan.
+type TcpdumpEndpointUpdate struct {
+	// The name of interface.
+	Iface string `json:"iface"`
+	// The endpoint with the total packets and bytes since the scan starts.
+	TcpdumpEndpoint
+	// The packets and bytes in the last interval.
+	DeltaPackets uint64 `json:"deltaPackets"`
+	DeltaBytes   uint64 `json:"deltaBytes"`
+	// The rates in the last interval, in packets per second and kbps.
+	PPS  float64 `json:"pps"`
+	Kbps float64 `json:"kbps"`
+}
+
+// TcpdumpScanUpdate is the event of streaming scan, with the endpoints which have packets in the last interval,
+// the top talkers first.
+type TcpdumpScanUpdate struct {
+	At TcTime `json:"at"`
+	// The seconds since the scan starts.
+	Elapsed float64 `json:"elapsed"`
+	// The endpoints updated, others have no packets in the last interval.
+	Endpoints []*TcpdumpEndpointUpdate `json:"endpoints"`
+}
+
+// tcpdumpStream builds the updates of streaming scan, by the difference of summary in each interval.
+type tcpdumpStream struct {
+	// The summary of scan, and the lock for it.
+	summary *TcpdumpSummary
+	lock    sync.Mutex
+	// The time when the scan and the last interval starts.
+	start, last time.Time
+	// The endpoint at the last interval, key is the interface and endpoint.
+	previous map[string]TcpdumpEndpoint
+}
+
+func newTcpdumpStream() *tcpdumpStream {
+	now := time.Now()
+	return &tcpdumpStream{
+		summary: NewTcpdumpSummary(), start: now, last: now, previous: make(map[string]TcpdumpEndpoint),
+	}
+}
+
+// OnPacket merges the packet to summary, which is called by the tcpdumps concurrently.
+func (v *tcpdumpStream) OnPacket(l *TcpdumpLog) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.summary.OnPacket(l)
+}
+
+// Update returns the endpoints which have packets since the last interval.
+func (v *tcpdumpStream) Update() *TcpdumpScanUpdate {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(v.last).Seconds()
+	update := &TcpdumpScanUpdate{
+		At: TcTime(now), Elapsed: now.Sub(v.start).Seconds(), Endpoints: []*TcpdumpEndpointUpdate{},
+	}
+	v.last = now
+
+	for name, iface := range v.summary.Interfaces {
+		for _, ep := range iface.Endpoints {
+			key := fmt.Sprintf("%v, %v", name, ep.Endpoint())
+			previous := v.previous[key]
+			if ep.Packets == previous.Packets {
+				continue
+			}
+			v.previous[key] = *ep
+
+			eu := &TcpdumpEndpointUpdate{
+				Iface: name, TcpdumpEndpoint: *ep,
+				DeltaPackets: ep.Packets - previous.Packets, DeltaBytes: ep.Bytes - previous.Bytes,
+			}
+			if elapsed > 0 {
+				eu.PPS = float64(eu.DeltaPackets) / elapsed
+				eu.Kbps = float64(eu.DeltaBytes) * 8 / 1000 / elapsed
+			}
+			update.Endpoints = append(update.Endpoints, eu)
+		}
+	}
+
+	sort.Slice(update.Endpoints, func(i, j int) bool {
+		return update.Endpoints[i].DeltaBytes > update.Endpoints[j].DeltaBytes
+	})
+	return update
+}
+
+// Summary returns the summary of scan, with the endpoints sorted.
+func (v *tcpdumpStream) Summary() *TcpdumpSummary {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.summary.Sort()
+	return v.summary
+}
+
+// writeScanEvent writes the event of Server-Sent Events, with the data in JSON.
+func writeScanEvent(w http.ResponseWriter, event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrapf(err, "marshal %v", event)
+	}
+
+	if _, err := fmt.Fprintf(w, "event: %v\ndata: %v\n\n", event, string(b)); err != nil {
+		return errors.Wrapf(err, "write %v", event)
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// TcScanStream scans like ScanByTcpdump, but streams the results by Server-Sent Events, for example:
+//
+//	/tc/api/v1/scan/stream?ifaces=eth0,lo&timeout=60
+//
+// There is an update event every second, with the endpoints which have packets in the last second. When the scan
+// is done, there is a done event with the summary, or an error event. Close the connection to stop it early.
+func TcScanStream(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	scan, err := parseTcpdumpScan(r)
+	if err != nil {
+		return err
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		return errors.New("streaming not supported")
+	}
+
+	ctx, cancel := context.WithCancel(logger.WithContext(r.Context()))
+	defer cancel()
+	logger.Tf(ctx, "Scan stream start, %v", scan)
+
+	ohttp.SetHeader(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	stream := newTcpdumpStream()
+	done := make(chan error, 1)
+	go func() {
+		done <- scan.Run(ctx, stream.OnPacket)
+	}()
+
+	ticker := time.NewTicker(scanStreamInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := writeScanEvent(w, "update", stream.Update()); err != nil {
+				logger.Wf(ctx, "Scan stream canceled, err %v", err)
+				cancel()
+			}
+		case err := <-done:
+			// The tcpdump is killed when the client is gone, so the error is expected.
+			if ctx.Err() != nil {
+				logger.Tf(ctx, "Scan stream stopped by client")
+				return nil
+			}
+
+			if err != nil {
+				logger.Wf(ctx, "Scan stream failed, err %+v", err)
+				writeScanEvent(w, "error", &struct {
+					Error string `json:"error"`
+				}{
+					Error: err.Error(),
+				})
+				return nil
+			}
+
+			writeScanEvent(w, "update", stream.Update())
+			summary := stream.Summary()
+			writeScanEvent(w, "done", summary)
+			logger.Tf(ctx, "Scan stream ok, ifaces=%v, %v", scan.captures, summary.String())
+			return nil
+		}
+	}
+}
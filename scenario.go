@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// ScenarioStep is a step of scenario, which applies the strategies for the duration.
+type ScenarioStep struct {
+	// The duration in seconds of step.
+	Duration int `json:"duration"`
+	// The strategies of step, or empty for clean network, which deletes the rule of scenario.
+	Strategies []*NetworkStrategy `json:"strategies,omitempty"`
+
+	// The duration of step from trace, in ms.
+	interval time.Duration
+}
+
+// length returns the duration of step.
+func (v *ScenarioStep) length() time.Duration {
+	if v.interval > 0 {
+		return v.interval
+	}
+	return time.Duration(v.Duration) * time.Second
+}
+
+func (v *ScenarioStep) String() string {
+	if len(v.Strategies) == 0 {
+		return fmt.Sprintf("%v clean", v.length())
+	}
+	return fmt.Sprintf("%v %v", v.length(), v.Strategies)
+}
+
+// ScenarioRequest is a timeline of network conditions, which applies the steps one by one, for example, 30s
+// clean, 30s 5% loss, then 30s 400ms delay.
+type ScenarioRequest struct {
+	Iface         string `json:"iface"`
+	Protocol      string `json:"protocol"`
+	Direction     string `json:"direction"`
+	IdentifyKey   string `json:"identifyKey"`
+	IdentifyValue string `json:"identifyValue"`
+	// The api listen port to exclude, default to API_LISTEN.
+	API string `json:"api,omitempty"`
+	// Whether restart from the first step after the last step.
+	Loop bool `json:"loop,omitempty"`
+	// The steps of scenario, at least one.
+	Steps []*ScenarioStep `json:"steps,omitempty"`
+	// The trace to replay, instead of steps.
+	Trace *ScenarioTrace `json:"trace,omitempty"`
+}
+
+// stepRequest converts the step to the request of setup.
+func (v *ScenarioRequest) stepRequest(step *ScenarioStep) *NetworkRequest {
+	return &NetworkRequest{
+		Iface: v.Iface, Protocol: v.Protocol, Direction: v.Direction,
+		IdentifyKey: v.IdentifyKey, IdentifyValue: v.IdentifyValue, API: v.API,
+		Strategies: step.Strategies,
+	}
+}
+
+// Build returns the steps, or the steps of trace, and checks them to make sure the scenario never fails for
+// bad request after started.
+func (v *ScenarioRequest) Build() ([]*ScenarioStep, error) {
+	if v.Iface == "" {
+		return nil, errors.New("no iface")
+	}
+	if len(v.Steps) > 0 && v.Trace != nil {
+		return nil, errors.New("steps and trace are exclusive")
+	}
+
+	steps := v.Steps
+	if v.Trace != nil {
+		var err error
+		if steps, err = v.Trace.Steps(); err != nil {
+			return nil, errors.Wrapf(err, "trace %v", v.Trace)
+		}
+	}
+	if len(steps) == 0 {
+		return nil, errors.New("no steps")
+	}
+
+	for i, step := range steps {
+		if step == nil {
+			return nil, errors.Errorf("no step %v", i)
+		}
+		if step.length() <= 0 {
+			return nil, errors.Errorf("invalid duration=%v of step %v", step.Duration, i)
+		}
+		if len(step.Strategies) == 0 {
+			continue
+		}
+		if err := v.stepRequest(step).Options().Validate(); err != nil {
+			return nil, errors.Wrapf(err, "step %v", i)
+		}
+	}
+	return steps, nil
+}
+
+// Scenario is a running scenario, which owns a rule of the filter, to apply the network of steps.
+type Scenario struct {
+	networkJob
+	Request *ScenarioRequest `json:"request"`
+	// The index of current step, and the round of loop which starts from 0.
+	Step  int `json:"step"`
+	Round int `json:"round"`
+	// The time when current step is started.
+	StepStartedAt time.Time `json:"stepStartedAt"`
+	// The position in ms of current step in the round, and the length in ms of the round.
+	Position int64 `json:"position"`
+	Length   int64 `json:"length"`
+
+	// The steps to apply, from request or trace.
+	steps []*ScenarioStep
+	// The index of next step, and its position in the round.
+	cursor   int
+	position time.Duration
+}
+
+// NewScenario builds the steps of request, to make sure the scenario never fails for bad request after started.
+func NewScenario(req *ScenarioRequest) (*Scenario, error) {
+	steps, err := req.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var length time.Duration
+	for _, step := range steps {
+		length += step.length()
+	}
+
+	return &Scenario{
+		networkJob: networkJob{kind: "scenario", iface: req.Iface, direction: req.Direction},
+		Request:    req, Length: int64(length / time.Millisecond), steps: steps,
+	}, nil
+}
+
+func (v *Scenario) String() string {
+	if v.Request.Trace != nil {
+		return fmt.Sprintf("id=%v, iface=%v, loop=%v, trace=(%v), steps=%v",
+			v.ID, v.Request.Iface, v.Request.Loop, v.Request.Trace, len(v.steps),
+		)
+	}
+	return fmt.Sprintf("id=%v, iface=%v, loop=%v, steps=%v", v.ID, v.Request.Iface, v.Request.Loop, v.steps)
+}
+
+// next moves to the next step, or the first step of next round for loop, and holds it for the duration of step.
+func (v *Scenario) next(at time.Time) (time.Duration, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.cursor == len(v.steps) {
+		if !v.Request.Loop {
+			return 0, false
+		}
+		v.cursor, v.position = 0, 0
+		v.Round++
+	}
+
+	step := v.steps[v.cursor]
+	v.Step, v.StepStartedAt, v.Position = v.cursor, at, int64(v.position/time.Millisecond)
+	v.cursor, v.position = v.cursor+1, v.position+step.length()
+	return step.length(), true
+}
+
+// apply applies the network of current step to the rule of scenario, or deletes the rule for clean step.
+func (v *Scenario) apply(ctx context.Context) error {
+	step := v.steps[v.Step]
+	if err := v.applyRule(ctx, v.Request.stepRequest(step)); err != nil {
+		return errors.Wrapf(err, "step %v", v.Step)
+	}
+
+	logger.Tf(ctx, "Scenario %v round %v step %v, %v", v.ID, v.Round, v.Step, step)
+	return nil
+}
+
+// TcScenarioStart starts a scenario by the JSON body, for example:
+//
+//	{"iface": "lo", "protocol": "udp", "direction": "outgoing", "identifyKey": "serverPort", "identifyValue": "8000",
+//	"loop": false, "steps": [{"duration": 30}, {"duration": 30, "strategies": [{"strategy": "loss", "loss": 5}]}]}
+//
+// Or replay a trace, which changes the rate and delay every interval in ms:
+//
+//	{"iface": "lo", "protocol": "udp", "direction": "outgoing", "identifyKey": "serverPort", "identifyValue": "8000",
+//	"loop": true, "trace": {"format": "csv", "content": "0,1000,50\n1000,500,80\n", "interval": 1000}}
+func TcScenarioStart(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	req := &ScenarioRequest{}
+	defer r.Body.Close()
+	if b, err := ioutil.ReadAll(r.Body); err != nil {
+		return errors.Wrapf(err, "read body")
+	} else if err := json.Unmarshal(b, req); err != nil {
+		return errors.Wrapf(err, "parse body %v", string(b))
+	}
+
+	for _, step := range req.Steps {
+		if step == nil {
+			continue
+		}
+		if err := applyPresets(step.Strategies); err != nil {
+			return err
+		}
+	}
+
+	scenario, err := NewScenario(req)
+	if err != nil {
+		return err
+	}
+	if err := jobs.Start(ctx, scenario); err != nil {
+		return err
+	}
+
+	return writeJob(ctx, w, r, scenario)
+}
+
+// TcScenarioPause pauses the scenario, which keeps the network of current step.
+func TcScenarioPause(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	return transitJob(ctx, w, r, "scenario", jobPaused, jobRunning)
+}
+
+// TcScenarioResume resumes the paused scenario, to run the rest of current step.
+func TcScenarioResume(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	return transitJob(ctx, w, r, "scenario", jobRunning, jobPaused)
+}
+
+// TcScenarioStop stops the scenario, and responses after the rule of scenario is deleted.
+func TcScenarioStop(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	return transitJob(ctx, w, r, "scenario", jobStopped, jobRunning, jobPaused)
+}
+
+// TcScenarioStatus responses the scenario by id, or all scenarios if no id.
+func TcScenarioStatus(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	return statusJob(ctx, w, r, "scenario", "scenarios")
+}
@@ -0,0 +1,769 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Shaper is the backend which applies the network options to the kernel.
+type Shaper interface {
+	// Name returns the name of shaper, for example, tcconfig, tc or netlink.
+	Name() string
+	// Setup applies the network options, overwriting the existing rules of the same direction.
+	Setup(ctx context.Context, opts *NetworkOptions) error
+	// Plan returns the commands which setup runs for the network options in order, without applying them.
+	Plan(ctx context.Context, opts *NetworkOptions) ([]string, error)
+	// AddRule adds the rule, besides the existing rules of the interface.
+	AddRule(ctx context.Context, rule *NetworkRule) error
+	// UpdateRule changes the strategies of the rule in place, without touching its filter.
+	UpdateRule(ctx context.Context, rule *NetworkRule) error
+	// DeleteRule removes the rule, without touching other rules of the interface.
+	DeleteRule(ctx context.Context, rule *NetworkRule) error
+	// Query returns the command to query the interface, and the output of it.
+	Query(ctx context.Context, iface string) (cmd, output string, err error)
+	// Reset removes all the rules of the interface, for both directions.
+	Reset(ctx context.Context, iface string) error
+}
+
+// NewShaper creates the shaper by name, which is configured by env TC_SHAPER.
+func NewShaper(name string) (Shaper, error) {
+	switch name {
+	case "", "tcconfig":
+		return &tcconfigShaper{}, nil
+	case "tc":
+		return &tcShaper{scripts: make(map[string][]*tcScriptSegment)}, nil
+	case "netlink":
+		return &netlinkShaper{}, nil
+	default:
+		return nil, errors.Errorf("invalid shaper %v", name)
+	}
+}
+
+var shaper Shaper
+
+const (
+	// The major of the HTB root qdisc, the same as tcconfig.
+	tcRootMajor = 0x1a1a
+	// The minor of the HTB default class, for the traffic which is not matched by any filter, such as the API.
+	tcDefaultMinor = 1
+	// The slot of the rule by setup, which is the minor of the HTB class for the matched traffic, the major of
+	// the netem qdisc under it, and the priority of the filter.
+	tcRuleMinor = 2
+	// The max slot of rules, so the major of netem never conflicts with the root.
+	tcRuleMaxMinor = 0xfff
+	// The priority of the filter to exclude the API port, which should be matched before the rules.
+	tcExcludePrio = 1
+	// The offset of priority for IPv6 filters, because kernel requires the filters of the same priority to be the
+	// same protocol, so the IPv6 filter of slot N is in priority N+0x1000.
+	tcIPv6PrioOffset = 0x1000
+	// The rate in bytes per second for the unlimited class, about 32gbit.
+	tcUnlimitedRate = 4000000000
+)
+
+const (
+	tcHandleRoot    = 0xffffffff
+	tcHandleIngress = 0xfffffff1
+)
+
+// tcHandle makes the handle or classid from major and minor, for example, 1a1a:2.
+func tcHandle(major, minor uint16) uint32 {
+	return uint32(major)<<16 | uint32(minor)
+}
+
+// tcHandleString formats the handle in tc syntax, for example, 1a1a: or 1a1a:2 or root.
+func tcHandleString(h uint32) string {
+	switch h {
+	case tcHandleRoot:
+		return "root"
+	case tcHandleIngress:
+		return "ingress"
+	}
+	if h&0xffff == 0 {
+		return fmt.Sprintf("%x:", h>>16)
+	}
+	return fmt.Sprintf("%x:%x", h>>16, h&0xffff)
+}
+
+const (
+	tcProtocolAll  = 0x0003
+	tcProtocolIPv4 = 0x0800
+	tcProtocolIPv6 = 0x86dd
+)
+
+// tcProtocolString formats the ethernet protocol of filter in tc syntax.
+func tcProtocolString(protocol uint16) string {
+	switch protocol {
+	case tcProtocolAll:
+		return "all"
+	case tcProtocolIPv4:
+		return "ip"
+	case tcProtocolIPv6:
+		return "ipv6"
+	default:
+		return fmt.Sprintf("0x%04x", protocol)
+	}
+}
+
+// tcLink is the ifb device to redirect the ingress traffic to.
+type tcLink struct {
+	name string
+	kind string
+}
+
+// tcQdisc is a qdisc, the htb for root, the ingress, or the netem for the rule.
+type tcQdisc struct {
+	dev    string
+	parent uint32
+	handle uint32
+	kind   string
+	// For htb, the minor of default class.
+	defaultMinor uint16
+	// For netem.
+	netem *tcNetem
+}
+
+// tcNetem is the parameters of netem qdisc, the rate and correlation is in %, and the time is in ms.
+type tcNetem struct {
+	loss, lossCorrelation float64
+	// The loss model, state for the 4-state Markov model with p13, p31, p32, p23 and p14, or gemodel for the
+	// Gilbert-Elliott model with p, r, 1-h and 1-k. The loss is ignored if loss model is set.
+	lossModel       string
+	lossModelParams []float64
+	// The delay and jitter, and the jitter is in distribution, default to uniform.
+	delay, jitter, delayCorrelation float64
+	distribution                    string
+	duplicate, duplicateCorrelation float64
+	corrupt, corruptCorrelation     float64
+	// Every gap-th packet is sent immediately, while others are delayed. Zero gap means reorder by rate only.
+	reorder, reorderCorrelation float64
+	gap                         uint32
+}
+
+// IsEmpty whether no impairment, so netem is not required.
+func (v *tcNetem) IsEmpty() bool {
+	return v.loss == 0 && v.lossModel == "" && v.delay == 0 && v.jitter == 0 && v.duplicate == 0 && v.corrupt == 0 && v.reorder == 0
+}
+
+// tcClass is the HTB class, to limit the rate.
+type tcClass struct {
+	dev     string
+	parent  uint32
+	classid uint32
+	// The rate and ceil in bytes per second.
+	rate, ceil uint64
+	// The buffer and cbuffer in psched ticks, or nil to calculate by rate.
+	buffers []uint32
+}
+
+// tcU32Key is a key of u32 selector, matches the 32 bits value at offset of the packet.
+type tcU32Key struct {
+	val, mask uint32
+	off       int32
+}
+
+// tcFilter is the u32 filter, to classify the traffic to the class, or redirect to ifb.
+type tcFilter struct {
+	dev      string
+	parent   uint32
+	prio     uint16
+	protocol uint16
+	keys     []tcU32Key
+	// Classify the matched packets to the class.
+	flowid uint32
+	// If not empty, redirect the matched packets to the ifb device.
+	redirect string
+}
+
+// tcPlan is the objects to apply for the network options, which is shared by the tc and netlink shapers,
+// so they build exactly the same rules.
+type tcPlan struct {
+	// The interface to set the network condition.
+	iface string
+	// For direction incoming, the ifb device which the ingress traffic is redirected to.
+	ifb string
+	// The device to build the HTB tree, the iface for outgoing, or the ifb for incoming.
+	dev string
+	// The objects to create in order, which is *tcLink, *tcQdisc, *tcClass or *tcFilter. The base is the HTB
+	// tree shared by the rules of the direction, while the objects are for the rule only.
+	base, objects []interface{}
+	// The rule class, and the priorities of rule filters for IPv4 and IPv6, to remove the rule.
+	ruleClass uint32
+	rulePrios []uint16
+}
+
+// tcIfbName returns the name of ifb device for the iface, note that the max length is 15.
+func tcIfbName(iface string) (string, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return "", errors.Wrapf(err, "query iface %v", iface)
+	}
+	return fmt.Sprintf("tcifb%v", ifi.Index), nil
+}
+
+// buildTcPlan builds the HTB tree for the network options, which is similar to tcset, for the rule in slot N:
+//
+//	root htb 1a1a: default 1
+//	  class 1a1a:1, unlimited, for the API and traffic not matched.
+//	  class 1a1a:N, rate limited, with netem N: for loss and delay.
+//	  filter prio 1, API port to 1a1a:1
+//	  filter prio N, matched traffic to 1a1a:N
+//
+// For direction incoming, the ingress traffic of iface is redirected to an ifb device, and the tree is built
+// on the ifb device.
+func buildTcPlan(opts *NetworkOptions, slot uint16) (*tcPlan, error) {
+	if slot < tcRuleMinor || slot > tcRuleMaxMinor {
+		return nil, errors.Errorf("invalid slot %v", slot)
+	}
+
+	plan := &tcPlan{
+		iface: opts.iface, dev: opts.iface, ruleClass: tcHandle(tcRootMajor, slot),
+		rulePrios: []uint16{slot, slot + tcIPv6PrioOffset},
+	}
+
+	if opts.direction == "incoming" {
+		ifb, err := tcIfbName(opts.iface)
+		if err != nil {
+			return nil, err
+		}
+		plan.ifb, plan.dev = ifb, ifb
+
+		plan.base = append(plan.base,
+			&tcLink{name: ifb, kind: "ifb"},
+			&tcQdisc{dev: opts.iface, parent: tcHandleIngress, handle: tcHandle(0xffff, 0), kind: "ingress"},
+			&tcFilter{
+				dev: opts.iface, parent: tcHandle(0xffff, 0), prio: tcExcludePrio, protocol: tcProtocolAll,
+				keys: []tcU32Key{{}}, flowid: tcHandle(tcRootMajor, 0), redirect: ifb,
+			},
+		)
+	}
+
+	// Merge the network strategies to netem and rate.
+	netem, rate := &tcNetem{}, uint64(tcUnlimitedRate)
+	for _, strategy := range opts.strategies {
+		switch strategy.Strategy {
+		case "loss":
+			netem.loss, netem.lossCorrelation = strategy.Loss, strategy.LossCorrelation
+		case "lossState":
+			netem.lossModel = "state"
+			netem.lossModelParams = []float64{strategy.P13, strategy.P31, strategy.P32, strategy.P23, strategy.P14}
+		case "lossGemodel":
+			netem.lossModel = "gemodel"
+			netem.lossModelParams = []float64{strategy.P, strategy.R, strategy.LossBad, strategy.LossGood}
+		case "delay":
+			netem.delay, netem.jitter = strategy.Delay, strategy.DelayDistro
+			netem.delayCorrelation, netem.distribution = strategy.DelayCorrelation, strategy.Distribution
+		case "rate":
+			if rate = uint64(strategy.Rate * 1000 / 8); rate == 0 || rate > tcUnlimitedRate {
+				return nil, errors.Errorf("invalid rate=%v", strategy.Rate)
+			}
+		case "duplicate":
+			netem.duplicate, netem.duplicateCorrelation = strategy.Duplicate, strategy.DuplicateCorrelation
+		case "corrupt":
+			netem.corrupt, netem.corruptCorrelation = strategy.Corrupt, strategy.CorruptCorrelation
+		case "reorder":
+			netem.reorder, netem.reorderCorrelation, netem.gap = strategy.Reorder, strategy.ReorderCorrelation, strategy.Gap
+		}
+	}
+
+	// Build the HTB tree.
+	root, defaultClass := tcHandle(tcRootMajor, 0), tcHandle(tcRootMajor, tcDefaultMinor)
+	plan.base = append(plan.base,
+		&tcQdisc{dev: plan.dev, parent: tcHandleRoot, handle: root, kind: "htb", defaultMinor: tcDefaultMinor},
+		&tcClass{dev: plan.dev, parent: root, classid: defaultClass, rate: tcUnlimitedRate, ceil: tcUnlimitedRate},
+	)
+	plan.objects = append(plan.objects,
+		&tcClass{dev: plan.dev, parent: root, classid: plan.ruleClass, rate: rate, ceil: rate},
+	)
+	if !netem.IsEmpty() {
+		plan.objects = append(plan.objects, &tcQdisc{
+			dev: plan.dev, parent: plan.ruleClass, handle: tcHandle(slot, 0), kind: "netem", netem: netem,
+		})
+	}
+
+	// Exclude the API port, by classifying it to the default class.
+	if opts.apiPort != "" {
+		port, err := strconv.ParseUint(opts.apiPort, 10, 16)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse api port %v", opts.apiPort)
+		}
+
+		// For outgoing, the API is the source port, while for incoming it's the dest port.
+		for _, ipv6 := range []bool{false, true} {
+			key := tcU32DestPort(ipv6, uint16(port), 0xffff)
+			if opts.direction == "outgoing" {
+				key = tcU32SourcePort(ipv6, uint16(port), 0xffff)
+			}
+			plan.base = append(plan.base, &tcFilter{
+				dev: plan.dev, parent: root, prio: tcFilterPrio(ipv6, tcExcludePrio), protocol: tcFilterProtocol(ipv6),
+				keys: []tcU32Key{key}, flowid: defaultClass,
+			})
+		}
+	}
+
+	// Classify the matched traffic to the rule class, for IPv4 and IPv6, or the families of clientIp. Each
+	// alternative of the filter, such as a CIDR or a block of port range, is a filter in the same priority.
+	families := []bool{false, true}
+	if opts.identifyKey == "clientIp" {
+		ipnets, err := parseClientIPs(opts.identifyValue)
+		if err != nil {
+			return nil, err
+		}
+
+		families = nil
+		for _, ipv6 := range []bool{false, true} {
+			for _, ipnet := range ipnets {
+				if (ipnet.IP.To4() == nil) == ipv6 {
+					families = append(families, ipv6)
+					break
+				}
+			}
+		}
+	}
+
+	for _, ipv6 := range families {
+		alternatives, err := buildTcFilterKeys(opts, ipv6)
+		if err != nil {
+			return nil, err
+		}
+		for _, keys := range alternatives {
+			plan.objects = append(plan.objects, &tcFilter{
+				dev: plan.dev, parent: root, prio: tcFilterPrio(ipv6, slot), protocol: tcFilterProtocol(ipv6),
+				keys: keys, flowid: plan.ruleClass,
+			})
+		}
+	}
+
+	return plan, nil
+}
+
+// tcFilterPrio returns the priority of filter for IPv4 or IPv6.
+func tcFilterPrio(ipv6 bool, prio uint16) uint16 {
+	if ipv6 {
+		return prio + tcIPv6PrioOffset
+	}
+	return prio
+}
+
+// tcFilterProtocol returns the ethernet protocol of filter for IPv4 or IPv6.
+func tcFilterProtocol(ipv6 bool) uint16 {
+	if ipv6 {
+		return tcProtocolIPv6
+	}
+	return tcProtocolIPv4
+}
+
+// The max number of alternatives of filter, that is, the CIDRs or blocks of port ranges.
+const tcMaxFilterAlternatives = 128
+
+// parseClientIPs parses the comma separated clientIp in CIDR or IP, for IPv4 or IPv6, for example,
+// 10.0.0.0/8,2001:db8::1.
+func parseClientIPs(value string) ([]*net.IPNet, error) {
+	var ipnets []*net.IPNet
+	for _, v := range strings.Split(value, ",") {
+		if ipnet, err := parseClientIP(strings.TrimSpace(v)); err != nil {
+			return nil, err
+		} else {
+			ipnets = append(ipnets, ipnet)
+		}
+	}
+
+	if len(ipnets) > tcMaxFilterAlternatives {
+		return nil, errors.Errorf("too many clientIp %v, max %v", len(ipnets), tcMaxFilterAlternatives)
+	}
+	return ipnets, nil
+}
+
+// parseClientIP parses the clientIp in CIDR or IP, for IPv4 or IPv6, for example, 10.0.0.0/8 or 2001:db8::1.
+func parseClientIP(value string) (*net.IPNet, error) {
+	if _, ipnet, err := net.ParseCIDR(value); err == nil {
+		return ipnet, nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, errors.Errorf("invalid clientIp %v", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// tcPortRange is an inclusive range of ports, for example, 10000-20000, or a single port.
+type tcPortRange struct {
+	from, to uint16
+}
+
+// Blocks splits the range to the blocks which are aligned to the mask, so each block is a u32 key, for example,
+// 8000-8003 is a block of 8000 with mask 0xfffc.
+func (v tcPortRange) Blocks() (values, masks []uint16) {
+	for from := uint32(v.from); from <= uint32(v.to); {
+		size := uint32(1)
+		for from&(size*2-1) == 0 && from+size*2-1 <= uint32(v.to) && size < 0x10000 {
+			size *= 2
+		}
+		values, masks = append(values, uint16(from)), append(masks, uint16(^(size-1)))
+		from += size
+	}
+	return
+}
+
+// parsePortRanges parses the comma separated ports or ranges, for example, 8000,10000-20000.
+func parsePortRanges(value string) ([]tcPortRange, error) {
+	parse := func(v string) (uint16, error) {
+		port, err := strconv.ParseUint(strings.TrimSpace(v), 10, 16)
+		if err != nil {
+			return 0, errors.Wrapf(err, "parse port %v", v)
+		}
+		return uint16(port), nil
+	}
+
+	var ranges []tcPortRange
+	var blocks int
+	for _, v := range strings.Split(value, ",") {
+		var r tcPortRange
+		var err error
+		if parts := strings.SplitN(v, "-", 2); len(parts) == 2 {
+			if r.from, err = parse(parts[0]); err != nil {
+				return nil, err
+			}
+			if r.to, err = parse(parts[1]); err != nil {
+				return nil, err
+			}
+			if r.from > r.to {
+				return nil, errors.Errorf("invalid port range %v", v)
+			}
+		} else {
+			if r.from, err = parse(v); err != nil {
+				return nil, err
+			}
+			r.to = r.from
+		}
+
+		values, _ := r.Blocks()
+		blocks += len(values)
+		ranges = append(ranges, r)
+	}
+
+	if blocks > tcMaxFilterAlternatives {
+		return nil, errors.Errorf("too many port blocks %v of %v, max %v", blocks, value, tcMaxFilterAlternatives)
+	}
+	return ranges, nil
+}
+
+// buildTcFilterKeys builds the alternatives of u32 keys to match the traffic identified by the network options,
+// in IPv4 or IPv6 header, each alternative is a filter. For outgoing, the server is the source, while for incoming
+// the server is the destination.
+func buildTcFilterKeys(opts *NetworkOptions, ipv6 bool) ([][]tcU32Key, error) {
+	var keys []tcU32Key
+	if protocol := tcIPProtocolOf(opts.protocol); protocol != 0 {
+		if ipv6 && protocol == tcIPProtocolICMP {
+			protocol = tcIPProtocolICMPv6
+		}
+		keys = append(keys, tcU32IPProtocol(ipv6, protocol))
+	}
+
+	// The alternative is the keys of protocol, with the keys of IP or port.
+	alternativeOf := func(matches ...tcU32Key) []tcU32Key {
+		r0 := append(append([]tcU32Key{}, keys...), matches...)
+		// Match all if no key, for example, 0.0.0.0/0.
+		if len(r0) == 0 {
+			r0 = append(r0, tcU32Key{})
+		}
+		return r0
+	}
+
+	if opts.identifyKey == "all" {
+		return [][]tcU32Key{alternativeOf()}, nil
+	}
+
+	var alternatives [][]tcU32Key
+	if opts.identifyKey == "clientIp" {
+		ipnets, err := parseClientIPs(opts.identifyValue)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ipnet := range ipnets {
+			if (ipnet.IP.To4() == nil) != ipv6 {
+				continue
+			}
+			if opts.direction == "outgoing" {
+				alternatives = append(alternatives, alternativeOf(tcU32DestIP(ipnet)...))
+			} else {
+				alternatives = append(alternatives, alternativeOf(tcU32SourceIP(ipnet)...))
+			}
+		}
+		if len(alternatives) == 0 {
+			return nil, errors.Errorf("no clientIp in %v for ipv6=%v", opts.identifyValue, ipv6)
+		}
+		return alternatives, nil
+	}
+
+	ranges, err := parsePortRanges(opts.identifyValue)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %v=%v", opts.identifyKey, opts.identifyValue)
+	}
+
+	isServerSource := opts.direction == "outgoing"
+	isSource := isServerSource == (opts.identifyKey == "serverPort")
+	for _, r := range ranges {
+		values, masks := r.Blocks()
+		for i, value := range values {
+			if isSource {
+				alternatives = append(alternatives, alternativeOf(tcU32SourcePort(ipv6, value, masks[i])))
+			} else {
+				alternatives = append(alternatives, alternativeOf(tcU32DestPort(ipv6, value, masks[i])))
+			}
+		}
+	}
+	return alternatives, nil
+}
+
+// The IP protocol numbers, see /etc/protocols
+const (
+	tcIPProtocolICMP   = 1
+	tcIPProtocolTCP    = 6
+	tcIPProtocolUDP    = 17
+	tcIPProtocolICMPv6 = 58
+)
+
+// tcIPProtocolOf returns the IP protocol number of the protocol option, or 0 for all protocols.
+func tcIPProtocolOf(protocol string) uint8 {
+	switch protocol {
+	case "tcp":
+		return tcIPProtocolTCP
+	case "udp":
+		return tcIPProtocolUDP
+	case "icmp":
+		return tcIPProtocolICMP
+	default:
+		return 0
+	}
+}
+
+// tcIPProtocolString formats the IP protocol number, for example, udp.
+func tcIPProtocolString(protocol uint8) string {
+	switch protocol {
+	case tcIPProtocolTCP:
+		return "tcp"
+	case tcIPProtocolUDP:
+		return "udp"
+	case tcIPProtocolICMP:
+		return "icmp"
+	case tcIPProtocolICMPv6:
+		return "icmpv6"
+	default:
+		return fmt.Sprintf("%v", protocol)
+	}
+}
+
+// The u32 keys for IPv4 and IPv6 header, which assumes there is no IP options or IPv6 extension headers, the
+// same as tc. Note that the IPv6 address is matched by words of the prefix.
+const (
+	tcU32IPv4SourceOffset = 12
+	tcU32IPv4DestOffset   = 16
+	tcU32IPv4PortOffset   = 20
+	tcU32IPv6SourceOffset = 8
+	tcU32IPv6DestOffset   = 24
+	tcU32IPv6PortOffset   = 40
+)
+
+func tcU32SourceIP(ipnet *net.IPNet) []tcU32Key {
+	if ipnet.IP.To4() != nil {
+		return tcU32IPKeys(ipnet, tcU32IPv4SourceOffset)
+	}
+	return tcU32IPKeys(ipnet, tcU32IPv6SourceOffset)
+}
+
+func tcU32DestIP(ipnet *net.IPNet) []tcU32Key {
+	if ipnet.IP.To4() != nil {
+		return tcU32IPKeys(ipnet, tcU32IPv4DestOffset)
+	}
+	return tcU32IPKeys(ipnet, tcU32IPv6DestOffset)
+}
+
+// tcU32IPKeys builds the keys of the address words at offset, ignoring the words not in prefix.
+func tcU32IPKeys(ipnet *net.IPNet, off int32) []tcU32Key {
+	ip, mask := ipnet.IP.To4(), net.IP(ipnet.Mask)
+	if ip == nil {
+		ip = ipnet.IP.To16()
+	}
+
+	var keys []tcU32Key
+	for i := 0; i+4 <= len(ip) && i+4 <= len(mask); i += 4 {
+		key := tcU32Key{val: binaryUint32(ip[i:]), mask: binaryUint32(mask[i:]), off: off + int32(i)}
+		if key.mask != 0 {
+			key.val &= key.mask
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func tcU32IPProtocol(ipv6 bool, protocol uint8) tcU32Key {
+	if ipv6 {
+		return tcU32Key{val: uint32(protocol) << 8, mask: 0x0000ff00, off: 4}
+	}
+	return tcU32Key{val: uint32(protocol) << 16, mask: 0x00ff0000, off: 8}
+}
+
+// The port is matched with mask, for example, the mask 0xfffc matches 4 ports.
+func tcU32SourcePort(ipv6 bool, port, mask uint16) tcU32Key {
+	off := int32(tcU32IPv4PortOffset)
+	if ipv6 {
+		off = tcU32IPv6PortOffset
+	}
+	return tcU32Key{val: uint32(port&mask) << 16, mask: uint32(mask) << 16, off: off}
+}
+
+func tcU32DestPort(ipv6 bool, port, mask uint16) tcU32Key {
+	off := int32(tcU32IPv4PortOffset)
+	if ipv6 {
+		off = tcU32IPv6PortOffset
+	}
+	return tcU32Key{val: uint32(port & mask), mask: uint32(mask), off: off}
+}
+
+// binaryUint32 reads the big-endian uint32.
+func binaryUint32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// tcFormatRate formats the rate in bytes per second to tc syntax, for example, 1000kbit.
+func tcFormatRate(rate uint64) string {
+	if rate*8%1000 == 0 {
+		return fmt.Sprintf("%vkbit", rate*8/1000)
+	}
+	return fmt.Sprintf("%vbit", rate*8)
+}
+
+// tcFormatKeys formats the u32 keys in tc syntax, for example, match u32 0x00001f40 0x0000ffff at 20.
+func tcFormatKeys(keys []tcU32Key) string {
+	var matches []string
+	for _, key := range keys {
+		matches = append(matches, fmt.Sprintf("match u32 0x%08x 0x%08x at %v", key.val, key.mask, key.off))
+	}
+	return strings.Join(matches, " ")
+}
+
+// tcDescribeKeys describes the u32 keys built by the plan, for example, protocol udp sport 8000, and the keys
+// not built by plan are formatted as raw match. The protocol is the ethernet protocol of filter, because the
+// offsets of IPv4 and IPv6 are different.
+func tcDescribeKeys(protocol uint16, keys []tcU32Key) string {
+	ipv6 := protocol == tcProtocolIPv6
+	srcOff, dstOff, portOff, size := int32(tcU32IPv4SourceOffset), int32(tcU32IPv4DestOffset), int32(tcU32IPv4PortOffset), int32(4)
+	if ipv6 {
+		srcOff, dstOff, portOff, size = tcU32IPv6SourceOffset, tcU32IPv6DestOffset, tcU32IPv6PortOffset, 16
+	}
+
+	// The address is matched by words, so we merge the words to the address.
+	src, srcMask := make([]byte, size), make([]byte, size)
+	dst, dstMask := make([]byte, size), make([]byte, size)
+	var hasSrc, hasDst bool
+	putWord := func(b []byte, off int32, v uint32) {
+		b[off], b[off+1], b[off+2], b[off+3] = byte(v>>24), byte(v>>16), byte(v>>8), byte(v)
+	}
+	ipNetString := func(ip, mask []byte) string {
+		return (&net.IPNet{IP: net.IP(ip), Mask: net.IPMask(mask)}).String()
+	}
+	// The port with mask is a range, for example, 8000-8003.
+	portString := func(port, mask uint16) string {
+		if mask == 0xffff {
+			return fmt.Sprintf("%v", port)
+		}
+		return fmt.Sprintf("%v-%v", port&mask, port|^mask)
+	}
+
+	var matches []string
+	for _, key := range keys {
+		switch {
+		case key.mask == 0:
+			matches = append(matches, "all")
+		case !ipv6 && key.off == 8 && key.mask == 0x00ff0000:
+			matches = append(matches, fmt.Sprintf("protocol %v", tcIPProtocolString(uint8(key.val>>16))))
+		case ipv6 && key.off == 4 && key.mask == 0x0000ff00:
+			matches = append(matches, fmt.Sprintf("protocol %v", tcIPProtocolString(uint8(key.val>>8))))
+		case key.off >= srcOff && key.off < srcOff+size && (key.off-srcOff)%4 == 0:
+			putWord(src, key.off-srcOff, key.val)
+			putWord(srcMask, key.off-srcOff, key.mask)
+			hasSrc = true
+		case key.off >= dstOff && key.off < dstOff+size && (key.off-dstOff)%4 == 0:
+			putWord(dst, key.off-dstOff, key.val)
+			putWord(dstMask, key.off-dstOff, key.mask)
+			hasDst = true
+		case key.off == portOff && key.mask&0x0000ffff == 0:
+			matches = append(matches, fmt.Sprintf("sport %v", portString(uint16(key.val>>16), uint16(key.mask>>16))))
+		case key.off == portOff && key.mask&0xffff0000 == 0:
+			matches = append(matches, fmt.Sprintf("dport %v", portString(uint16(key.val), uint16(key.mask))))
+		default:
+			matches = append(matches, tcFormatKeys([]tcU32Key{key}))
+		}
+	}
+
+	if hasSrc {
+		matches = append(matches, fmt.Sprintf("src %v", ipNetString(src, srcMask)))
+	}
+	if hasDst {
+		matches = append(matches, fmt.Sprintf("dst %v", ipNetString(dst, dstMask)))
+	}
+	return strings.Join(matches, " ")
+}
+
+// tcNetemArgs formats the netem parameters in tc syntax, for example, delay 100ms 10ms distribution normal.
+func tcNetemArgs(v *tcNetem) []string {
+	format := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	var args []string
+	if v.delay > 0 || v.jitter > 0 {
+		args = append(args, "delay", fmt.Sprintf("%vms", format(v.delay)))
+		if v.jitter > 0 {
+			args = append(args, fmt.Sprintf("%vms", format(v.jitter)))
+			if v.delayCorrelation > 0 {
+				args = append(args, fmt.Sprintf("%v%%", format(v.delayCorrelation)))
+			}
+		}
+		if v.distribution != "" {
+			args = append(args, "distribution", v.distribution)
+		}
+	}
+	if v.lossModel != "" {
+		args = append(args, "loss", v.lossModel)
+		for _, param := range v.lossModelParams {
+			args = append(args, fmt.Sprintf("%v%%", format(param)))
+		}
+	} else if v.loss > 0 {
+		args = append(args, "loss", fmt.Sprintf("%v%%", format(v.loss)))
+		if v.lossCorrelation > 0 {
+			args = append(args, fmt.Sprintf("%v%%", format(v.lossCorrelation)))
+		}
+	}
+	if v.duplicate > 0 {
+		args = append(args, "duplicate", fmt.Sprintf("%v%%", format(v.duplicate)))
+		if v.duplicateCorrelation > 0 {
+			args = append(args, fmt.Sprintf("%v%%", format(v.duplicateCorrelation)))
+		}
+	}
+	if v.corrupt > 0 {
+		args = append(args, "corrupt", fmt.Sprintf("%v%%", format(v.corrupt)))
+		if v.corruptCorrelation > 0 {
+			args = append(args, fmt.Sprintf("%v%%", format(v.corruptCorrelation)))
+		}
+	}
+	if v.reorder > 0 {
+		args = append(args, "reorder", fmt.Sprintf("%v%%", format(v.reorder)))
+		if v.reorderCorrelation > 0 {
+			args = append(args, fmt.Sprintf("%v%%", format(v.reorderCorrelation)))
+		}
+		if v.gap > 0 {
+			args = append(args, "gap", fmt.Sprintf("%v", v.gap))
+		}
+	}
+	return args
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// netlinkShaper programs the HTB/netem qdiscs, classes and u32 filters directly over rtnetlink, so it doesn't
+// depend on tcconfig or iproute2.
+type netlinkShaper struct {
+}
+
+func (v *netlinkShaper) Name() string {
+	return "netlink"
+}
+
+func (v *netlinkShaper) Setup(ctx context.Context, opts *NetworkOptions) error {
+	plan, err := buildTcPlan(opts, tcRuleMinor)
+	if err != nil {
+		return errors.Wrapf(err, "build plan")
+	}
+
+	operations, err := v.setupOperations(ctx, plan)
+	if err != nil {
+		return err
+	}
+
+	conn, err := nlDial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, operation := range operations {
+		if err := operation.run(conn); err != nil {
+			return err
+		}
+	}
+
+	logger.Tf(ctx, "netlink setup iface=%v, dev=%v, objects=%v", plan.iface, plan.dev, len(plan.base)+len(plan.objects))
+	return nil
+}
+
+func (v *netlinkShaper) Plan(ctx context.Context, opts *NetworkOptions) ([]string, error) {
+	plan, err := buildTcPlan(opts, tcRuleMinor)
+	if err != nil {
+		return nil, errors.Wrapf(err, "build plan")
+	}
+
+	operations, err := v.setupOperations(ctx, plan)
+	if err != nil {
+		return nil, err
+	}
+
+	var commands []string
+	for _, operation := range operations {
+		commands = append(commands, operation.commands...)
+	}
+	return commands, nil
+}
+
+func (v *netlinkShaper) AddRule(ctx context.Context, rule *NetworkRule) error {
+	plan, err := buildTcPlan(rule.opts, rule.Slot)
+	if err != nil {
+		return errors.Wrapf(err, "build plan")
+	}
+
+	conn, err := nlDial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Create the HTB tree of the direction, if it's the first rule.
+	if ok, err := v.hasRoot(conn, plan.dev); err != nil {
+		return err
+	} else if !ok {
+		if err := v.createBase(ctx, conn, plan); err != nil {
+			return err
+		}
+	}
+
+	for _, object := range plan.objects {
+		if err := v.create(conn, object); err != nil {
+			return err
+		}
+	}
+
+	logger.Tf(ctx, "netlink add rule slot=%v, iface=%v, dev=%v, objects=%v", rule.Slot, plan.iface, plan.dev, len(plan.objects))
+	return nil
+}
+
+func (v *netlinkShaper) UpdateRule(ctx context.Context, rule *NetworkRule) error {
+	plan, err := buildTcPlan(rule.opts, rule.Slot)
+	if err != nil {
+		return errors.Wrapf(err, "build plan")
+	}
+
+	conn, err := nlDial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Change the class and replace the netem in place, so the queue is not flushed. The filters are not changed.
+	netem := false
+	for _, object := range plan.objects {
+		switch o := object.(type) {
+		case *tcClass:
+			if err := v.modify(conn, o, 0); err != nil {
+				return err
+			}
+		case *tcQdisc:
+			if err := v.modify(conn, o, nlmFCreate|nlmFReplace); err != nil {
+				return err
+			}
+			netem = true
+		}
+	}
+	if !netem {
+		if err := v.deleteQdisc(conn, plan.dev, plan.ruleClass, tcHandle(rule.Slot, 0)); err != nil {
+			return errors.Wrapf(err, "delete netem of %v", plan.dev)
+		}
+	}
+
+	logger.Tf(ctx, "netlink update rule slot=%v, iface=%v, dev=%v", rule.Slot, plan.iface, plan.dev)
+	return nil
+}
+
+func (v *netlinkShaper) DeleteRule(ctx context.Context, rule *NetworkRule) error {
+	plan, err := buildTcPlan(rule.opts, rule.Slot)
+	if err != nil {
+		return errors.Wrapf(err, "build plan")
+	}
+
+	conn, err := nlDial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Ignore if the device is removed, for example, the ifb is deleted by reset.
+	ifi, err := net.InterfaceByName(plan.dev)
+	if err != nil {
+		logger.Tf(ctx, "netlink ignore rule slot=%v, no dev %v", rule.Slot, plan.dev)
+		return nil
+	}
+
+	// Remove the filter before the class, because HTB refuses to delete the class in use.
+	root := tcHandle(tcRootMajor, 0)
+	for _, prio := range plan.rulePrios {
+		if _, err := conn.Execute(rtmDelTFilter, 0, nlTcmsg(ifi.Index, 0, root, uint32(prio)<<16)); err != nil && !nlIsNotExist(err) {
+			return errors.Wrapf(err, "delete filter prio %v of %v", prio, plan.dev)
+		}
+	}
+	if _, err := conn.Execute(rtmDelTClass, 0, nlTcmsg(ifi.Index, plan.ruleClass, root, 0)); err != nil && !nlIsNotExist(err) {
+		return errors.Wrapf(err, "delete class %v of %v", tcHandleString(plan.ruleClass), plan.dev)
+	}
+
+	logger.Tf(ctx, "netlink delete rule slot=%v, iface=%v, dev=%v", rule.Slot, plan.iface, plan.dev)
+	return nil
+}
+
+func (v *netlinkShaper) Query(ctx context.Context, iface string) (cmd, output string, err error) {
+	conn, err := nlDial()
+	if err != nil {
+		return "", "", err
+	}
+	defer conn.Close()
+
+	devs := []string{iface}
+	if ifb, err := tcIfbName(iface); err != nil {
+		return "", "", err
+	} else if _, err := net.InterfaceByName(ifb); err == nil {
+		devs = append(devs, ifb)
+	}
+
+	var lines []string
+	for _, dev := range devs {
+		if r0, err := v.dump(conn, dev); err != nil {
+			return "", "", errors.Wrapf(err, "dump %v", dev)
+		} else {
+			lines = append(lines, r0...)
+		}
+	}
+
+	return fmt.Sprintf("netlink dump %v", strings.Join(devs, " ")), strings.Join(lines, "\n"), nil
+}
+
+func (v *netlinkShaper) Reset(ctx context.Context, iface string) error {
+	conn, err := nlDial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := v.deleteQdisc(conn, iface, tcHandleRoot, 0); err != nil {
+		return errors.Wrapf(err, "delete root of %v", iface)
+	}
+
+	ifb, err := tcIfbName(iface)
+	if err != nil {
+		return err
+	}
+	if err := v.deleteIngress(ctx, conn, iface, ifb); err != nil {
+		return err
+	}
+
+	logger.Tf(ctx, "netlink reset iface=%v, ifb=%v", iface, ifb)
+	return nil
+}
+
+// nlOperation is an operation over netlink, which is described by the equivalent tc or ip commands.
+type nlOperation struct {
+	commands []string
+	run      func(conn *nlConn) error
+}
+
+// setupOperations builds the operations to overwrite the existing rules of the direction by the plan.
+func (v *netlinkShaper) setupOperations(ctx context.Context, plan *tcPlan) ([]*nlOperation, error) {
+	operations, err := v.baseOperations(ctx, plan)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, object := range plan.objects {
+		if operation, err := v.createOperation(object); err != nil {
+			return nil, err
+		} else {
+			operations = append(operations, operation)
+		}
+	}
+	return operations, nil
+}
+
+// baseOperations builds the operations to overwrite the existing rules of the direction, and create the HTB tree
+// shared by rules.
+func (v *netlinkShaper) baseOperations(ctx context.Context, plan *tcPlan) ([]*nlOperation, error) {
+	var operations []*nlOperation
+	if plan.ifb != "" {
+		operations = append(operations, &nlOperation{
+			commands: []string{
+				fmt.Sprintf("tc qdisc del dev %v ingress", plan.iface), fmt.Sprintf("ip link del dev %v", plan.ifb),
+			},
+			run: func(conn *nlConn) error {
+				return v.deleteIngress(ctx, conn, plan.iface, plan.ifb)
+			},
+		})
+	} else {
+		operations = append(operations, &nlOperation{
+			commands: []string{fmt.Sprintf("tc qdisc del dev %v root", plan.iface)},
+			run: func(conn *nlConn) error {
+				if err := v.deleteQdisc(conn, plan.iface, tcHandleRoot, 0); err != nil {
+					return errors.Wrapf(err, "delete root of %v", plan.iface)
+				}
+				return nil
+			},
+		})
+	}
+
+	for _, object := range plan.base {
+		if operation, err := v.createOperation(object); err != nil {
+			return nil, err
+		} else {
+			operations = append(operations, operation)
+		}
+	}
+	return operations, nil
+}
+
+// createOperation builds the operation to create the object of plan.
+func (v *netlinkShaper) createOperation(object interface{}) (*nlOperation, error) {
+	commands, err := tcCommandsOf(object)
+	if err != nil {
+		return nil, err
+	}
+
+	operation := &nlOperation{run: func(conn *nlConn) error {
+		return v.create(conn, object)
+	}}
+	for _, command := range commands {
+		operation.commands = append(operation.commands, command.String())
+	}
+	return operation, nil
+}
+
+// createBase overwrites the existing rules of the direction, and creates the HTB tree shared by rules.
+func (v *netlinkShaper) createBase(ctx context.Context, conn *nlConn, plan *tcPlan) error {
+	operations, err := v.baseOperations(ctx, plan)
+	if err != nil {
+		return err
+	}
+
+	for _, operation := range operations {
+		if err := operation.run(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasRoot whether the device has the HTB root qdisc created by us.
+func (v *netlinkShaper) hasRoot(conn *nlConn, dev string) (bool, error) {
+	ifi, err := net.InterfaceByName(dev)
+	if err != nil {
+		return false, nil
+	}
+
+	responses, err := conn.Execute(rtmGetQdisc, nlmFDump, nlTcmsg(0, 0, 0, 0))
+	if err != nil {
+		return false, errors.Wrapf(err, "dump qdisc")
+	}
+
+	for _, b := range responses {
+		h, attrs, err := nlParseTcmsg(b)
+		if err != nil {
+			return false, err
+		}
+		if h.ifindex == ifi.Index && h.parent == tcHandleRoot && h.handle == tcHandle(tcRootMajor, 0) &&
+			nlAttrString(nlFindAttr(attrs, tcaKind)) == "htb" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// deleteIngress removes the ingress qdisc of iface, and the ifb device.
+func (v *netlinkShaper) deleteIngress(ctx context.Context, conn *nlConn, iface, ifb string) error {
+	if err := v.deleteQdisc(conn, iface, tcHandleIngress, tcHandle(0xffff, 0)); err != nil {
+		return errors.Wrapf(err, "delete ingress of %v", iface)
+	}
+
+	if ifi, err := net.InterfaceByName(ifb); err == nil {
+		if _, err := conn.Execute(rtmDelLink, 0, nlIfinfomsg(ifi.Index, 0, 0)); err != nil && !nlIsNotExist(err) {
+			return errors.Wrapf(err, "delete link %v", ifb)
+		}
+		logger.Tf(ctx, "netlink delete link %v", ifb)
+	}
+	return nil
+}
+
+// deleteQdisc removes the qdisc, ignore if not exists.
+func (v *netlinkShaper) deleteQdisc(conn *nlConn, dev string, parent, handle uint32) error {
+	ifi, err := net.InterfaceByName(dev)
+	if err != nil {
+		return errors.Wrapf(err, "query iface %v", dev)
+	}
+
+	if _, err := conn.Execute(rtmDelQdisc, 0, nlTcmsg(ifi.Index, handle, parent, 0)); err != nil && !nlIsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// create creates the object of plan in kernel.
+func (v *netlinkShaper) create(conn *nlConn, object interface{}) error {
+	return v.modify(conn, object, nlmFCreate|nlmFExcl)
+}
+
+// modify creates or changes the object in kernel by flags, to create it exclusively, change the existing one, or
+// replace it.
+func (v *netlinkShaper) modify(conn *nlConn, object interface{}, flags uint16) error {
+	verb := "create"
+	if flags&nlmFExcl == 0 {
+		verb = "change"
+	}
+
+	indexOf := func(dev string) (int, error) {
+		ifi, err := net.InterfaceByName(dev)
+		if err != nil {
+			return 0, errors.Wrapf(err, "query iface %v", dev)
+		}
+		return ifi.Index, nil
+	}
+
+	switch o := object.(type) {
+	case *tcLink:
+		payload := nlConcat(nlIfinfomsg(0, 0, 0), nlString(iflaIfname, o.name),
+			nlNest(iflaLinkinfo, nlString(iflaInfoKind, o.kind)),
+		)
+		if _, err := conn.Execute(rtmNewLink, flags, payload); err != nil {
+			return errors.Wrapf(err, "%v link %v type %v", verb, o.name, o.kind)
+		}
+
+		index, err := indexOf(o.name)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Execute(rtmNewLink, 0, nlIfinfomsg(index, syscall.IFF_UP, syscall.IFF_UP)); err != nil {
+			return errors.Wrapf(err, "up link %v", o.name)
+		}
+	case *tcQdisc:
+		index, err := indexOf(o.dev)
+		if err != nil {
+			return err
+		}
+
+		payload := nlConcat(nlTcmsg(index, o.handle, o.parent, 0), nlString(tcaKind, o.kind))
+		if o.kind == "htb" {
+			payload = append(payload, nlHtbQdiscOptions(o.defaultMinor)...)
+		} else if o.kind == "netem" {
+			if options, err := nlNetemOptions(o.netem); err != nil {
+				return err
+			} else {
+				payload = append(payload, options...)
+			}
+		}
+
+		if _, err := conn.Execute(rtmNewQdisc, flags, payload); err != nil {
+			return errors.Wrapf(err, "%v qdisc %v %v parent %v of %v", verb,
+				o.kind, tcHandleString(o.handle), tcHandleString(o.parent), o.dev)
+		}
+	case *tcClass:
+		index, err := indexOf(o.dev)
+		if err != nil {
+			return err
+		}
+
+		payload := nlConcat(nlTcmsg(index, o.classid, o.parent, 0), nlString(tcaKind, "htb"),
+			nlHtbClassOptions(o.rate, o.ceil, o.buffers),
+		)
+		if _, err := conn.Execute(rtmNewTClass, flags, payload); err != nil {
+			return errors.Wrapf(err, "%v class %v rate %v of %v", verb,
+				tcHandleString(o.classid), tcFormatRate(o.rate), o.dev)
+		}
+	case *tcFilter:
+		index, err := indexOf(o.dev)
+		if err != nil {
+			return err
+		}
+
+		var redirectIndex int
+		if o.redirect != "" {
+			if redirectIndex, err = indexOf(o.redirect); err != nil {
+				return err
+			}
+		}
+
+		info := uint32(o.prio)<<16 | uint32(nlHtons(o.protocol))
+		payload := nlConcat(nlTcmsg(index, 0, o.parent, info), nlString(tcaKind, "u32"),
+			nlU32Options(o, redirectIndex),
+		)
+		if _, err := conn.Execute(rtmNewTFilter, flags, payload); err != nil {
+			return errors.Wrapf(err, "%v filter prio %v %v of %v", verb, o.prio, tcFormatKeys(o.keys), o.dev)
+		}
+	default:
+		return errors.Errorf("invalid object %v", object)
+	}
+	return nil
+}
+
+// dump returns the qdiscs, classes and filters of the device, in text.
+func (v *netlinkShaper) dump(conn *nlConn, dev string) ([]string, error) {
+	ifi, err := net.InterfaceByName(dev)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query iface %v", dev)
+	}
+
+	var lines []string
+	responses, err := conn.Execute(rtmGetQdisc, nlmFDump, nlTcmsg(0, 0, 0, 0))
+	if err != nil {
+		return nil, errors.Wrapf(err, "dump qdisc")
+	}
+
+	var parents []uint32
+	for _, b := range responses {
+		h, attrs, err := nlParseTcmsg(b)
+		if err != nil {
+			return nil, err
+		}
+		if h.ifindex != ifi.Index {
+			continue
+		}
+
+		kind := nlAttrString(nlFindAttr(attrs, tcaKind))
+		line := fmt.Sprintf("qdisc %v %v parent %v dev %v", kind, tcHandleString(h.handle), tcHandleString(h.parent), dev)
+		if kind == "netem" {
+			netem := nlParseNetemOptions(nlFindAttr(attrs, tcaOptions))
+			line += " " + strings.Join(tcNetemArgs(netem), " ")
+		}
+		lines = append(lines, line)
+
+		if kind == "htb" || kind == "ingress" {
+			parents = append(parents, h.handle)
+		}
+	}
+
+	if responses, err = conn.Execute(rtmGetTClass, nlmFDump, nlTcmsg(ifi.Index, 0, 0, 0)); err != nil {
+		return nil, errors.Wrapf(err, "dump class")
+	}
+	for _, b := range responses {
+		h, attrs, err := nlParseTcmsg(b)
+		if err != nil {
+			return nil, err
+		}
+
+		kind := nlAttrString(nlFindAttr(attrs, tcaKind))
+		line := fmt.Sprintf("class %v %v parent %v dev %v", kind, tcHandleString(h.handle), tcHandleString(h.parent), dev)
+		if kind == "htb" {
+			if opt := nlFindAttr(nlParseAttrs(nlFindAttr(attrs, tcaOptions)), tcaHtbParms); len(opt) >= 24 {
+				line += fmt.Sprintf(" rate %v ceil %v",
+					tcFormatRate(uint64(nativeEndian.Uint32(opt[8:]))), tcFormatRate(uint64(nativeEndian.Uint32(opt[20:]))),
+				)
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	for _, parent := range parents {
+		if responses, err = conn.Execute(rtmGetTFilter, nlmFDump, nlTcmsg(ifi.Index, 0, parent, 0)); err != nil {
+			return nil, errors.Wrapf(err, "dump filter of %v", tcHandleString(parent))
+		}
+
+		for _, b := range responses {
+			h, attrs, err := nlParseTcmsg(b)
+			if err != nil {
+				return nil, err
+			}
+
+			kind := nlAttrString(nlFindAttr(attrs, tcaKind))
+			if kind != "u32" {
+				lines = append(lines, fmt.Sprintf("filter %v parent %v prio %v dev %v", kind, tcHandleString(parent), h.info>>16, dev))
+				continue
+			}
+
+			keys, flowid := nlParseU32Options(nlFindAttr(attrs, tcaOptions))
+			if keys == nil {
+				continue
+			}
+			protocol := nlHtons(uint16(h.info))
+			lines = append(lines, fmt.Sprintf("filter u32 parent %v prio %v protocol %v dev %v flowid %v match %v",
+				tcHandleString(parent), h.info>>16, tcProtocolString(protocol), dev, tcHandleString(flowid),
+				tcDescribeKeys(protocol, keys),
+			))
+		}
+	}
+
+	return lines, nil
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// tcShaper applies the network options by plain iproute2 tc and ip commands, which builds the same HTB tree
+// as netlink, for hosts with iproute2 but without tcconfig.
+type tcShaper struct {
+	// The script of each iface, for operators to replay it by hand.
+	scripts map[string][]*tcScriptSegment
+	lock    sync.Mutex
+}
+
+// tcScriptSegment is the commands ran to create the HTB tree of a direction, or a rule of it. The segments of an
+// iface are the script to build its rules on a clean host.
+type tcScriptSegment struct {
+	direction string
+	// The slot of rule, or 0 for the HTB tree of direction.
+	slot uint16
+	// The commands to create it, and the last commands to update it in place.
+	commands, updates []string
+}
+
+func (v *tcShaper) Name() string {
+	return "tc"
+}
+
+func (v *tcShaper) Setup(ctx context.Context, opts *NetworkOptions) error {
+	plan, base, objects, err := v.setupCommands(opts)
+	if err != nil {
+		return err
+	}
+
+	// The HTB tree of direction is recreated, so is the script of direction.
+	tree := &tcScriptSegment{direction: opts.direction}
+	rule := &tcScriptSegment{direction: opts.direction, slot: tcRuleMinor}
+	defer v.record(plan.iface, tree, rule)
+
+	if tree.commands, err = v.execute(ctx, base); err != nil {
+		return err
+	}
+	rule.commands, err = v.execute(ctx, objects)
+	return err
+}
+
+func (v *tcShaper) Plan(ctx context.Context, opts *NetworkOptions) ([]string, error) {
+	_, base, objects, err := v.setupCommands(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var script []string
+	for _, command := range append(base, objects...) {
+		script = append(script, command.String())
+	}
+	return script, nil
+}
+
+// setupCommands builds the commands to overwrite the existing rules of the direction by the network options, the
+// commands of the HTB tree and the rule.
+func (v *tcShaper) setupCommands(opts *NetworkOptions) (*tcPlan, []*tcCommand, []*tcCommand, error) {
+	plan, err := buildTcPlan(opts, tcRuleMinor)
+	if err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "build plan")
+	}
+
+	base, err := v.createBase(plan)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	objects, err := v.commandsOf(plan.objects)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return plan, base, objects, nil
+}
+
+func (v *tcShaper) AddRule(ctx context.Context, rule *NetworkRule) error {
+	plan, err := buildTcPlan(rule.opts, rule.Slot)
+	if err != nil {
+		return errors.Wrapf(err, "build plan")
+	}
+
+	// Create the HTB tree of the direction, if it's the first rule.
+	var base []*tcCommand
+	if ok, err := v.hasRoot(ctx, plan.dev); err != nil {
+		return err
+	} else if !ok {
+		if base, err = v.createBase(plan); err != nil {
+			return err
+		}
+	}
+
+	objects, err := v.commandsOf(plan.objects)
+	if err != nil {
+		return err
+	}
+
+	segment := &tcScriptSegment{direction: rule.opts.direction, slot: rule.Slot}
+	if len(base) > 0 {
+		tree := &tcScriptSegment{direction: rule.opts.direction}
+		defer v.record(plan.iface, tree, segment)
+		if tree.commands, err = v.execute(ctx, base); err != nil {
+			return err
+		}
+	} else {
+		defer v.record(plan.iface, segment)
+	}
+
+	segment.commands, err = v.execute(ctx, objects)
+	return err
+}
+
+func (v *tcShaper) UpdateRule(ctx context.Context, rule *NetworkRule) error {
+	plan, err := buildTcPlan(rule.opts, rule.Slot)
+	if err != nil {
+		return errors.Wrapf(err, "build plan")
+	}
+
+	// Change the class and replace the netem in place, so the queue is not flushed. The filters are not changed.
+	var commands []*tcCommand
+	netem := false
+	for _, object := range plan.objects {
+		verb := "change"
+		switch object.(type) {
+		case *tcClass:
+		case *tcQdisc:
+			verb, netem = "replace", true
+		default:
+			continue
+		}
+
+		r0, err := tcCommandsOf(object)
+		if err != nil {
+			return err
+		}
+		r0[0].args[2] = verb
+		commands = append(commands, r0...)
+	}
+	if !netem {
+		commands = append(commands, &tcCommand{args: []string{
+			"tc", "qdisc", "del", "dev", plan.dev, "parent", tcHandleString(plan.ruleClass),
+			"handle", tcHandleString(tcHandle(rule.Slot, 0)),
+		}, ignoreError: true})
+	}
+
+	updates, err := v.execute(ctx, commands)
+	v.recordUpdates(plan.iface, rule.opts.direction, rule.Slot, updates)
+	return err
+}
+
+func (v *tcShaper) DeleteRule(ctx context.Context, rule *NetworkRule) error {
+	plan, err := buildTcPlan(rule.opts, rule.Slot)
+	if err != nil {
+		return errors.Wrapf(err, "build plan")
+	}
+
+	// Remove the filter before the class, because HTB refuses to delete the class in use. Ignore the error
+	// because the rule might be removed, for example, by reset.
+	var commands []*tcCommand
+	root := tcHandleString(tcHandle(tcRootMajor, 0))
+	for _, prio := range plan.rulePrios {
+		commands = append(commands, &tcCommand{
+			args: []string{"tc", "filter", "del", "dev", plan.dev, "parent", root, "prio", fmt.Sprintf("%v", prio)}, ignoreError: true,
+		})
+	}
+	commands = append(commands, &tcCommand{
+		args: []string{"tc", "class", "del", "dev", plan.dev, "classid", tcHandleString(plan.ruleClass)}, ignoreError: true,
+	})
+
+	if _, err := v.execute(ctx, commands); err != nil {
+		return err
+	}
+	v.record(plan.iface, &tcScriptSegment{direction: rule.opts.direction, slot: rule.Slot})
+	return nil
+}
+
+func (v *tcShaper) Query(ctx context.Context, iface string) (cmd, output string, err error) {
+	devs := []string{iface}
+	if ifb, err := tcIfbName(iface); err != nil {
+		return "", "", err
+	} else if _, err := net.InterfaceByName(ifb); err == nil {
+		devs = append(devs, ifb)
+	}
+
+	var cmds, outputs []string
+	for _, dev := range devs {
+		for _, args := range [][]string{
+			{"tc", "qdisc", "show", "dev", dev},
+			{"tc", "class", "show", "dev", dev},
+			{"tc", "filter", "show", "dev", dev},
+			{"tc", "filter", "show", "dev", dev, "parent", "ffff:"},
+		} {
+			b, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+			if err != nil {
+				return "", "", errors.Wrapf(err, "exec %v", strings.Join(args, " "))
+			}
+
+			cmds = append(cmds, strings.Join(args, " "))
+			if bs := strings.TrimSpace(string(b)); bs != "" {
+				outputs = append(outputs, tcDescribeFilters(bs))
+			}
+		}
+	}
+
+	logger.Tf(ctx, "tc query %v", strings.Join(cmds, "; "))
+	return strings.Join(cmds, "; "), strings.Join(outputs, "\n"), nil
+}
+
+func (v *tcShaper) Reset(ctx context.Context, iface string) error {
+	ifb, err := tcIfbName(iface)
+	if err != nil {
+		return err
+	}
+
+	commands := []*tcCommand{{args: []string{"tc", "qdisc", "del", "dev", iface, "root"}, ignoreError: true}}
+	commands = append(commands, v.deleteIngress(iface, ifb)...)
+
+	if _, err := v.execute(ctx, commands); err != nil {
+		return err
+	}
+	v.record(iface, &tcScriptSegment{direction: "outgoing"}, &tcScriptSegment{direction: "incoming"})
+	return nil
+}
+
+// Script returns the script of the iface, which is the commands it ran to build the HTB tree of each direction
+// and the rules, so it's replayable on a clean host.
+func (v *tcShaper) Script(iface string) []string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	script := []string{}
+	for _, segment := range v.scripts[iface] {
+		script = append(script, segment.commands...)
+		script = append(script, segment.updates...)
+	}
+	return script
+}
+
+// record replaces the segments of script of the iface with the same direction and slot, and the segment without
+// commands is removed. The segment of HTB tree replaces all segments of the direction, because it's recreated.
+func (v *tcShaper) record(iface string, segments ...*tcScriptSegment) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, segment := range segments {
+		var others []*tcScriptSegment
+		for _, s := range v.scripts[iface] {
+			if s.direction != segment.direction || (segment.slot != 0 && s.slot != segment.slot) {
+				others = append(others, s)
+			}
+		}
+		if len(segment.commands) > 0 {
+			others = append(others, segment)
+		}
+		v.scripts[iface] = others
+	}
+}
+
+// recordUpdates replaces the commands to update the rule in place, so the script keeps the last ones.
+func (v *tcShaper) recordUpdates(iface, direction string, slot uint16, updates []string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	segments := append([]*tcScriptSegment{}, v.scripts[iface]...)
+	for i, s := range segments {
+		if s.direction == direction && s.slot == slot {
+			segment := *s
+			segment.updates = updates
+			segments[i] = &segment
+			v.scripts[iface] = segments
+			return
+		}
+	}
+	v.scripts[iface] = append(segments, &tcScriptSegment{direction: direction, slot: slot, updates: updates})
+}
+
+// saveScripts returns the scripts of the ifaces, to restore them when the apply is rolled back.
+func (v *tcShaper) saveScripts(ifaces []string) map[string][]*tcScriptSegment {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	scripts := make(map[string][]*tcScriptSegment)
+	for _, iface := range ifaces {
+		scripts[iface] = v.scripts[iface]
+	}
+	return scripts
+}
+
+// restoreScripts restores the scripts saved before the apply.
+func (v *tcShaper) restoreScripts(scripts map[string][]*tcScriptSegment) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for iface, segments := range scripts {
+		v.scripts[iface] = segments
+	}
+}
+
+// createBase builds the commands to overwrite the existing rules of the direction, and create the HTB tree
+// shared by rules.
+func (v *tcShaper) createBase(plan *tcPlan) ([]*tcCommand, error) {
+	var commands []*tcCommand
+	if plan.ifb != "" {
+		commands = append(commands, v.deleteIngress(plan.iface, plan.ifb)...)
+	} else {
+		commands = append(commands, &tcCommand{args: []string{"tc", "qdisc", "del", "dev", plan.iface, "root"}, ignoreError: true})
+	}
+
+	if r0, err := v.commandsOf(plan.base); err != nil {
+		return nil, err
+	} else {
+		commands = append(commands, r0...)
+	}
+	return commands, nil
+}
+
+// commandsOf builds the commands to create the objects.
+func (v *tcShaper) commandsOf(objects []interface{}) ([]*tcCommand, error) {
+	var commands []*tcCommand
+	for _, object := range objects {
+		if r0, err := tcCommandsOf(object); err != nil {
+			return nil, err
+		} else {
+			commands = append(commands, r0...)
+		}
+	}
+	return commands, nil
+}
+
+// hasRoot whether the device has the HTB root qdisc created by us.
+func (v *tcShaper) hasRoot(ctx context.Context, dev string) (bool, error) {
+	if _, err := net.InterfaceByName(dev); err != nil {
+		return false, nil
+	}
+
+	args := []string{"tc", "qdisc", "show", "dev", dev, "root"}
+	b, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if err != nil {
+		return false, errors.Wrapf(err, "exec %v", strings.Join(args, " "))
+	}
+
+	root := fmt.Sprintf("qdisc htb %v root", tcHandleString(tcHandle(tcRootMajor, 0)))
+	return strings.HasPrefix(strings.TrimSpace(string(b)), root), nil
+}
+
+// deleteIngress removes the ingress qdisc of iface, and the ifb device.
+func (v *tcShaper) deleteIngress(iface, ifb string) []*tcCommand {
+	return []*tcCommand{
+		{args: []string{"tc", "qdisc", "del", "dev", iface, "ingress"}, ignoreError: true},
+		{args: []string{"ip", "link", "del", "dev", ifb}, ignoreError: true},
+	}
+}
+
+// execute runs the commands in order, and returns the commands which ran, even if failed, to record the script.
+func (v *tcShaper) execute(ctx context.Context, commands []*tcCommand) ([]string, error) {
+	var script []string
+	for _, command := range commands {
+		b, err := exec.CommandContext(ctx, command.args[0], command.args[1:]...).CombinedOutput()
+		if err != nil && !command.ignoreError {
+			return script, errors.Wrapf(err, "exec %v, %v", command.String(), strings.TrimSpace(string(b)))
+		}
+		logger.Tf(ctx, "exec %v, err=%v, %v", command.String(), err, strings.TrimSpace(string(b)))
+		script = append(script, command.String())
+	}
+	return script, nil
+}
+
+// tcCommand is a tc or ip command of script.
+type tcCommand struct {
+	args []string
+	// Whether ignore the error, for example, to delete the qdisc which might not exist.
+	ignoreError bool
+}
+
+func (v *tcCommand) String() string {
+	if v.ignoreError {
+		return fmt.Sprintf("%v || true", strings.Join(v.args, " "))
+	}
+	return strings.Join(v.args, " ")
+}
+
+// tcCommandsOf builds the tc or ip commands to create the object of plan.
+func tcCommandsOf(object interface{}) ([]*tcCommand, error) {
+	switch o := object.(type) {
+	case *tcLink:
+		return []*tcCommand{
+			{args: []string{"ip", "link", "add", "name", o.name, "type", o.kind}},
+			{args: []string{"ip", "link", "set", "dev", o.name, "up"}},
+		}, nil
+	case *tcQdisc:
+		args := []string{"tc", "qdisc", "add", "dev", o.dev}
+		if o.kind == "ingress" {
+			return []*tcCommand{{args: append(args, "ingress")}}, nil
+		}
+
+		if o.parent == tcHandleRoot {
+			args = append(args, "root")
+		} else {
+			args = append(args, "parent", tcHandleString(o.parent))
+		}
+		args = append(args, "handle", tcHandleString(o.handle), o.kind)
+
+		if o.kind == "htb" {
+			args = append(args, "default", fmt.Sprintf("%x", o.defaultMinor))
+		} else if o.kind == "netem" {
+			args = append(args, "limit", "1000")
+			args = append(args, tcNetemArgs(o.netem)...)
+		}
+		return []*tcCommand{{args: args}}, nil
+	case *tcClass:
+		return []*tcCommand{{args: []string{
+			"tc", "class", "add", "dev", o.dev, "parent", tcHandleString(o.parent),
+			"classid", tcHandleString(o.classid), "htb", "rate", tcFormatRate(o.rate), "ceil", tcFormatRate(o.ceil),
+		}}}, nil
+	case *tcFilter:
+		args := []string{
+			"tc", "filter", "add", "dev", o.dev, "parent", tcHandleString(o.parent),
+			"protocol", tcProtocolString(o.protocol), "prio", fmt.Sprintf("%v", o.prio), "u32",
+		}
+		args = append(args, strings.Split(tcFormatKeys(o.keys), " ")...)
+		args = append(args, "flowid", tcHandleString(o.flowid))
+		if o.redirect != "" {
+			args = append(args, "action", "mirred", "egress", "redirect", "dev", o.redirect)
+		}
+		return []*tcCommand{{args: args}}, nil
+	default:
+		return nil, errors.Errorf("invalid object %v", object)
+	}
+}
+
+// tcDescribeFilters appends the description after the match lines of tc filter show, for example:
+//
+//	filter parent 1a1a: protocol ip pref 2 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 flowid 1a1a:2
+//	match 00110000/00ff0000 at 8
+//	match 1f400000/ffff0000 at 20
+//	# match protocol udp sport 8000
+func tcDescribeFilters(output string) string {
+	var lines []string
+	var keys []tcU32Key
+	var protocol uint16
+	flush := func() {
+		if len(keys) > 0 {
+			lines = append(lines, fmt.Sprintf("  # match %v", tcDescribeKeys(protocol, keys)))
+			keys = nil
+		}
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		var key tcU32Key
+		if n, _ := fmt.Sscanf(strings.TrimSpace(line), "match %08x/%08x at %d", &key.val, &key.mask, &key.off); n == 3 {
+			keys = append(keys, key)
+		} else {
+			flush()
+		}
+
+		// The protocol of filter, for example, filter parent 1a1a: protocol ipv6 pref 4098 u32
+		if fields := strings.Fields(line); len(fields) > 4 && fields[0] == "filter" {
+			for i := 1; i < len(fields)-1; i++ {
+				if fields[i] == "protocol" && fields[i+1] == "ipv6" {
+					protocol = tcProtocolIPv6
+				} else if fields[i] == "protocol" {
+					protocol = tcProtocolIPv4
+				}
+			}
+		}
+		lines = append(lines, line)
+	}
+	flush()
+
+	return strings.Join(lines, "\n")
+}
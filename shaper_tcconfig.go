@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// tcconfigShaper applies the network options by tcset/tcshow/tcdel of tcconfig, see
+// https://github.com/thombashi/tcconfig
+type tcconfigShaper struct {
+}
+
+func (v *tcconfigShaper) Name() string {
+	return "tcconfig"
+}
+
+func (v *tcconfigShaper) Setup(ctx context.Context, opts *NetworkOptions) error {
+	// Overwrite existing traffic shaping rules.
+	return v.set(ctx, opts, "--overwrite")
+}
+
+func (v *tcconfigShaper) Plan(ctx context.Context, opts *NetworkOptions) ([]string, error) {
+	// The filters of tcset are recreated for the protocol after it runs, by the handles and keys allocated by it, so
+	// the operations are unknown before apply.
+	if tcIPProtocolOf(opts.protocol) != 0 {
+		return nil, errors.Errorf("tcconfig can't plan protocol=%v, please use TC_SHAPER=tc or netlink", opts.protocol)
+	}
+
+	commands, err := v.setArgs(opts, "--overwrite")
+	if err != nil {
+		return nil, err
+	}
+
+	var script []string
+	for _, args := range commands {
+		script = append(script, fmt.Sprintf("tcset %v", strings.Join(args, " ")))
+	}
+	return script, nil
+}
+
+func (v *tcconfigShaper) AddRule(ctx context.Context, rule *NetworkRule) error {
+	// Add the rule besides the existing rules, and tcset allocates the class for it.
+	return v.set(ctx, rule.opts, "--add")
+}
+
+func (v *tcconfigShaper) UpdateRule(ctx context.Context, rule *NetworkRule) error {
+	// Change the existing rule which matches the filter.
+	return v.set(ctx, rule.opts, "--change")
+}
+
+func (v *tcconfigShaper) DeleteRule(ctx context.Context, rule *NetworkRule) error {
+	values, err := v.identifyValues(rule.opts)
+	if err != nil {
+		return err
+	}
+
+	// The tcdel removes the rule which matches the filter, one for each value.
+	for _, value := range values {
+		args := append(v.filterArgs(rule.opts, value), rule.opts.iface)
+		if err := v.execute(ctx, "tcdel", args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set runs tcset for the network options, the mode is --overwrite, --add or --change.
+func (v *tcconfigShaper) set(ctx context.Context, opts *NetworkOptions, mode string) error {
+	commands, err := v.setArgs(opts, mode)
+	if err != nil {
+		return err
+	}
+
+	protocol := tcIPProtocolOf(opts.protocol)
+	for _, args := range commands {
+		// The filters before tcset, to find the ones created by it. For overwrite, all filters are of the rule.
+		var previous []*tcconfigFilter
+		if protocol != 0 && args[0] != "--overwrite" {
+			if previous, err = tcconfigFilters(opts.iface, opts.direction); err != nil {
+				return errors.Wrapf(err, "query filters of %v", opts.iface)
+			}
+		}
+
+		if err := v.execute(ctx, "tcset", args); err != nil {
+			return err
+		}
+
+		// The tcset doesn't filter by protocol, so restrict the filters it created.
+		if protocol != 0 {
+			if err := v.restrictProtocol(ctx, opts, protocol, previous); err != nil {
+				return errors.Wrapf(err, "restrict protocol=%v", opts.protocol)
+			}
+		}
+	}
+	return nil
+}
+
+// tcconfigFilter is a u32 filter of the htb qdisc created by tcset.
+type tcconfigFilter struct {
+	dev    string
+	filter *HostFilter
+	// The identity of filter, by the dev, handle, keys and flowid.
+	id string
+}
+
+// tcconfigFilters returns the u32 filters which classify the packets to the classes of tcset, on the interface for
+// outgoing, or on the ifb device redirected to for incoming. The filters to the default class, which are the
+// excluded API port, are ignored.
+func tcconfigFilters(iface, direction string) ([]*tcconfigFilter, error) {
+	conn, err := nlDial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	interfaces, err := (&ruleManager{}).captureHost(conn, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	devs := map[string]bool{iface: direction == "outgoing"}
+	for _, dev := range interfaces {
+		for _, f := range dev.Filters {
+			if dev.Name == iface && f.Redirect != "" && direction == "incoming" {
+				devs[f.Redirect] = true
+			}
+		}
+	}
+
+	var filters []*tcconfigFilter
+	for _, dev := range interfaces {
+		if !devs[dev.Name] {
+			continue
+		}
+
+		defaults := make(map[string]bool)
+		for _, q := range dev.Qdiscs {
+			if handle, err := tcParseHandle(q.Handle); err == nil && q.Kind == "htb" {
+				defaults[tcHandleString(handle|uint32(q.Default))] = true
+			}
+		}
+
+		for _, f := range dev.Filters {
+			if f.Kind != "u32" || f.Unsupported != "" || f.Redirect != "" || f.Flowid == "" || defaults[f.Flowid] {
+				continue
+			}
+
+			keys, _ := json.Marshal(f.Keys)
+			filters = append(filters, &tcconfigFilter{
+				dev: dev.Name, filter: f, id: fmt.Sprintf("%v %v %v %v", dev.Name, f.Handle, string(keys), f.Flowid),
+			})
+		}
+	}
+	return filters, nil
+}
+
+// restrictProtocol restricts the filters created by tcset to the IP protocol. For each filter not in previous, a
+// filter with the key of protocol is created in the same priority by netlink, then the filter of tcset is removed,
+// so the packets of the protocol are always matched.
+func (v *tcconfigShaper) restrictProtocol(ctx context.Context, opts *NetworkOptions, protocol uint8, previous []*tcconfigFilter) error {
+	filters, err := tcconfigFilters(opts.iface, opts.direction)
+	if err != nil {
+		return errors.Wrapf(err, "query filters of %v", opts.iface)
+	}
+
+	existing := make(map[string]bool)
+	for _, f := range previous {
+		existing[f.id] = true
+	}
+
+	conn, err := nlDial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, f := range filters {
+		if existing[f.id] {
+			continue
+		}
+
+		o, err := f.filter.filter(f.dev)
+		if err != nil {
+			return err
+		}
+
+		ipv6 := o.protocol == tcProtocolIPv6
+		key := tcU32IPProtocol(ipv6, protocol)
+		if ipv6 && protocol == tcIPProtocolICMP {
+			key = tcU32IPProtocol(ipv6, tcIPProtocolICMPv6)
+		}
+
+		restricted := false
+		for _, k := range o.keys {
+			restricted = restricted || k == key
+		}
+		if restricted {
+			continue
+		}
+
+		ifi, err := net.InterfaceByName(f.dev)
+		if err != nil {
+			return errors.Wrapf(err, "query iface %v", f.dev)
+		}
+
+		// The kernel allocates a new handle for the restricted filter, which is after the filter of tcset.
+		restrictedFilter := *o
+		restrictedFilter.keys = append([]tcU32Key{key}, o.keys...)
+		if err := (&netlinkShaper{}).create(conn, &restrictedFilter); err != nil {
+			return err
+		}
+
+		info := uint32(o.prio)<<16 | uint32(nlHtons(o.protocol))
+		payload := nlConcat(nlTcmsg(ifi.Index, f.filter.handle, o.parent, info), nlString(tcaKind, "u32"))
+		if _, err := conn.Execute(rtmDelTFilter, 0, payload); err != nil {
+			return errors.Wrapf(err, "delete filter %v prio %v of %v", f.filter.Handle, o.prio, f.dev)
+		}
+		logger.Tf(ctx, "tcconfig restrict filter %v prio %v of %v to %v",
+			f.filter.Handle, o.prio, f.dev, tcIPProtocolString(protocol))
+	}
+	return nil
+}
+
+// setArgs builds the args of each tcset to run for the network options, in order.
+func (v *tcconfigShaper) setArgs(opts *NetworkOptions, mode string) ([][]string, error) {
+	values, err := v.identifyValues(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The tcset accepts one port or network, so we set each value as a rule, the first one in the mode, and
+	// others are added to it, except for change which changes each rule.
+	var commands [][]string
+	for i, value := range values {
+		if i > 0 && mode == "--overwrite" {
+			mode = "--add"
+		}
+		if args, err := v.valueArgs(opts, mode, value); err != nil {
+			return nil, err
+		} else {
+			commands = append(commands, args)
+		}
+	}
+	return commands, nil
+}
+
+// valueArgs builds the args of tcset for the network options, with one value of filter.
+func (v *tcconfigShaper) valueArgs(opts *NetworkOptions, mode, value string) ([]string, error) {
+	// Format the shaping algorithm. We use HTB which doesn't require iptables.
+	args := []string{
+		mode,
+		// Use HTB which doesn't require iptables.
+		"--shaping-algo", "htb",
+	}
+
+	// Exclude the API port, which is the source port for outgoing, or dest port for incoming.
+	if opts.direction == "outgoing" {
+		args = append(args, "--exclude-src-port", opts.apiPort)
+	} else if opts.direction == "incoming" {
+		args = append(args, "--exclude-dst-port", opts.apiPort)
+	}
+	args = append(args, v.filterArgs(opts, value)...)
+
+	for _, strategy := range opts.strategies {
+		params, err := tcconfigStrategyParams(strategy)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(params); i += 2 {
+			args = append(args, "--"+params[i], params[i+1])
+		}
+	}
+
+	return append(args, opts.iface), nil
+}
+
+func (v *tcconfigShaper) Query(ctx context.Context, iface string) (cmd, output string, err error) {
+	args := []string{iface}
+	if b, err := exec.CommandContext(ctx, "tcshow", args...).Output(); err != nil {
+		return "", "", errors.Wrapf(err, "exec tcshow %v", strings.Join(args, " "))
+	} else {
+		logger.Tf(ctx, "tcshow %v", strings.Join(args, " "))
+		output = strings.TrimSpace(string(b))
+	}
+	return strings.Join(append([]string{"tcshow"}, args...), " "), output, nil
+}
+
+func (v *tcconfigShaper) Reset(ctx context.Context, iface string) error {
+	return v.execute(ctx, "tcdel", []string{"--all", iface})
+}
+
+// identifyValues splits the identifyValue to the values for tcset, which doesn't support port range.
+func (v *tcconfigShaper) identifyValues(opts *NetworkOptions) ([]string, error) {
+	if opts.identifyKey == "all" {
+		return []string{""}, nil
+	}
+
+	var values []string
+	for _, value := range strings.Split(opts.identifyValue, ",") {
+		if value = strings.TrimSpace(value); opts.identifyKey != "clientIp" && strings.Contains(value, "-") {
+			return nil, errors.Errorf("tcconfig doesn't support port range %v, please use TC_SHAPER=tc or netlink", value)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// filterArgs builds the args of tcset or tcdel, for the direction and filter with the value.
+func (v *tcconfigShaper) filterArgs(opts *NetworkOptions, value string) []string {
+	args := []string{"--direction", opts.direction}
+	if key := tcconfigFilterKey(opts); key != "" {
+		args = append(args, "--"+key, value)
+	}
+
+	// The tcset applies to IPv4 by default, so we must enable it for IPv6 clientIp.
+	if opts.identifyKey == "clientIp" {
+		if ipnet, err := parseClientIP(value); err == nil && ipnet.IP.To4() == nil {
+			args = append(args, "--ipv6")
+		}
+	}
+
+	return args
+}
+
+// execute runs the tcset or tcdel, and checks the output for errors, because they might succeed with
+// errors in output.
+func (v *tcconfigShaper) execute(ctx context.Context, name string, args []string) error {
+	if b, err := exec.CommandContext(ctx, name, args...).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "%v %v", name, strings.Join(args, " "))
+	} else if bs := string(b); len(bs) > 0 {
+		nnErrors := strings.Count(bs, "ERROR")
+
+		// Ignore the error because it always happens:
+		// 		tc qdisc del dev lo ingress
+		// 		Error: Invalid handle.
+		isIngressDel := strings.Contains(bs, "ingress") && strings.Contains(bs, "qdisc del")
+		canIgnore := nnErrors == 1 && isIngressDel
+
+		if nnErrors > 0 && !canIgnore {
+			return errors.Errorf("%v %v, %v", name, strings.Join(args, " "), bs)
+		}
+		logger.Tf(ctx, "%v %v, error=%v, ingress=%v, ignore=%v, %v",
+			name, strings.Join(args, " "), nnErrors, isIngressDel, canIgnore, bs)
+	} else {
+		logger.Tf(ctx, "%v %v", name, strings.Join(args, " "))
+	}
+	return nil
+}
+
+// tcconfigFilterKey returns the filter of tcset for the identifyKey in the direction, or empty for all. For
+// direction outgoing, client pull stream from server, while for incoming, client push stream to server.
+func tcconfigFilterKey(opts *NetworkOptions) string {
+	if opts.direction == "outgoing" {
+		switch opts.identifyKey {
+		case "serverPort":
+			return "src-port"
+		case "clientIp":
+			return "dst-network"
+		case "clientPort":
+			return "dst-port"
+		}
+	} else if opts.direction == "incoming" {
+		switch opts.identifyKey {
+		case "serverPort":
+			return "dst-port"
+		case "clientIp":
+			return "src-network"
+		case "clientPort":
+			return "src-port"
+		}
+	}
+	return ""
+}
+
+// tcconfigStrategyParams returns the pairs of tcset parameter and value for the strategy, for example, loss
+// and 5%, which is also the key and value in the setting of tcconfig.
+func tcconfigStrategyParams(strategy *NetworkStrategy) ([]string, error) {
+	// The tcset only supports random loss, no loss model.
+	if strategy.Strategy == "lossState" || strategy.Strategy == "lossGemodel" {
+		return nil, errors.Errorf("tcconfig doesn't support %v, please use TC_SHAPER=tc or netlink", strategy)
+	}
+
+	// The tcset doesn't support correlation and gap.
+	if strategy.LossCorrelation > 0 || strategy.DelayCorrelation > 0 || strategy.DuplicateCorrelation > 0 ||
+		strategy.CorruptCorrelation > 0 || strategy.ReorderCorrelation > 0 || strategy.Gap > 0 {
+		return nil, errors.Errorf("tcconfig doesn't support correlation or gap, %v, please use TC_SHAPER=tc or netlink", strategy)
+	}
+
+	// Format the network strategy, that is, loss, delay, rate.
+	var params []string
+	if strategy.Strategy == "loss" {
+		params = append(params, "loss", fmt.Sprintf("%v%%", strategy.Loss))
+	} else if strategy.Strategy == "delay" {
+		params = append(params, "delay", fmt.Sprintf("%vms", strategy.Delay))
+		if strategy.DelayDistro > 0 {
+			params = append(params, "delay-distro", fmt.Sprintf("%vms", strategy.DelayDistro))
+		}
+		if strategy.Distribution != "" {
+			params = append(params, "delay-distribution", strategy.Distribution)
+		}
+	} else if strategy.Strategy == "rate" {
+		// Note that tc is in kbit, while tcset is in kbps.
+		params = append(params, "rate", fmt.Sprintf("%vkbps", strategy.Rate))
+	} else if strategy.Strategy == "duplicate" {
+		params = append(params, "duplicate", fmt.Sprintf("%v%%", strategy.Duplicate))
+	} else if strategy.Strategy == "corrupt" {
+		params = append(params, "corrupt", fmt.Sprintf("%v%%", strategy.Corrupt))
+	} else if strategy.Strategy == "reorder" {
+		params = append(params, "reordering", fmt.Sprintf("%v%%", strategy.Reorder))
+	}
+	return params, nil
+}
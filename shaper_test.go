@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTcPortRangeBlocks(t *testing.T) {
+	for _, c := range []struct {
+		r             tcPortRange
+		values, masks []uint16
+	}{
+		{tcPortRange{8000, 8000}, []uint16{8000}, []uint16{0xffff}},
+		{tcPortRange{8000, 8003}, []uint16{8000}, []uint16{0xfffc}},
+		{tcPortRange{8001, 8004}, []uint16{8001, 8002, 8004}, []uint16{0xffff, 0xfffe, 0xffff}},
+		{tcPortRange{0, 65535}, []uint16{0}, []uint16{0}},
+		{tcPortRange{65535, 65535}, []uint16{65535}, []uint16{0xffff}},
+		{tcPortRange{65534, 65535}, []uint16{65534}, []uint16{0xfffe}},
+		{tcPortRange{1024, 65535}, []uint16{1024, 2048, 4096, 8192, 16384, 32768},
+			[]uint16{0xfc00, 0xf800, 0xf000, 0xe000, 0xc000, 0x8000},
+		},
+	} {
+		values, masks := c.r.Blocks()
+		if !reflect.DeepEqual(values, c.values) || !reflect.DeepEqual(masks, c.masks) {
+			t.Errorf("%v: expect %v/%x, actual %v/%x", c.r, c.values, c.masks, values, masks)
+		}
+	}
+}
+
+func TestTcPortRangeBlocksCover(t *testing.T) {
+	// The blocks should cover exactly the ports of range, without overlap.
+	for _, r := range []tcPortRange{{1, 1000}, {8000, 9000}, {10000, 20000}, {12345, 54321}, {1, 65534}} {
+		covered := make(map[uint32]bool)
+		values, masks := r.Blocks()
+		for i, value := range values {
+			size := uint32(^masks[i]) + 1
+			for port := uint32(value); port < uint32(value)+size; port++ {
+				if covered[port] {
+					t.Errorf("%v: port %v overlaps", r, port)
+				}
+				covered[port] = true
+			}
+		}
+
+		for port := uint32(0); port <= 65535; port++ {
+			if expected := port >= uint32(r.from) && port <= uint32(r.to); covered[port] != expected {
+				t.Errorf("%v: port %v expect %v, actual %v", r, port, expected, covered[port])
+				break
+			}
+		}
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	for _, c := range []struct {
+		value    string
+		expected []tcPortRange
+	}{
+		{"8000", []tcPortRange{{8000, 8000}}},
+		{"8000,9000", []tcPortRange{{8000, 8000}, {9000, 9000}}},
+		{"10000-20000", []tcPortRange{{10000, 20000}}},
+		{" 8000 , 10000 - 20000 ", []tcPortRange{{8000, 8000}, {10000, 20000}}},
+		{"0-65535", []tcPortRange{{0, 65535}}},
+		{"9000-9000", []tcPortRange{{9000, 9000}}},
+	} {
+		if ranges, err := parsePortRanges(c.value); err != nil {
+			t.Errorf("%v: err %+v", c.value, err)
+		} else if !reflect.DeepEqual(ranges, c.expected) {
+			t.Errorf("%v: expect %v, actual %v", c.value, c.expected, ranges)
+		}
+	}
+}
+
+func TestParsePortRangesError(t *testing.T) {
+	var ports []string
+	for i := 0; i <= tcMaxFilterAlternatives; i++ {
+		ports = append(ports, fmt.Sprintf("%v", 1000+2*i))
+	}
+
+	for _, value := range []string{
+		"", "port", "-1", "65536", "8000,", "9000-8000", "8000-", "-8000", "8000-9000-10000",
+		// Too many ports, each is a block.
+		strings.Join(ports, ","),
+	} {
+		if ranges, err := parsePortRanges(value); err == nil {
+			t.Errorf("%v: expect error, actual %v", value, ranges)
+		}
+	}
+}
+
+func TestParseClientIPs(t *testing.T) {
+	for _, c := range []struct {
+		value    string
+		expected []string
+	}{
+		{"10.0.0.1", []string{"10.0.0.1/32"}},
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}},
+		{"10.1.2.3/8", []string{"10.0.0.0/8"}},
+		{"2001:db8::1", []string{"2001:db8::1/128"}},
+		{"2001:db8::/32", []string{"2001:db8::/32"}},
+		{"10.0.0.0/24, 2001:db8::1,192.168.1.1", []string{"10.0.0.0/24", "2001:db8::1/128", "192.168.1.1/32"}},
+	} {
+		ipnets, err := parseClientIPs(c.value)
+		if err != nil {
+			t.Errorf("%v: err %+v", c.value, err)
+			continue
+		}
+
+		var actual []string
+		for _, ipnet := range ipnets {
+			actual = append(actual, ipnet.String())
+		}
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%v: expect %v, actual %v", c.value, c.expected, actual)
+		}
+	}
+
+	// The IPv4 is always in 4 bytes, to build the keys of IPv4 header.
+	if ipnets, err := parseClientIPs("10.0.0.1"); err != nil || len(ipnets[0].IP) != 4 {
+		t.Errorf("expect IPv4 in 4 bytes, actual %v, err %v", ipnets, err)
+	}
+}
+
+func TestParseClientIPsError(t *testing.T) {
+	var ips []string
+	for i := 0; i <= tcMaxFilterAlternatives; i++ {
+		ips = append(ips, fmt.Sprintf("10.0.%v.%v", i/256, i%256))
+	}
+
+	for _, value := range []string{
+		"", "host", "10.0.0", "10.0.0.256", "10.0.0.0/33", "2001:db8::/129", "10.0.0.1,", "10.0.0.1;10.0.0.2",
+		strings.Join(ips, ","),
+	} {
+		if ipnets, err := parseClientIPs(value); err == nil {
+			t.Errorf("%v: expect error, actual %v", value, ipnets)
+		}
+	}
+}
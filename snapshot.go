@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"net/http"
+	"strings"
+)
+
+// NetworkSnapshot is the kernel state of interfaces before apply, to restore it if the apply fails halfway.
+type NetworkSnapshot struct {
+	Ifaces []string
+	// The qdiscs, classes and filters of the interfaces, and the ifb devices of them, to rebuild and verify.
+	interfaces []*HostInterface
+	// The ifb devices before apply, the ones created by apply are removed when restore.
+	ifbs map[string]bool
+}
+
+// NetworkRollback is the result of rollback, after the apply fails.
+type NetworkRollback struct {
+	// Whether rollback happened, false if the apply fails before changing the interfaces.
+	RolledBack bool `json:"rolledBack"`
+	// Whether all the interfaces are restored to the snapshot.
+	Restored bool `json:"restored"`
+	// The error of rollback, if not restored.
+	Error string `json:"error,omitempty"`
+}
+
+// NetworkApplyError is the error of apply, with the result of rollback.
+type NetworkApplyError struct {
+	Err      error
+	Rollback *NetworkRollback
+}
+
+func (v *NetworkApplyError) Error() string {
+	if !v.Rollback.RolledBack {
+		return v.Err.Error()
+	} else if v.Rollback.Restored {
+		return fmt.Sprintf("%v, rollback ok", v.Err.Error())
+	}
+	return fmt.Sprintf("%v, rollback failed %v", v.Err.Error(), v.Rollback.Error)
+}
+
+// transact snapshots the interfaces, and applies the change. If the apply fails, the interfaces are restored
+// to the snapshots, and the error is NetworkApplyError with the result of rollback. Nothing is applied if the os
+// is darwin. The caller should hold the lock.
+func (v *ruleManager) transact(ctx context.Context, ifaces []string, apply func() error) error {
+	if isDarwin {
+		logger.Tf(ctx, "Darwin: Ignore apply for ifaces=%v", ifaces)
+		return nil
+	}
+
+	conn, err := nlDial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	snapshot, err := v.snapshot(conn, ifaces)
+	if err != nil {
+		return errors.Wrapf(err, "snapshot %v", ifaces)
+	}
+
+	// The script recorded by the tc shaper is restored with the interfaces.
+	scripter, ok := shaper.(*tcShaper)
+	var scripts map[string][]*tcScriptSegment
+	if ok {
+		scripts = scripter.saveScripts(ifaces)
+	}
+
+	err = apply()
+	if err == nil {
+		return nil
+	}
+
+	rollback := &NetworkRollback{RolledBack: true, Restored: true}
+	if r0 := v.restore(ctx, conn, snapshot); r0 != nil {
+		rollback.Restored, rollback.Error = false, r0.Error()
+	}
+	if ok {
+		scripter.restoreScripts(scripts)
+	}
+
+	logger.Wf(ctx, "Rollback ifaces=%v, restored=%v, err %v", ifaces, rollback.Restored, err)
+	return &NetworkApplyError{Err: err, Rollback: rollback}
+}
+
+// snapshot captures the qdiscs, classes and filters of the interfaces and their ifb devices by netlink, whatever the
+// shaper is. The caller should hold the lock.
+func (v *ruleManager) snapshot(conn *nlConn, ifaces []string) (*NetworkSnapshot, error) {
+	captured, all, err := v.captureIfaces(conn, ifaces)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &NetworkSnapshot{Ifaces: ifaces, interfaces: captured, ifbs: make(map[string]bool)}
+	for _, iface := range all {
+		if iface.Kind == "ifb" {
+			snapshot.ifbs[iface.Name] = true
+		}
+	}
+	return snapshot, nil
+}
+
+// restore removes the ifb devices created by apply, rebuilds the objects of snapshot, and verifies the state is the
+// same as the snapshot. The caller should hold the lock.
+func (v *ruleManager) restore(ctx context.Context, conn *nlConn, snapshot *NetworkSnapshot) error {
+	// The interface with objects which can't be rebuilt is cleared, rather than left half applied.
+	objects := make(map[string][]interface{})
+	var unsupported []string
+	for _, iface := range snapshot.interfaces {
+		if r0 := iface.Unsupported(); len(r0) > 0 {
+			unsupported = append(unsupported, fmt.Sprintf("%v of %v", strings.Join(r0, ", "), iface.Name))
+			continue
+		}
+
+		r0, err := iface.objects()
+		if err != nil {
+			return errors.Wrapf(err, "restore %v", iface.Name)
+		}
+		objects[iface.Name] = r0
+	}
+
+	links, err := dumpHostLinks(conn)
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		if link.kind == "ifb" && !snapshot.ifbs[link.name] {
+			if _, err := conn.Execute(rtmDelLink, 0, nlIfinfomsg(link.index, 0, 0)); err != nil {
+				return errors.Wrapf(err, "delete link %v", link.name)
+			}
+		}
+	}
+
+	if err := v.rebuildHost(ctx, conn, snapshot.interfaces, objects); err != nil {
+		return errors.Wrapf(err, "restore %v", snapshot.Ifaces)
+	}
+	if len(unsupported) > 0 {
+		return errors.Errorf("can't restore %v, cleared", strings.Join(unsupported, "; "))
+	}
+	return v.verifyHost(conn, snapshot.interfaces)
+}
+
+// writeApplyError responses the error of apply with the result of rollback, for example:
+//
+//	{"code":100,"data":{"error":"...","rollback":{"rolledBack":true,"restored":true}}}
+//
+// Other errors, for example, invalid request, are responsed by ohttp.WriteError as before.
+func writeApplyError(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	ae, ok := errors.Cause(err).(*NetworkApplyError)
+	if !ok {
+		ohttp.WriteError(ctx, w, r, err)
+		return
+	}
+
+	logger.Ef(ctx, "Serve %v failed, err is %+v", r.URL, err)
+	b, r0 := json.Marshal(&struct {
+		Code int         `json:"code"`
+		Data interface{} `json:"data"`
+	}{
+		Code: 100, Data: &struct {
+			Error    string           `json:"error"`
+			Rollback *NetworkRollback `json:"rollback"`
+		}{
+			Error: err.Error(), Rollback: ae.Rollback,
+		},
+	})
+	if r0 != nil {
+		ohttp.WriteError(ctx, w, r, r0)
+		return
+	}
+
+	ohttp.SetHeader(w)
+	w.Header().Set("Content-Type", ohttp.HttpJson)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(b)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// storeFile returns the path of file in the data directory, which is configured by env TC_DATA_DIR.
+func storeFile(name string) string {
+	return path.Join(os.Getenv("TC_DATA_DIR"), name)
+}
+
+// saveJSON writes the object as JSON to the file in data directory, by a temporary file and rename, so the file
+// is never half-written.
+func saveJSON(name string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "marshal %v", name)
+	}
+
+	if err := os.MkdirAll(os.Getenv("TC_DATA_DIR"), 0755); err != nil {
+		return errors.Wrapf(err, "create dir %v", os.Getenv("TC_DATA_DIR"))
+	}
+
+	filename := storeFile(name)
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return errors.Wrapf(err, "write %v", tmp)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return errors.Wrapf(err, "rename %v to %v", tmp, filename)
+	}
+	return nil
+}
+
+// loadJSON reads the object from the file in data directory, and returns false if the file doesn't exist.
+func loadJSON(name string, v interface{}) (bool, error) {
+	filename := storeFile(name)
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrapf(err, "read %v", filename)
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, errors.Wrapf(err, "parse %v", filename)
+	}
+	return true, nil
+}
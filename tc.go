@@ -12,12 +12,14 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
 	"os/exec"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,73 +32,173 @@ func init() {
 }
 
 func ScanByTcpdump(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	scan, err := parseTcpdumpScan(r)
+	if err != nil {
+		return err
+	}
+
+	ctx = logger.WithContext(context.Background())
+	logger.Tf(ctx, "Scan start, %v", scan)
+
+	summary := NewTcpdumpSummary()
+	var lock sync.Mutex
+	if err := scan.Run(ctx, func(l *TcpdumpLog) {
+		lock.Lock()
+		defer lock.Unlock()
+		summary.OnPacket(l)
+	}); err != nil {
+		return err
+	}
+
+	summary.Sort()
+	logger.Tf(ctx, "Scan ok, ifaces=%v, %v", scan.captures, summary.String())
+	ohttp.WriteData(ctx, w, r, summary)
+	return nil
+}
+
+// tcpdumpScan is the request of scan, to capture the interfaces by tcpdump in timeout.
+type tcpdumpScan struct {
+	// The interfaces to capture, or any for all interfaces.
+	captures []string
+	// The filter expression of tcpdump.
+	exp string
+	// The timeout to stop the capture, at most 60s.
+	timeout time.Duration
+}
+
+func (v *tcpdumpScan) String() string {
+	return fmt.Sprintf("ifaces=%v, timeout=%v, exp=%v", v.captures, v.timeout, v.exp)
+}
+
+// parseTcpdumpScan parses the scan request from query, the ifaces, timeout in seconds and exp.
+func parseTcpdumpScan(r *http.Request) (*tcpdumpScan, error) {
 	q := r.URL.Query()
 	ifaces, timeout, exp := q.Get("ifaces"), q.Get("timeout"), q.Get("exp")
 	if ifaces == "" {
-		return errors.Errorf("no iface, url=%v", r.RequestURI)
-	}
-	if strings.Contains(ifaces, ",") {
-		return errors.Errorf("only support single interface, ifaces=%v", ifaces)
+		return nil, errors.Errorf("no iface, url=%v", r.RequestURI)
 	}
 	if timeout == "" {
-		return errors.Errorf("no timeout, url=%v", r.RequestURI)
+		return nil, errors.Errorf("no timeout, url=%v", r.RequestURI)
 	}
 	if exp == "" {
-		exp = "ip"
+		exp = "ip or ip6"
+	}
+
+	captures, err := parseScanInterfaces(ifaces)
+	if err != nil {
+		return nil, err
 	}
 
 	var to time.Duration
 	if tov, err := strconv.ParseInt(timeout, 10, 64); err != nil {
-		return errors.Wrapf(err, "parse timeout=%v", timeout)
+		return nil, errors.Wrapf(err, "parse timeout=%v", timeout)
 	} else {
 		to = time.Duration(tov) * time.Second
 	}
 
 	if to <= time.Duration(0) {
-		return errors.Errorf("invalid timeout=%v, should >0s", timeout)
+		return nil, errors.Errorf("invalid timeout=%v, should >0s", timeout)
 	}
 	if to > time.Duration(60)*time.Second {
-		return errors.Errorf("invalid timeout=%v, should <=60s", timeout)
+		return nil, errors.Errorf("invalid timeout=%v, should <=60s", timeout)
 	}
 
-	ctx, cancel := context.WithCancel(logger.WithContext(context.Background()))
+	return &tcpdumpScan{captures: captures, exp: exp, timeout: to}, nil
+}
+
+// Run runs a tcpdump for each interface, until timeout or the context is done. The packets are passed to
+// onPacket, which is called concurrently by the tcpdumps. If any tcpdump fails, all the others are canceled.
+func (v *tcpdumpScan) Run(ctx context.Context, onPacket func(l *TcpdumpLog)) error {
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	logger.Tf(ctx, "Scan start, ifaces=%v, timeout=%v, exp=%v", ifaces, to, exp)
 
 	go func() {
 		select {
 		case <-ctx.Done():
-		case <-time.After(to):
-			logger.Tf(ctx, "Scan finished for to=%v", to)
+		case <-time.After(v.timeout):
+			logger.Tf(ctx, "Scan finished for to=%v", v.timeout)
 			cancel()
 		}
 	}()
 
+	var wg sync.WaitGroup
+	errs := make([]error, len(v.captures))
+	for i, capture := range v.captures {
+		wg.Add(1)
+		go func(i int, capture string) {
+			defer wg.Done()
+
+			if errs[i] = scanTcpdump(ctx, capture, v.exp, onPacket); errs[i] != nil {
+				cancel()
+			}
+		}(i, capture)
+	}
+	wg.Wait()
+	logger.Tf(ctx, "Scan finished")
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseScanInterfaces parses the comma-separated interfaces to capture, or any for all interfaces, which should
+// not be used with others, because the packets would be captured twice.
+func parseScanInterfaces(ifaces string) ([]string, error) {
+	var captures []string
+	visited := make(map[string]bool)
+	for _, iface := range strings.Split(ifaces, ",") {
+		if iface = strings.TrimSpace(iface); iface == "" || visited[iface] {
+			continue
+		}
+		visited[iface] = true
+
+		if iface != "any" {
+			if _, err := net.InterfaceByName(iface); err != nil {
+				return nil, errors.Wrapf(err, "query iface %v", iface)
+			}
+		}
+		captures = append(captures, iface)
+	}
+
+	if len(captures) == 0 {
+		return nil, errors.Errorf("no iface, ifaces=%v", ifaces)
+	}
+	if visited["any"] && len(captures) > 1 {
+		return nil, errors.Errorf("any should not be used with other interfaces, ifaces=%v", ifaces)
+	}
+	return captures, nil
+}
+
+// scanTcpdump captures the packets of the interface by tcpdump, until the context is done. The packet is
+// attributed to the interface, or the interface in line for any.
+func scanTcpdump(ctx context.Context, iface, exp string, onPacket func(l *TcpdumpLog)) error {
 	// -i interface
 	// -n     Don't convert addresses (i.e., host addresses, port numbers, etc.) to names.
 	// -tt    Print the timestamp, as seconds since January 1, 1970, 00:00:00, UTC, and fractions of a second since that time, on each dump line.
-	args := []string{"-i", ifaces, "-n", "-tt", "--immediate-mode", "-l", exp}
+	args := []string{"-i", iface, "-n", "-tt", "--immediate-mode", "-l", exp}
 	cmd := exec.CommandContext(context.Background(), "tcpdump", args...)
 	logger.Tf(ctx, "tcpdump %v", strings.Join(args, " "))
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return errors.Wrapf(err, "pipe stdout")
+		return errors.Wrapf(err, "pipe stdout of %v", iface)
 	}
 	defer stdout.Close()
 
 	if err := cmd.Start(); err != nil {
-		return errors.Wrapf(err, "start")
+		return errors.Wrapf(err, "start tcpdump of %v", iface)
 	}
 
 	go func() {
 		// Kill process if context is canceled
 		<-ctx.Done()
 		cmd.Process.Kill()
-		logger.Tf(ctx, "Scan canceled, kill tcpdump %v", cmd.Process.Pid)
+		logger.Tf(ctx, "Scan canceled, kill tcpdump %v of %v", cmd.Process.Pid, iface)
 	}()
 
-	summary := NewTcpdumpSummary()
 	if s := bufio.NewScanner(stdout); true {
 		for s.Scan() {
 			line := s.Text()
@@ -104,134 +206,206 @@ func ScanByTcpdump(ctx context.Context, w http.ResponseWriter, r *http.Request)
 			if !ok {
 				continue
 			}
-			summary.OnPacket(l)
+			if iface != "any" {
+				l.Interface = iface
+			}
+			onPacket(l)
 		}
 	}
-	logger.Tf(ctx, "Scan finished")
 
 	if err := cmd.Wait(); err != nil {
 		if ctx.Err() != context.Canceled {
-			return errors.Wrapf(err, "wait cmd ctx=%v", ctx.Err())
+			return errors.Wrapf(err, "wait tcpdump of %v ctx=%v", iface, ctx.Err())
 		}
 	}
+	return nil
+}
 
-	for _, iface := range summary.Interfaces {
-		sort.Slice(iface.Endpoints, func(i, j int) bool {
-			return iface.Endpoints[i].Packets > iface.Endpoints[j].Packets
+func TcReset(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	iface := r.URL.Query().Get("iface")
+	if iface == "" {
+		return errors.New("no iface")
+	}
+	logger.Tf(ctx, "Start reset for iface=%v", iface)
+
+	q := r.URL.Query()
+	scope := &NetworkScope{
+		ID: q.Get("id"), Direction: q.Get("direction"),
+		IdentifyKey: q.Get("identifyKey"), IdentifyValue: q.Get("identifyValue"),
+	}
+	if !scope.Empty() {
+		removed, err := rules.Remove(ctx, iface, scope)
+		if err != nil {
+			return err
+		}
+
+		logger.Tf(ctx, "Reset TC for iface=%v, shaper=%v, scope=%v, removed=%v", iface, shaper.Name(), scope, len(removed))
+		ohttp.WriteData(ctx, w, r, &struct {
+			Rules []*NetworkRule `json:"rules"`
+		}{
+			Rules: removed,
 		})
+		return nil
 	}
 
-	logger.Tf(ctx, "Scan ok, ifaces=%v, %v", ifaces, summary.String())
-	ohttp.WriteData(ctx, w, r, summary)
+	if err := rules.Reset(ctx, iface); err != nil {
+		return err
+	}
+
+	logger.Tf(ctx, "Reset TC for iface=%v, shaper=%v", iface, shaper.Name())
+	ohttp.WriteData(ctx, w, r, nil)
 	return nil
 }
 
-func TcQuery(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+func TcScript(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	iface := r.URL.Query().Get("iface")
 	if iface == "" {
 		return errors.New("no iface")
 	}
-	logger.Tf(ctx, "Start query for iface=%v", iface)
 
-	var output string
-	var args []string
-	if !isDarwin {
-		args = []string{iface}
-		if b, err := exec.CommandContext(ctx, "tcshow", args...).Output(); err != nil {
-			return errors.Wrapf(err, "exec tcshow %v", strings.Join(args, " "))
-		} else {
-			logger.Tf(ctx, "tcshow %v", strings.Join(args, " "))
-			output = strings.TrimSpace(string(b))
-		}
+	scripter, ok := shaper.(interface {
+		Script(iface string) []string
+	})
+	if !ok {
+		return errors.Errorf("shaper %v does not support script", shaper.Name())
 	}
 
-	logger.Tf(ctx, "Query TC for iface=%v, args=%v, %v", iface, args, output)
+	script := scripter.Script(iface)
+	logger.Tf(ctx, "Script TC for iface=%v, shaper=%v, %v", iface, shaper.Name(), strings.Join(script, "; "))
 	ohttp.WriteData(ctx, w, r, &struct {
-		Cmd    string `json:"cmd"`
-		Output string `json:"output"`
+		Script []string `json:"script"`
 	}{
-		Cmd:    strings.Join(append([]string{"ts"}, args...), " "),
-		Output: output,
+		Script: script,
 	})
 	return nil
 }
 
-func TcReset(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	iface := r.URL.Query().Get("iface")
-	if iface == "" {
-		return errors.New("no iface")
+// TcApply setups the network by the JSON body, with any number of strategies, for example:
+//
+//	{"iface": "lo", "protocol": "udp", "direction": "outgoing", "identifyKey": "serverPort", "identifyValue": "8000",
+//	"strategies": [{"strategy": "loss", "loss": 10}, {"strategy": "delay", "delay": 100}]}
+func TcApply(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	req, err := readNetworkRequest(r)
+	if err != nil {
+		return err
 	}
-	logger.Tf(ctx, "Start reset for iface=%v", iface)
 
-	if !isDarwin {
-		args := []string{"--all", iface}
-		if b, err := exec.CommandContext(ctx, "tcdel", args...).CombinedOutput(); err != nil {
-			return errors.Wrapf(err, "tcdel %v", strings.Join(args, " "))
-		} else if bs := string(b); len(bs) > 0 {
-			nnErrors := strings.Count(bs, "ERROR")
-
-			// Ignore the error because it always happens:
-			// 		tc qdisc del dev lo ingress
-			// 		Error: Invalid handle.
-			isIngressDel := strings.Contains(bs, "ingress") && strings.Contains(bs, "qdisc del")
-			canIgnore := nnErrors == 1 && isIngressDel
-
-			if nnErrors > 0 && !canIgnore {
-				return errors.Errorf("tcdel %v, %v", strings.Join(args, " "), bs)
+	return applyNetwork(ctx, w, r, req)
+}
+
+// readNetworkRequest reads the request from JSON body, and applies the presets of strategies.
+func readNetworkRequest(r *http.Request) (*NetworkRequest, error) {
+	req := &NetworkRequest{}
+	defer r.Body.Close()
+	if b, err := ioutil.ReadAll(r.Body); err != nil {
+		return nil, errors.Wrapf(err, "read body")
+	} else if err := json.Unmarshal(b, req); err != nil {
+		return nil, errors.Wrapf(err, "parse body %v", string(b))
+	}
+
+	if err := applyPresets(req.Strategies); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// applyPresets fills the parameters of strategies by preset, for the strategies in JSON body.
+func applyPresets(strategies []*NetworkStrategy) error {
+	for _, strategy := range strategies {
+		if strategy != nil && strategy.Preset != "" {
+			if err := strategy.applyPreset(); err != nil {
+				return err
 			}
-			logger.Tf(ctx, "tcdel %v, error=%v, ingress=%v, ignore=%v, %v",
-				strings.Join(args, " "), nnErrors, isIngressDel, canIgnore, bs)
-		} else {
-			logger.Tf(ctx, "tcdel %v", strings.Join(args, " "))
 		}
 	}
-
-	logger.Tf(ctx, "Reset TC for iface=%v", iface)
-	ohttp.WriteData(ctx, w, r, nil)
 	return nil
 }
 
+// TcSetup setups the network by query with one strategy, which is a shim of TcApply.
 func TcSetup(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	q := r.URL.Query()
-	opts := &NetworkOptions{
-		iface: q.Get("iface"), protocol: q.Get("protocol"), direction: q.Get("direction"),
-		identifyKey: q.Get("identifyKey"), identifyValue: q.Get("identifyValue"),
-		strategy: q.Get("strategy"), loss: q.Get("loss"), delay: q.Get("delay"),
-		rate: q.Get("rate"), apiPort: strings.Trim(os.Getenv("API_LISTEN"), ":"),
-		delayDistro: q.Get("delayDistro"),
-	}
-	if q.Get("api") != "" {
-		opts.apiPort = q.Get("api")
+	req, err := ParseNetworkRequest(q)
+	if err != nil {
+		return err
 	}
-	if err := opts.Execute(ctx); err != nil {
+
+	if strategy, err := ParseNetworkStrategy(q, ""); err != nil {
 		return err
+	} else if strategy != nil {
+		req.Strategies = append(req.Strategies, strategy)
 	}
 
-	logger.Tf(ctx, "Setup TC for iface=%v", opts.iface)
-	ohttp.WriteData(ctx, w, r, nil)
-	return nil
+	return applyNetwork(ctx, w, r, req)
 }
 
+// TcSetup2 setups the network by query with two strategies, the second is with suffix 2, which is a shim
+// of TcApply.
 func TcSetup2(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	q := r.URL.Query()
-	opts := &NetworkOptions{
-		iface: q.Get("iface"), protocol: q.Get("protocol"), direction: q.Get("direction"),
-		identifyKey: q.Get("identifyKey"), identifyValue: q.Get("identifyValue"),
-		apiPort:  strings.Trim(os.Getenv("API_LISTEN"), ":"),
-		strategy: q.Get("strategy"), loss: q.Get("loss"), delay: q.Get("delay"),
-		rate: q.Get("rate"), delayDistro: q.Get("delayDistro"),
-		strategy2: q.Get("strategy2"), loss2: q.Get("loss2"), delay2: q.Get("delay2"),
-		rate2: q.Get("rate2"), delayDistro2: q.Get("delayDistro2"),
-	}
-	if q.Get("api") != "" {
-		opts.apiPort = q.Get("api")
-	}
-	if err := opts.Execute(ctx); err != nil {
+	req, err := ParseNetworkRequest(q)
+	if err != nil {
 		return err
 	}
 
-	logger.Tf(ctx, "Setup2 TC for iface=%v", opts.iface)
-	ohttp.WriteData(ctx, w, r, nil)
+	for _, suffix := range []string{"", "2"} {
+		if strategy, err := ParseNetworkStrategy(q, suffix); err != nil {
+			return err
+		} else if strategy != nil {
+			req.Strategies = append(req.Strategies, strategy)
+		}
+	}
+
+	return applyNetwork(ctx, w, r, req)
+}
+
+// TcPlan responses the commands to setup the network, without applying them. The request is the JSON body like
+// apply, or the query like setup2.
+func TcPlan(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	q.Set("dryRun", "true")
+	r.URL.RawQuery = q.Encode()
+
+	if r.Method == http.MethodPost {
+		return TcApply(ctx, w, r)
+	}
+	return TcSetup2(ctx, w, r)
+}
+
+// applyNetwork setups the network by the request, overwriting the rules of the direction, and responses the
+// ID of rule.
+func applyNetwork(ctx context.Context, w http.ResponseWriter, r *http.Request, req *NetworkRequest) error {
+	if err := expandProfile(req); err != nil {
+		return err
+	}
+
+	// Response the commands to run, without applying them.
+	if r.URL.Query().Get("dryRun") == "true" {
+		commands, err := req.Options().Plan(ctx)
+		if err != nil {
+			return err
+		}
+
+		logger.Tf(ctx, "Plan TC for iface=%v, shaper=%v, %v", req.Iface, shaper.Name(), strings.Join(commands, "; "))
+		ohttp.WriteData(ctx, w, r, &struct {
+			Shaper   string   `json:"shaper"`
+			Commands []string `json:"commands"`
+		}{
+			Shaper: shaper.Name(), Commands: commands,
+		})
+		return nil
+	}
+
+	rule, err := rules.Setup(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	logger.Tf(ctx, "Setup TC for iface=%v, rule=%v, strategies=%v", req.Iface, rule.ID, len(req.Strategies))
+	ohttp.WriteData(ctx, w, r, &struct {
+		ID string `json:"id"`
+	}{
+		ID: rule.ID,
+	})
 	return nil
 }
 
@@ -327,36 +501,123 @@ func TcUI(ctx context.Context, reactjsEP string) http.HandlerFunc {
 	}
 }
 
+// NetworkRequest is the request to setup the network, in JSON body or query.
+type NetworkRequest struct {
+	Iface         string `json:"iface"`
+	Protocol      string `json:"protocol"`
+	Direction     string `json:"direction"`
+	IdentifyKey   string `json:"identifyKey"`
+	IdentifyValue string `json:"identifyValue"`
+	// The api listen port to exclude, default to API_LISTEN.
+	API string `json:"api,omitempty"`
+	// The duration in seconds to revert to the previous state, 0 to keep it until reset.
+	Duration int `json:"duration,omitempty"`
+	// The name of profile, which is expanded to the strategies of direction.
+	Profile string `json:"profile,omitempty"`
+	// The strategies, which are combined to one netem and HTB config.
+	Strategies []*NetworkStrategy `json:"strategies"`
+}
+
+// ParseNetworkRequest parses the request from query, without the strategies.
+func ParseNetworkRequest(q url.Values) (*NetworkRequest, error) {
+	req := &NetworkRequest{
+		Iface: q.Get("iface"), Protocol: q.Get("protocol"), Direction: q.Get("direction"),
+		IdentifyKey: q.Get("identifyKey"), IdentifyValue: q.Get("identifyValue"), API: q.Get("api"),
+		Profile: q.Get("profile"),
+	}
+	if v := q.Get("duration"); v != "" {
+		if iv, err := strconv.Atoi(v); err != nil {
+			return nil, errors.Wrapf(err, "parse duration=%v", v)
+		} else {
+			req.Duration = iv
+		}
+	}
+	return req, nil
+}
+
+// Options converts the request to network options.
+func (v *NetworkRequest) Options() *NetworkOptions {
+	opts := &NetworkOptions{
+		iface: v.Iface, protocol: v.Protocol, direction: v.Direction,
+		identifyKey: v.IdentifyKey, identifyValue: v.IdentifyValue,
+		apiPort: strings.Trim(os.Getenv("API_LISTEN"), ":"),
+	}
+	if v.API != "" {
+		opts.apiPort = v.API
+	}
+	for _, strategy := range v.Strategies {
+		if strategy != nil {
+			opts.strategies = append(opts.strategies, strategy)
+		}
+	}
+	return opts
+}
+
 type NetworkOptions struct {
 	// The interface name to set the network condition.
 	iface string
-	// The protocol to set, UDP or TCP.
+	// The protocol to set, tcp, udp or icmp, or ip and all for all protocols.
 	protocol string
 	// The direction, publisher for incoming, player for outgoing.
 	direction string
 	// The filter to identify, by ip or port.
 	identifyKey, identifyValue string
-	// The network strategy name.
-	strategy, strategy2 string
-	// If strategy is loss, the loss rate in %.
-	loss, loss2 string
-	// If strategy is delay, the delay in ms.
-	delay, delay2 string
-	// If delayDistro is not empty, it's the delay-distro in ms.
-	delayDistro, delayDistro2 string
-	// If strategy is rate, the bitrate limit in kbps.
-	rate, rate2 string
+	// The network strategies, at least one, and each strategy at most once.
+	strategies []*NetworkStrategy
 	// The api listen port, which should be excluded from the network condition.
 	apiPort string
 }
 
 func (v *NetworkOptions) Execute(ctx context.Context) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	logger.Tf(ctx, "Setup network for darwin=%v, iface=%v, protocol=%v, direction=%v, identify=%v/%v, "+
+		"strategies=%v",
+		isDarwin, v.iface, v.protocol, v.direction, v.identifyKey, v.identifyValue, v.strategies,
+	)
+
+	// Ignore if the os is darwin because it doesn't support it yet.
+	if isDarwin {
+		logger.Tf(ctx, "Darwin: Ignore network setup")
+		return nil
+	}
+
+	if err := shaper.Setup(ctx, v); err != nil {
+		return errors.Wrapf(err, "setup by %v", shaper.Name())
+	}
+	return nil
+}
+
+// Plan validates the network options, and returns the commands which Execute runs in order, without applying them.
+func (v *NetworkOptions) Plan(ctx context.Context) ([]string, error) {
+	if err := v.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Nothing is applied if the os is darwin.
+	if isDarwin {
+		return []string{}, nil
+	}
+
+	commands, err := shaper.Plan(ctx, v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "plan by %v", shaper.Name())
+	}
+	return commands, nil
+}
+
+// Validate checks the filter and strategies of network options.
+func (v *NetworkOptions) Validate() error {
 	if v.iface == "" {
 		return errors.New("no iface")
 	}
 	if v.protocol == "" {
 		return errors.New("no protocol")
 	}
+	if v.protocol != "ip" && v.protocol != "all" && v.protocol != "tcp" && v.protocol != "udp" && v.protocol != "icmp" {
+		return errors.Errorf("invalid protocol=%v", v.protocol)
+	}
 	if v.direction == "" {
 		return errors.New("no direction")
 	}
@@ -372,121 +633,352 @@ func (v *NetworkOptions) Execute(ctx context.Context) error {
 	if v.identifyKey != "all" && v.identifyKey != "serverPort" && v.identifyKey != "clientPort" && v.identifyKey != "clientIp" {
 		return errors.Errorf("invalid identifyKey=%v", v.identifyKey)
 	}
-	if v.strategy == "" && v.strategy2 == "" {
-		return errors.New("no strategy")
-	}
-	if v.strategy == v.strategy2 {
-		return errors.Errorf("duplicated strategy %v", v.strategy)
+	if v.identifyKey == "clientIp" {
+		if _, err := parseClientIPs(v.identifyValue); err != nil {
+			return err
+		}
 	}
-	if (v.strategy == "loss" && v.loss == "") || (v.strategy2 == "loss" && v.loss2 == "") {
-		return errors.New("no loss")
+	if v.identifyKey == "serverPort" || v.identifyKey == "clientPort" {
+		if _, err := parsePortRanges(v.identifyValue); err != nil {
+			return errors.Wrapf(err, "parse %v=%v", v.identifyKey, v.identifyValue)
+		}
 	}
-	if (v.strategy == "delay" && v.delay == "") || (v.strategy2 == "delay" && v.delay2 == "") {
-		return errors.New("no delay")
+	if v.protocol == "icmp" && (v.identifyKey == "serverPort" || v.identifyKey == "clientPort") {
+		return errors.Errorf("no port for protocol=%v, identifyKey=%v", v.protocol, v.identifyKey)
 	}
-	if (v.strategy == "rate" && v.rate == "") || (v.strategy2 == "rate" && v.rate2 == "") {
-		return errors.New("no rate")
+	return validateStrategies(v.strategies)
+}
+
+// validateStrategies checks the strategies, which are combined to one netem and HTB config.
+func validateStrategies(strategies []*NetworkStrategy) error {
+	if len(strategies) == 0 {
+		return errors.New("no strategy")
 	}
-	logger.Tf(ctx, "Setup network for darwin=%v, iface=%v, protocol=%v, direction=%v, identify=%v/%v, "+
-		"strategy=%v, loss=%v, delay=%v, rate=%v, delayDistro=%v, strategy2=%v, loss2=%v, delay2=%v, rate2=%v, "+
-		"delayDistro2=%v",
-		isDarwin, v.iface, v.protocol, v.direction, v.identifyKey, v.identifyKey, v.strategy, v.loss,
-		v.delay, v.rate, v.delayDistro, v.strategy2, v.loss2, v.delay2, v.rate2, v.delayDistro2,
-	)
+	names := make(map[string]bool)
+	for _, strategy := range strategies {
+		if strategy == nil {
+			return errors.New("no strategy")
+		}
+		if names[strategy.Strategy] {
+			return errors.Errorf("duplicated strategy %v", strategy.Strategy)
+		}
+		names[strategy.Strategy] = true
 
-	// Ignore if the os is darwin because it doesn't support it yet.
-	if isDarwin {
-		logger.Tf(ctx, "Darwin: Ignore network setup")
-		return nil
+		if err := strategy.Validate(); err != nil {
+			return err
+		}
 	}
 
-	// Format the shaping algorithm. We use HTB which doesn't require iptables.
-	args := []string{
-		// Overwrite existing traffic shaping rules.
-		"--overwrite",
-		// Use HTB which doesn't require iptables.
-		"--shaping-algo", "htb",
+	v := &NetworkOptions{strategies: strategies}
+	if names := v.lossStrategies(); len(names) > 1 {
+		return errors.Errorf("conflict loss models %v", strings.Join(names, ","))
 	}
+	if v.hasStrategy("reorder") && !v.hasStrategy("delay") {
+		return errors.New("reorder requires delay")
+	}
+	return nil
+}
 
-	// For direction outgoing, client pull stream from server.
-	if v.direction == "outgoing" {
-		args = append(args,
-			"--direction", "outgoing",
-			"--exclude-src-port", v.apiPort, // Exclude the API port.
-		)
-		if v.identifyKey == "serverPort" {
-			args = append(args, "--src-port", v.identifyValue)
-		} else if v.identifyKey == "clientIp" {
-			args = append(args, "--dst-network", v.identifyValue)
-		} else if v.identifyKey == "clientPort" {
-			args = append(args, "--dst-port", v.identifyValue)
+// lossStrategies returns the strategies of loss model, because netem only supports one loss model.
+func (v *NetworkOptions) lossStrategies() []string {
+	var names []string
+	for _, name := range []string{"loss", "lossState", "lossGemodel"} {
+		if v.hasStrategy(name) {
+			names = append(names, name)
 		}
 	}
+	return names
+}
 
-	// For direction incoming, client push stream to server.
-	if v.direction == "incoming" {
-		args = append(args,
-			"--direction", "incoming",
-			"--exclude-dst-port", v.apiPort, // Exclude the API port.
-		)
-		if v.identifyKey == "serverPort" {
-			args = append(args, "--dst-port", v.identifyValue)
-		} else if v.identifyKey == "clientIp" {
-			args = append(args, "--src-network", v.identifyValue)
-		} else if v.identifyKey == "clientPort" {
-			args = append(args, "--src-port", v.identifyValue)
+// hasStrategy whether the network options has the strategy.
+func (v *NetworkOptions) hasStrategy(name string) bool {
+	for _, strategy := range v.strategies {
+		if strategy.Strategy == name {
+			return true
 		}
 	}
+	return false
+}
+
+// NetworkStrategy is a network strategy, which is a netem impairment or a rate limit.
+type NetworkStrategy struct {
+	// The network strategy name, loss, lossState, lossGemodel, delay, rate, duplicate, corrupt or reorder.
+	Strategy string `json:"strategy"`
+	// If strategy is loss, the loss rate in %, and the correlation in %.
+	Loss            float64 `json:"loss,omitempty"`
+	LossCorrelation float64 `json:"lossCorrelation,omitempty"`
+	// If strategy is lossState, the 4-state Markov loss model, the transition probabilities in %. The state 1 is
+	// good reception, 2 is good reception within burst, 3 is burst losses and 4 is independent losses.
+	P13 float64 `json:"p13,omitempty"`
+	P31 float64 `json:"p31,omitempty"`
+	P32 float64 `json:"p32,omitempty"`
+	P23 float64 `json:"p23,omitempty"`
+	P14 float64 `json:"p14,omitempty"`
+	// If strategy is lossGemodel, the Gilbert-Elliott loss model in %. The p is the probability from good to bad
+	// state, the r is from bad to good state, the lossBad is the loss in bad state, that is 1-h, and the lossGood
+	// is the loss in good state, that is 1-k.
+	P        float64 `json:"p,omitempty"`
+	R        float64 `json:"r,omitempty"`
+	LossBad  float64 `json:"lossBad,omitempty"`
+	LossGood float64 `json:"lossGood,omitempty"`
+	// The preset of lossGemodel, lightBursty or heavyBursty, which overwrites the parameters.
+	Preset string `json:"preset,omitempty"`
+	// If strategy is delay, the delay in ms.
+	Delay float64 `json:"delay,omitempty"`
+	// If delayDistro is not zero, it's the jitter of delay in ms, in the distribution.
+	DelayDistro float64 `json:"delayDistro,omitempty"`
+	// The distribution of jitter, normal, pareto or paretonormal, default to uniform.
+	Distribution string `json:"distribution,omitempty"`
+	// The correlation of delay in %.
+	DelayCorrelation float64 `json:"delayCorrelation,omitempty"`
+	// If strategy is rate, the bitrate limit in kbps.
+	Rate float64 `json:"rate,omitempty"`
+	// If strategy is duplicate, the duplicate rate in %, and the correlation in %.
+	Duplicate            float64 `json:"duplicate,omitempty"`
+	DuplicateCorrelation float64 `json:"duplicateCorrelation,omitempty"`
+	// If strategy is corrupt, the corrupt rate in %, and the correlation in %.
+	Corrupt            float64 `json:"corrupt,omitempty"`
+	CorruptCorrelation float64 `json:"corruptCorrelation,omitempty"`
+	// If strategy is reorder, the reorder rate in %, and the correlation in %. The gap is the distance of
+	// packets to reorder, that is, every gap-th packet is sent immediately, while others are delayed.
+	Reorder            float64 `json:"reorder,omitempty"`
+	ReorderCorrelation float64 `json:"reorderCorrelation,omitempty"`
+	Gap                uint32  `json:"gap,omitempty"`
+}
+
+// ParseNetworkStrategy parses the strategy from query, the suffix is for the second strategy, for example,
+// strategy2 and loss2. Returns nil if no strategy.
+func ParseNetworkStrategy(q url.Values, suffix string) (*NetworkStrategy, error) {
+	v := &NetworkStrategy{Strategy: q.Get("strategy" + suffix)}
+	if v.Strategy == "" {
+		return nil, nil
+	}
 
-	// Build the first strategy.
-	buildStrategyArgs := func(args []string, strategy, loss, delay, rate, delayDistro string) []string {
-		// Ignore empty strategy.
-		if strategy == "" {
-			return args
+	parse := func(name string, pv *float64) error {
+		if value := q.Get(name + suffix); value != "" {
+			if f, err := strconv.ParseFloat(value, 64); err != nil {
+				return errors.Wrapf(err, "parse %v%v=%v", name, suffix, value)
+			} else {
+				*pv = f
+			}
 		}
+		return nil
+	}
 
-		// Format the network strategy, that is, loss, delay, rate.
-		if strategy == "loss" {
-			args = append(args, "--loss", fmt.Sprintf("%v%%", loss))
-		} else if strategy == "delay" {
-			args = append(args, "--delay", fmt.Sprintf("%vms", delay))
-		} else if strategy == "rate" {
-			// Note that tc is in kbit, while tcset is in kbps.
-			args = append(args, "--rate", fmt.Sprintf("%vkbps", rate))
+	switch v.Strategy {
+	case "loss":
+		if q.Get("loss"+suffix) == "" {
+			return nil, errors.New("no loss")
+		}
+		if err := parse("loss", &v.Loss); err != nil {
+			return nil, err
+		}
+		if err := parse("lossCorrelation", &v.LossCorrelation); err != nil {
+			return nil, err
+		}
+	case "lossState":
+		if q.Get("p13"+suffix) == "" {
+			return nil, errors.New("no p13")
+		}
+		if err := parse("p13", &v.P13); err != nil {
+			return nil, err
+		}
+		// Like tc, the p31 defaults to 100-p13, p23 to 100, and others to 0.
+		v.P31, v.P23 = 100-v.P13, 100
+		for _, param := range []struct {
+			name string
+			pv   *float64
+		}{{"p31", &v.P31}, {"p32", &v.P32}, {"p23", &v.P23}, {"p14", &v.P14}} {
+			if err := parse(param.name, param.pv); err != nil {
+				return nil, err
+			}
+		}
+	case "lossGemodel":
+		if v.Preset = q.Get("preset" + suffix); v.Preset != "" {
+			if err := v.applyPreset(); err != nil {
+				return nil, err
+			}
+			break
 		}
 
-		// Append other arguments.
-		if delayDistro != "" {
-			args = append(args, "--delay-distro", fmt.Sprintf("%v", delayDistro))
+		if q.Get("p"+suffix) == "" {
+			return nil, errors.New("no p")
+		}
+		if err := parse("p", &v.P); err != nil {
+			return nil, err
+		}
+		// Like tc, the r defaults to 100-p, 1-h to 100 and 1-k to 0.
+		v.R, v.LossBad = 100-v.P, 100
+		for _, param := range []struct {
+			name string
+			pv   *float64
+		}{{"r", &v.R}, {"lossBad", &v.LossBad}, {"lossGood", &v.LossGood}} {
+			if err := parse(param.name, param.pv); err != nil {
+				return nil, err
+			}
+		}
+	case "delay":
+		if q.Get("delay"+suffix) == "" {
+			return nil, errors.New("no delay")
+		}
+		v.Distribution = q.Get("distribution" + suffix)
+		if err := parse("delay", &v.Delay); err != nil {
+			return nil, err
+		}
+		if err := parse("delayDistro", &v.DelayDistro); err != nil {
+			return nil, err
+		}
+		if err := parse("delayCorrelation", &v.DelayCorrelation); err != nil {
+			return nil, err
+		}
+	case "rate":
+		if q.Get("rate"+suffix) == "" {
+			return nil, errors.New("no rate")
+		}
+		if err := parse("rate", &v.Rate); err != nil {
+			return nil, err
+		}
+	case "duplicate":
+		if q.Get("duplicate"+suffix) == "" {
+			return nil, errors.New("no duplicate")
+		}
+		if err := parse("duplicate", &v.Duplicate); err != nil {
+			return nil, err
+		}
+		if err := parse("duplicateCorrelation", &v.DuplicateCorrelation); err != nil {
+			return nil, err
+		}
+	case "corrupt":
+		if q.Get("corrupt"+suffix) == "" {
+			return nil, errors.New("no corrupt")
+		}
+		if err := parse("corrupt", &v.Corrupt); err != nil {
+			return nil, err
+		}
+		if err := parse("corruptCorrelation", &v.CorruptCorrelation); err != nil {
+			return nil, err
+		}
+	case "reorder":
+		if q.Get("reorder"+suffix) == "" {
+			return nil, errors.New("no reorder")
+		}
+		if err := parse("reorder", &v.Reorder); err != nil {
+			return nil, err
+		}
+		if err := parse("reorderCorrelation", &v.ReorderCorrelation); err != nil {
+			return nil, err
+		}
+		if gap := q.Get("gap" + suffix); gap != "" {
+			if iv, err := strconv.ParseUint(gap, 10, 32); err != nil {
+				return nil, errors.Wrapf(err, "parse gap%v=%v", suffix, gap)
+			} else {
+				v.Gap = uint32(iv)
+			}
 		}
-		return args
 	}
-	args = buildStrategyArgs(args, v.strategy, v.loss, v.delay, v.rate, v.delayDistro)
-	args = buildStrategyArgs(args, v.strategy2, v.loss2, v.delay2, v.rate2, v.delayDistro2)
 
-	args = append(args, v.iface)
-	if b, err := exec.CommandContext(ctx, "tcset", args...).CombinedOutput(); err != nil {
-		return errors.Wrapf(err, "tcset %v", strings.Join(args, " "))
-	} else if bs := string(b); len(bs) > 0 {
-		nnErrors := strings.Count(bs, "ERROR")
+	return v, nil
+}
+
+// The presets of lossGemodel, for UI to use bursty loss without the raw probabilities. The average loss is
+// about p/(p+r)*lossBad + r/(p+r)*lossGood, and the average length of burst is 100/r packets.
+var lossPresets = map[string]*NetworkStrategy{
+	// About 3.8% loss, in bursts of 4 packets.
+	"lightBursty": {P: 1, R: 25, LossBad: 100},
+	// About 21% loss, in bursts of 5 packets, and 1% random loss in good state.
+	"heavyBursty": {P: 5, R: 20, LossBad: 100, LossGood: 1},
+}
+
+// applyPreset overwrites the parameters of lossGemodel by the preset.
+func (v *NetworkStrategy) applyPreset() error {
+	preset, ok := lossPresets[v.Preset]
+	if !ok {
+		return errors.Errorf("invalid preset=%v", v.Preset)
+	}
+	v.P, v.R, v.LossBad, v.LossGood = preset.P, preset.R, preset.LossBad, preset.LossGood
+	return nil
+}
 
-		// Ignore the error because it always happens:
-		// 		tc qdisc del dev lo ingress
-		// 		Error: Invalid handle.
-		isIngressDel := strings.Contains(bs, "ingress") && strings.Contains(bs, "qdisc del")
-		canIgnore := nnErrors == 1 && isIngressDel
+// Validate checks the parameters of strategy.
+func (v *NetworkStrategy) Validate() error {
+	percents := map[string]float64{
+		"loss": v.Loss, "lossCorrelation": v.LossCorrelation, "delayCorrelation": v.DelayCorrelation,
+		"duplicate": v.Duplicate, "duplicateCorrelation": v.DuplicateCorrelation,
+		"corrupt": v.Corrupt, "corruptCorrelation": v.CorruptCorrelation,
+		"reorder": v.Reorder, "reorderCorrelation": v.ReorderCorrelation,
+		"p13": v.P13, "p31": v.P31, "p32": v.P32, "p23": v.P23, "p14": v.P14,
+		"p": v.P, "r": v.R, "lossBad": v.LossBad, "lossGood": v.LossGood,
+	}
+	for name, value := range percents {
+		if value < 0 || value > 100 {
+			return errors.Errorf("invalid %v=%v, should in [0, 100]", name, value)
+		}
+	}
 
-		if nnErrors > 0 && !canIgnore {
-			return errors.Errorf("tcset %v, %v", strings.Join(args, " "), bs)
+	switch v.Strategy {
+	case "loss", "duplicate", "corrupt", "reorder":
+	case "lossState":
+		if v.P13 == 0 {
+			return errors.New("invalid p13=0, never enter burst losses")
 		}
-		logger.Tf(ctx, "tcset %v, error=%v, ingress=%v, ignore=%v, %v",
-			strings.Join(args, " "), nnErrors, isIngressDel, canIgnore, bs)
-	} else {
-		logger.Tf(ctx, "tcset %v", strings.Join(args, " "))
+	case "lossGemodel":
+		if v.Preset != "" {
+			if _, ok := lossPresets[v.Preset]; !ok {
+				return errors.Errorf("invalid preset=%v", v.Preset)
+			}
+		}
+		if v.P == 0 {
+			return errors.New("invalid p=0, never enter bad state")
+		}
+		if v.R == 0 {
+			return errors.New("invalid r=0, never leave bad state")
+		}
+	case "delay":
+		if v.Delay < 0 {
+			return errors.Errorf("invalid delay=%v", v.Delay)
+		}
+		if v.DelayDistro < 0 {
+			return errors.Errorf("invalid delayDistro=%v", v.DelayDistro)
+		}
+		if v.Distribution != "" && v.Distribution != "normal" && v.Distribution != "pareto" && v.Distribution != "paretonormal" {
+			return errors.Errorf("invalid distribution=%v", v.Distribution)
+		}
+		if v.Distribution != "" && v.DelayDistro == 0 {
+			return errors.Errorf("no delayDistro for distribution=%v", v.Distribution)
+		}
+	case "rate":
+		if v.Rate <= 0 {
+			return errors.Errorf("invalid rate=%v", v.Rate)
+		}
+	default:
+		return errors.Errorf("invalid strategy=%v", v.Strategy)
 	}
 	return nil
 }
 
+func (v *NetworkStrategy) String() string {
+	switch v.Strategy {
+	case "loss":
+		return fmt.Sprintf("loss=%v%%/%v%%", v.Loss, v.LossCorrelation)
+	case "lossState":
+		return fmt.Sprintf("lossState=%v%%/%v%%/%v%%/%v%%/%v%%", v.P13, v.P31, v.P32, v.P23, v.P14)
+	case "lossGemodel":
+		return fmt.Sprintf("lossGemodel=%v%%/%v%%/%v%%/%v%%/%v", v.P, v.R, v.LossBad, v.LossGood, v.Preset)
+	case "delay":
+		return fmt.Sprintf("delay=%vms/%vms/%v%%/%v", v.Delay, v.DelayDistro, v.DelayCorrelation, v.Distribution)
+	case "rate":
+		return fmt.Sprintf("rate=%vkbps", v.Rate)
+	case "duplicate":
+		return fmt.Sprintf("duplicate=%v%%/%v%%", v.Duplicate, v.DuplicateCorrelation)
+	case "corrupt":
+		return fmt.Sprintf("corrupt=%v%%/%v%%", v.Corrupt, v.CorruptCorrelation)
+	case "reorder":
+		return fmt.Sprintf("reorder=%v%%/%v%%/%v", v.Reorder, v.ReorderCorrelation, v.Gap)
+	default:
+		return fmt.Sprintf("strategy=%v", v.Strategy)
+	}
+}
+
 type TcpdumpEndpoint struct {
 	// The protocol family, TCP or UDP.
 	Family TcProtocolFamily `json:"family"`
@@ -513,7 +1005,7 @@ type TcpdumpInterfaceSummary struct {
 	Endpoints []*TcpdumpEndpoint `json:"endpoints,omitempty"`
 
 	// The enpoints in slice.
-	endpoints map[string]*TcpdumpEndpoint `json:"endpoints,omitempty"`
+	endpoints map[string]*TcpdumpEndpoint
 }
 
 func NewTcpdumpInterfaceSummary(iface *TcInterface) *TcpdumpInterfaceSummary {
@@ -534,21 +1026,26 @@ type TcpdumpSummary struct {
 	// Interfaces.
 	Interfaces map[string]*TcpdumpInterfaceSummary `json:"ifaces,omitempty"`
 
-	// Network interface. Key is ipv4 address.
-	ipv4Interfaces map[string]*TcInterface
+	// Network interface. Key is ipv4 or ipv6 address.
+	ipInterfaces map[string]*TcInterface
+	// Network interface. Key is the name.
+	nameInterfaces map[string]*TcInterface
 }
 
 func NewTcpdumpSummary() *TcpdumpSummary {
 	v := &TcpdumpSummary{
 		Interfaces:     make(map[string]*TcpdumpInterfaceSummary),
-		ipv4Interfaces: make(map[string]*TcInterface),
+		ipInterfaces:   make(map[string]*TcInterface),
+		nameInterfaces: make(map[string]*TcInterface),
 	}
 
-	// Build the network interfaces metadata.
+	// Build the network interfaces metadata, by all the addresses, because an interface might have more than
+	// one IPv6 addresses, for example, the link-local and global one.
 	interfaces, _ := queryIPNetInterfaces(nil)
 	for _, iface := range interfaces {
-		if iface.IPv4 != nil {
-			v.ipv4Interfaces[iface.IPv4.String()] = iface
+		v.nameInterfaces[iface.Name] = iface
+		for _, ip := range iface.addrs {
+			v.ipInterfaces[ip.String()] = iface
 		}
 	}
 
@@ -561,17 +1058,33 @@ func (v *TcpdumpSummary) String() string {
 	)
 }
 
+// Sort sorts the endpoints of each interface by packets, the top talkers first.
+func (v *TcpdumpSummary) Sort() {
+	for _, iface := range v.Interfaces {
+		sort.Slice(iface.Endpoints, func(i, j int) bool {
+			return iface.Endpoints[i].Packets > iface.Endpoints[j].Packets
+		})
+	}
+}
+
 func (v *TcpdumpSummary) OnPacket(p *TcpdumpLog) {
 	// Ignore packet without any payload.
 	if p.Length == 0 {
 		return
 	}
 
+	// Attribute to the interface captured on, or find by address if unknown, for example, any of old tcpdump.
 	// Ignore if no interface found.
 	var tcInterface *TcInterface
-	if iface, ok := v.ipv4Interfaces[p.Source.String()]; ok {
+	if p.Interface != "" {
+		if iface, ok := v.nameInterfaces[p.Interface]; ok {
+			tcInterface = iface
+		} else {
+			tcInterface = &TcInterface{Name: p.Interface}
+		}
+	} else if iface, ok := v.ipInterfaces[p.Source.String()]; ok {
 		tcInterface = iface
-	} else if iface, ok = v.ipv4Interfaces[p.Destination.String()]; ok {
+	} else if iface, ok = v.ipInterfaces[p.Destination.String()]; ok {
 		tcInterface = iface
 	} else {
 		return
@@ -617,6 +1130,8 @@ func (v *TcpdumpSummary) OnPacket(p *TcpdumpLog) {
 type TcpdumpLog struct {
 	// The timestamp.
 	Timestamp time.Time
+	// The interface captured on, parsed from line for any, or empty if unknown.
+	Interface string
 	// The source and dest IP address.
 	Source, Destination net.IP
 	// The source and dest TCP/UDP port.
@@ -632,19 +1147,47 @@ type TcpdumpLog struct {
 //		1675941530.517119 IP 10.72.6.42.54440 > 10.72.6.42.8000: UDP, length 88
 //	 1675941503.166124 IP 10.99.245.232.443 > 10.72.6.42.58325: Flags [P.], seq 1205:1377, ack 16476, win 330, options [nop,nop,TS val 1265544348 ecr 1176955433], length 172
 //	 1675941649.798584 IP 192.168.255.10 > 101.43.175.30: ICMP echo request, id 57083, seq 8, length 64
+//	 1675941530.517119 IP6 2001:db8::1.54440 > 2001:db8::2.8000: UDP, length 88
+//	 1675941649.798584 IP6 2001:db8::1 > 2001:db8::2: ICMP6, echo request, id 3, seq 1, length 64
+//
+// For interface any, tcpdump 4.99+ prints the interface and the direction In, Out, B, M or P after timestamp:
+//
+//	1675941530.517119 eth0  In  IP 10.72.6.42.54440 > 10.72.6.42.8000: UDP, length 88
 func parseTcpdumpLine(line string) (*TcpdumpLog, bool) {
-	var timestamp float64
-	var ssrc, sdst, label string
-	fmt.Sscanf(line, "%f IP %s > %s %s", &timestamp, &ssrc, &sdst, &label)
-
-	ssrc = strings.Trim(ssrc, ":")
-	sdst = strings.Trim(sdst, ":")
-	label = strings.Trim(label, ",")
-
-	l := &TcpdumpLog{}
-	var s0, s1, s2, s3, d0, d1, d2, d3 int
-	fmt.Sscanf(ssrc, "%d.%d.%d.%d.%d", &s0, &s1, &s2, &s3, &l.SourcePort)
-	fmt.Sscanf(sdst, "%d.%d.%d.%d.%d", &d0, &d1, &d2, &d3, &l.DestPort)
+	// The fields are timestamp, IP or IP6, source, >, dest and label.
+	fields := strings.Fields(line)
+
+	// Remove the interface and direction, for interface any.
+	var iface string
+	if len(fields) > 3 && fields[1] != "IP" && fields[1] != "IP6" {
+		switch fields[2] {
+		case "In", "Out", "B", "M", "P":
+			iface = fields[1]
+			fields = append(fields[:1], fields[3:]...)
+		}
+	}
+
+	if len(fields) < 6 || (fields[1] != "IP" && fields[1] != "IP6") || fields[3] != ">" {
+		return nil, false
+	}
+
+	timestamp, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, false
+	}
+	// Only trim the colon after address, because the IPv6 address might start with colons, for example, ::1.
+	ssrc := strings.TrimSuffix(fields[2], ":")
+	sdst := strings.TrimSuffix(fields[4], ":")
+	label := strings.Trim(fields[5], ",")
+
+	l := &TcpdumpLog{Interface: iface}
+	var ok bool
+	if l.Source, l.SourcePort, ok = parseTcpdumpAddress(ssrc); !ok {
+		return nil, false
+	}
+	if l.Destination, l.DestPort, ok = parseTcpdumpAddress(sdst); !ok {
+		return nil, false
+	}
 	if idx := strings.LastIndex(line, ", length "); idx > 0 {
 		fmt.Sscanf(line[idx:], ", length %d", &l.Length)
 	}
@@ -653,18 +1196,36 @@ func parseTcpdumpLine(line string) (*TcpdumpLog, bool) {
 		l.Family = ProtocolFamilyUDP
 	} else if label == "Flags" {
 		l.Family = ProtocolFamilyTCP
-	} else if label == "ICMP" {
+	} else if label == "ICMP" || label == "ICMP6" {
 		l.Family = ProtocolFamilyICMP
 	} else {
 		return nil, false
 	}
 
 	l.Timestamp = time.Unix(0, int64(timestamp*1000*1000*1000))
-	l.Source = net.IPv4(byte(s0), byte(s1), byte(s2), byte(s3))
-	l.Destination = net.IPv4(byte(d0), byte(d1), byte(d2), byte(d3))
 	return l, true
 }
 
+// parseTcpdumpAddress parses the address of tcpdump, which is the IP followed by a dot and the port, for example,
+// 10.72.6.42.8000 or 2001:db8::1.8000, or the IP without port for ICMP.
+func parseTcpdumpAddress(s string) (net.IP, uint16, bool) {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, 0, true
+	}
+
+	idx := strings.LastIndex(s, ".")
+	if idx < 0 {
+		return nil, 0, false
+	}
+
+	ip := net.ParseIP(s[:idx])
+	port, err := strconv.ParseUint(s[idx+1:], 10, 16)
+	if ip == nil || err != nil {
+		return nil, 0, false
+	}
+	return ip, uint16(port), true
+}
+
 func queryIPNetInterfaces(filter func(iface *net.Interface, addr net.Addr) bool) ([]*TcInterface, error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
@@ -694,10 +1255,15 @@ func queryIPNetInterfaces(filter func(iface *net.Interface, addr net.Addr) bool)
 				if ip := r0.IP.To4(); ip != nil {
 					if os.Getenv("IFACE_FILTER_IPV4") != "false" {
 						ti.IPv4 = TcIP(ip)
+						ti.addrs = append(ti.addrs, ip)
 					}
 				} else if ip := r0.IP.To16(); ip != nil {
 					if os.Getenv("IFACE_FILTER_IPV6") != "false" {
-						ti.IPv6 = TcIP(ip)
+						// Prefer the global address, rather than the link-local one.
+						if ti.IPv6 == nil || net.IP(ti.IPv6).IsLinkLocalUnicast() {
+							ti.IPv6 = TcIP(ip)
+						}
+						ti.addrs = append(ti.addrs, ip)
 					}
 				}
 			}
@@ -737,6 +1303,9 @@ type TcInterface struct {
 	IPv4 TcIP `json:"ipv4,omitempty"`
 	// The ipv6 address.
 	IPv6 TcIP `json:"ipv6,omitempty"`
+
+	// All the ipv4 and ipv6 addresses.
+	addrs []net.IP
 }
 
 func (v *TcInterface) String() string {
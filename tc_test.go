@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseTcpdumpLine(t *testing.T) {
+	for _, c := range []struct {
+		line                string
+		ok                  bool
+		iface               string
+		source, destination string
+		sport, dport        uint16
+		family              TcProtocolFamily
+		length              int
+	}{
+		{
+			line: "1675941530.517119 IP 10.72.6.42.54440 > 10.72.6.42.8000: UDP, length 88", ok: true,
+			source: "10.72.6.42", sport: 54440, destination: "10.72.6.42", dport: 8000,
+			family: ProtocolFamilyUDP, length: 88,
+		},
+		{
+			line: "1675941503.166124 IP 10.99.245.232.443 > 10.72.6.42.58325: Flags [P.], seq 1205:1377, " +
+				"ack 16476, win 330, options [nop,nop,TS val 1265544348 ecr 1176955433], length 172", ok: true,
+			source: "10.99.245.232", sport: 443, destination: "10.72.6.42", dport: 58325,
+			family: ProtocolFamilyTCP, length: 172,
+		},
+		{
+			line: "1675941649.798584 IP 192.168.255.10 > 101.43.175.30: ICMP echo request, id 57083, seq 8, " +
+				"length 64", ok: true,
+			source: "192.168.255.10", destination: "101.43.175.30", family: ProtocolFamilyICMP, length: 64,
+		},
+		{
+			line: "1675941530.517119 IP6 2001:db8::1.54440 > 2001:db8::2.8000: UDP, length 88", ok: true,
+			source: "2001:db8::1", sport: 54440, destination: "2001:db8::2", dport: 8000,
+			family: ProtocolFamilyUDP, length: 88,
+		},
+		{
+			line: "1675941530.517119 IP6 fe80::a00:27ff:fe4e:66a1.22 > fe80::1.50000: Flags [S], seq 1, " +
+				"win 64800, length 0", ok: true,
+			source: "fe80::a00:27ff:fe4e:66a1", sport: 22, destination: "fe80::1", dport: 50000,
+			family: ProtocolFamilyTCP,
+		},
+		{
+			line: "1675941649.798584 IP6 2001:db8::1 > 2001:db8::2: ICMP6, echo request, id 3, seq 1, " +
+				"length 64", ok: true,
+			source: "2001:db8::1", destination: "2001:db8::2", family: ProtocolFamilyICMP, length: 64,
+		},
+		{
+			line: "1675941530.517119 IP6 ::1.8000 > ::1.54440: UDP, length 1000", ok: true,
+			source: "::1", sport: 8000, destination: "::1", dport: 54440, family: ProtocolFamilyUDP, length: 1000,
+		},
+		{
+			line: "1675941530.517119 eth0  In  IP 10.72.6.42.54440 > 10.72.6.42.8000: UDP, length 88", ok: true,
+			iface: "eth0", source: "10.72.6.42", sport: 54440, destination: "10.72.6.42", dport: 8000,
+			family: ProtocolFamilyUDP, length: 88,
+		},
+		{
+			line: "1675941530.517119 lo    Out IP6 ::1.8000 > ::1.54440: UDP, length 1000", ok: true,
+			iface: "lo", source: "::1", sport: 8000, destination: "::1", dport: 54440,
+			family: ProtocolFamilyUDP, length: 1000,
+		},
+		{
+			line: "1675941649.798584 docker0 B   IP 172.17.0.1 > 172.17.255.255: ICMP echo request, id 1, seq 1, " +
+				"length 64", ok: true,
+			iface: "docker0", source: "172.17.0.1", destination: "172.17.255.255", family: ProtocolFamilyICMP,
+			length: 64,
+		},
+		{line: "1675941530.517119 eth0  Up  IP 10.72.6.42.54440 > 10.72.6.42.8000: UDP, length 88"},
+		{line: "1675941530.517119 eth0  In  ARP, Request who-has 10.72.6.1 tell 10.72.6.42, length 28"},
+		{line: ""},
+		{line: "tcpdump: listening on eth0, link-type EN10MB (Ethernet), capture size 262144 bytes"},
+		{line: "1675941530.517119 ARP, Request who-has 10.72.6.1 tell 10.72.6.42, length 28"},
+		{line: "1675941530.517119 IP6 2001:db8::1.54440 > 2001:db8::2.8000: SCTP, length 88"},
+		{line: "1675941530.517119 IP6 2001:db8::1.99999 > 2001:db8::2.8000: UDP, length 88"},
+		{line: "now IP 10.72.6.42.54440 > 10.72.6.42.8000: UDP, length 88"},
+	} {
+		l, ok := parseTcpdumpLine(c.line)
+		if ok != c.ok {
+			t.Errorf("%v: expect ok=%v, actual %v", c.line, c.ok, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if l.Interface != c.iface {
+			t.Errorf("%v: expect iface %v, actual %v", c.line, c.iface, l.Interface)
+		}
+		if !l.Source.Equal(net.ParseIP(c.source)) || l.SourcePort != c.sport {
+			t.Errorf("%v: expect source %v.%v, actual %v.%v", c.line, c.source, c.sport, l.Source, l.SourcePort)
+		}
+		if !l.Destination.Equal(net.ParseIP(c.destination)) || l.DestPort != c.dport {
+			t.Errorf("%v: expect dest %v.%v, actual %v.%v",
+				c.line, c.destination, c.dport, l.Destination, l.DestPort,
+			)
+		}
+		if l.Family != c.family || l.Length != c.length {
+			t.Errorf("%v: expect %v length %v, actual %v length %v", c.line, c.family, c.length, l.Family, l.Length)
+		}
+		if at := fmt.Sprintf("%.6f", float64(l.Timestamp.UnixNano())/1e9); at != strings.Fields(c.line)[0] {
+			t.Errorf("%v: invalid timestamp %v", c.line, at)
+		}
+	}
+}
+
+func TestValidateStrategies(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		strategies []*NetworkStrategy
+		ok         bool
+	}{
+		{"one", []*NetworkStrategy{{Strategy: "rate", Rate: 1000}}, true},
+		{"combined", []*NetworkStrategy{
+			{Strategy: "rate", Rate: 1000}, {Strategy: "delay", Delay: 50}, {Strategy: "loss", Loss: 1},
+			{Strategy: "duplicate", Duplicate: 1}, {Strategy: "corrupt", Corrupt: 1},
+		}, true},
+		{"reorder with delay", []*NetworkStrategy{
+			{Strategy: "delay", Delay: 50}, {Strategy: "reorder", Reorder: 10},
+		}, true},
+		{"no strategy", nil, false},
+		{"nil strategy", []*NetworkStrategy{nil}, false},
+		{"invalid strategy", []*NetworkStrategy{{Strategy: "jitter"}}, false},
+		{"duplicated", []*NetworkStrategy{{Strategy: "loss", Loss: 1}, {Strategy: "loss", Loss: 2}}, false},
+		{"loss and lossState", []*NetworkStrategy{
+			{Strategy: "loss", Loss: 1}, {Strategy: "lossState", P13: 1},
+		}, false},
+		{"lossState and lossGemodel", []*NetworkStrategy{
+			{Strategy: "lossState", P13: 1}, {Strategy: "lossGemodel", P: 1, R: 10},
+		}, false},
+		{"reorder without delay", []*NetworkStrategy{{Strategy: "reorder", Reorder: 10}}, false},
+		{"percent", []*NetworkStrategy{{Strategy: "loss", Loss: 101}}, false},
+		{"rate", []*NetworkStrategy{{Strategy: "rate"}}, false},
+		{"distribution without jitter", []*NetworkStrategy{
+			{Strategy: "delay", Delay: 50, Distribution: "normal"},
+		}, false},
+	} {
+		if err := validateStrategies(c.strategies); (err == nil) != c.ok {
+			t.Errorf("%v: expect ok=%v, actual err %v", c.name, c.ok, err)
+		}
+	}
+}
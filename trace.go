@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The bytes of packet in the Mahimahi trace, each line is an opportunity to deliver a MTU packet.
+	traceMahimahiPacket = 1500
+	// The default interval in ms to change the rate.
+	traceDefaultInterval = 1000
+	// The max steps of trace, to limit the memory and the changes to kernel.
+	traceMaxSteps = 100000
+)
+
+// ScenarioTrace is a bandwidth or latency trace to replay, which changes the rate and delay every interval.
+type ScenarioTrace struct {
+	// The format of trace, mahimahi for the packet-delivery trace of Mahimahi, or csv for lines of
+	// t_ms,kbps,delay_ms, where the delay_ms is optional.
+	Format string `json:"format"`
+	// The content of trace, or the name of file to read in TC_DATA_DIR, which never reads other paths.
+	Content string `json:"content,omitempty"`
+	File    string `json:"file,omitempty"`
+	// The interval in ms to change the rate, default to 1000.
+	Interval int `json:"interval,omitempty"`
+}
+
+func (v *ScenarioTrace) String() string {
+	return fmt.Sprintf("format=%v, file=%v, content=%vB, interval=%vms", v.Format, v.File, len(v.Content), v.Interval)
+}
+
+// traceSample is the network condition from the time in ms.
+type traceSample struct {
+	at, kbps, delay float64
+}
+
+// Steps parses the trace, and resamples it to steps of interval.
+func (v *ScenarioTrace) Steps() ([]*ScenarioStep, error) {
+	content := v.Content
+	if content == "" && v.File != "" {
+		if strings.ContainsAny(v.File, "/\\") || v.File == "." || v.File == ".." {
+			return nil, errors.Errorf("invalid file=%v, should be a name in TC_DATA_DIR", v.File)
+		}
+
+		if b, err := ioutil.ReadFile(storeFile(v.File)); err != nil {
+			return nil, errors.Wrapf(err, "read %v", v.File)
+		} else {
+			content = string(b)
+		}
+	}
+	if content == "" {
+		return nil, errors.New("no trace content or file")
+	}
+
+	interval := v.Interval
+	if interval == 0 {
+		interval = traceDefaultInterval
+	}
+	if interval < jobMinInterval {
+		return nil, errors.Errorf("invalid interval=%v, should be at least %vms", interval, jobMinInterval)
+	}
+
+	var samples []traceSample
+	var length float64
+	var err error
+	switch v.Format {
+	case "mahimahi":
+		samples, length, err = parseMahimahiTrace(content, float64(interval))
+	case "csv":
+		samples, length, err = parseCSVTrace(content, float64(interval))
+	default:
+		return nil, errors.Errorf("invalid trace format=%v", v.Format)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %v trace", v.Format)
+	}
+
+	n := int(math.Ceil(length / float64(interval)))
+	if n > traceMaxSteps {
+		return nil, errors.Errorf("too many steps %v, length=%vms, interval=%vms", n, length, interval)
+	}
+
+	// Resample the trace, each step is the last sample before the start of step.
+	steps := make([]*ScenarioStep, 0, n)
+	for i, j := 0, 0; i < n; i++ {
+		at := float64(i * interval)
+		for j+1 < len(samples) && samples[j+1].at <= at {
+			j++
+		}
+		steps = append(steps, traceStep(samples[j], time.Duration(interval)*time.Millisecond))
+	}
+	return steps, nil
+}
+
+// traceStep builds the step of sample, the zero bandwidth is an outage, by 100% loss.
+func traceStep(sample traceSample, interval time.Duration) *ScenarioStep {
+	step := &ScenarioStep{interval: interval}
+	if sample.kbps <= 0 {
+		step.Strategies = append(step.Strategies, &NetworkStrategy{Strategy: "loss", Loss: 100})
+	} else {
+		step.Strategies = append(step.Strategies, &NetworkStrategy{Strategy: "rate", Rate: sample.kbps})
+	}
+	if sample.delay > 0 {
+		step.Strategies = append(step.Strategies, &NetworkStrategy{Strategy: "delay", Delay: sample.delay})
+	}
+	return step
+}
+
+// parseMahimahiTrace parses the Mahimahi trace, each line is the time in ms to deliver a packet of 1500 bytes,
+// and the trace repeats after the last line. The bandwidth of each interval is the bits delivered in it. The errors
+// never echo the content, which might be a file on server.
+func parseMahimahiTrace(content string, interval float64) ([]traceSample, float64, error) {
+	var times []float64
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		t, err := strconv.ParseUint(text, 10, 64)
+		if err != nil {
+			return nil, 0, errors.Errorf("line %v: invalid time", line)
+		}
+		if len(times) > 0 && float64(t) < times[len(times)-1] {
+			return nil, 0, errors.Errorf("line %v: time is before the previous line", line)
+		}
+		times = append(times, float64(t))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, errors.Wrapf(err, "scan")
+	}
+	if len(times) == 0 {
+		return nil, 0, errors.New("empty trace")
+	}
+
+	length := times[len(times)-1]
+	if length <= 0 {
+		return nil, 0, errors.Errorf("invalid trace length %vms", length)
+	}
+
+	// The packet at time t is delivered in the interval of [k*interval, (k+1)*interval).
+	var samples []traceSample
+	for i, j := 0, 0; float64(i)*interval < length; i++ {
+		at, packets := float64(i)*interval, 0
+		for ; j < len(times) && times[j] < at+interval; j++ {
+			packets++
+		}
+
+		// The bits per ms is the kbps.
+		kbps := float64(packets*traceMahimahiPacket*8) / interval
+		samples = append(samples, traceSample{at: at, kbps: kbps})
+	}
+	return samples, length, nil
+}
+
+// parseCSVTrace parses the trace of t_ms,kbps,delay_ms lines, each line is the network condition until the next
+// line, and the last line lasts for an interval. The header line and comments are ignored. Like Mahimahi, the
+// errors never echo the content.
+func parseCSVTrace(content string, interval float64) ([]traceSample, float64, error) {
+	var samples []traceSample
+	var header bool
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Split(text, ",")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, 0, errors.Errorf("line %v: invalid fields %v", line, len(fields))
+		}
+
+		var values []float64
+		for _, field := range fields {
+			value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				break
+			}
+			values = append(values, value)
+		}
+		if len(values) != len(fields) {
+			// Ignore the header line, for example, t_ms,kbps,delay_ms
+			if len(samples) == 0 && !header {
+				header = true
+				continue
+			}
+			return nil, 0, errors.Errorf("line %v: invalid number", line)
+		}
+
+		sample := traceSample{at: values[0], kbps: values[1]}
+		if len(values) > 2 {
+			sample.delay = values[2]
+		}
+		if sample.at < 0 || sample.kbps < 0 || sample.delay < 0 {
+			return nil, 0, errors.Errorf("line %v: negative value", line)
+		}
+		samples = append(samples, sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, errors.Wrapf(err, "scan")
+	}
+	if len(samples) == 0 {
+		return nil, 0, errors.New("empty trace")
+	}
+
+	if !sort.SliceIsSorted(samples, func(i, j int) bool { return samples[i].at < samples[j].at }) {
+		return nil, 0, errors.New("time is not in order")
+	}
+	return samples, samples[len(samples)-1].at + interval, nil
+}
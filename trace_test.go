@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMahimahiTrace(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		content  string
+		interval float64
+		samples  []traceSample
+		length   float64
+	}{
+		{"one interval", "0\n0\n500\n1000\n", 1000, []traceSample{{at: 0, kbps: 36}}, 1000},
+		{"two intervals", "0\n0\n500\n1000\n", 500, []traceSample{{at: 0, kbps: 48}, {at: 500, kbps: 24}}, 1000},
+		{"comments", "# Verizon\n\n10\n  20  \n", 10, []traceSample{{at: 0, kbps: 0}, {at: 10, kbps: 1200}}, 20},
+		{"no packets", "0\n3000\n", 1000,
+			[]traceSample{{at: 0, kbps: 12}, {at: 1000, kbps: 0}, {at: 2000, kbps: 0}}, 3000,
+		},
+	} {
+		samples, length, err := parseMahimahiTrace(c.content, c.interval)
+		if err != nil {
+			t.Errorf("%v: err %+v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(samples, c.samples) || length != c.length {
+			t.Errorf("%v: expect %v %v, actual %v %v", c.name, c.samples, c.length, samples, length)
+		}
+	}
+}
+
+func TestParseMahimahiTraceError(t *testing.T) {
+	for _, c := range []struct {
+		content, err string
+	}{
+		{"", "empty trace"},
+		{"# comment\n", "empty trace"},
+		{"0\n", "invalid trace length"},
+		{"0\n10\nsecret\n", "line 3: invalid time"},
+		{"0\n-10\n", "line 2: invalid time"},
+		{"0\n20\n10\n", "line 3: time is before the previous line"},
+	} {
+		if _, _, err := parseMahimahiTrace(c.content, 1000); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: expect %v, actual %v", c.content, c.err, err)
+		} else if strings.Contains(err.Error(), "secret") {
+			t.Errorf("%q: echo content %v", c.content, err)
+		}
+	}
+}
+
+func TestParseCSVTrace(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		content string
+		samples []traceSample
+		length  float64
+	}{
+		{"rate", "0,1000\n", []traceSample{{at: 0, kbps: 1000}}, 1000},
+		{"rate and delay", "0,1000,50\n1000,500\n",
+			[]traceSample{{at: 0, kbps: 1000, delay: 50}, {at: 1000, kbps: 500}}, 2000,
+		},
+		{"header and comments", "t_ms,kbps,delay_ms\n# LTE\n\n0, 1000, 50\n2500,0,10\n",
+			[]traceSample{{at: 0, kbps: 1000, delay: 50}, {at: 2500, kbps: 0, delay: 10}}, 3500,
+		},
+	} {
+		samples, length, err := parseCSVTrace(c.content, 1000)
+		if err != nil {
+			t.Errorf("%v: err %+v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(samples, c.samples) || length != c.length {
+			t.Errorf("%v: expect %v %v, actual %v %v", c.name, c.samples, c.length, samples, length)
+		}
+	}
+}
+
+func TestParseCSVTraceError(t *testing.T) {
+	for _, c := range []struct {
+		content, err string
+	}{
+		{"", "empty trace"},
+		{"t_ms,kbps\n", "empty trace"},
+		{"secret\n", "line 1: invalid fields 1"},
+		{"0,1,2,secret\n", "line 1: invalid fields 4"},
+		{"0,1000\nsecret,1\n", "line 2: invalid number"},
+		{"t_ms,kbps\nt_ms,secret\n", "line 2: invalid number"},
+		{"0,-1\n", "line 1: negative value"},
+		{"0,1,-1\n", "line 1: negative value"},
+		{"1000,1\n0,1\n", "time is not in order"},
+	} {
+		if _, _, err := parseCSVTrace(c.content, 1000); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: expect %v, actual %v", c.content, c.err, err)
+		} else if strings.Contains(err.Error(), "secret") {
+			t.Errorf("%q: echo content %v", c.content, err)
+		}
+	}
+}
+
+func TestScenarioTraceSteps(t *testing.T) {
+	trace := &ScenarioTrace{Format: "csv", Content: "0,1000,50\n1500,0\n"}
+	steps, err := trace.Steps()
+	if err != nil {
+		t.Fatalf("err %+v", err)
+	}
+
+	// The length is 2500ms, so 3 steps of 1000ms, and each step is the last sample before its start.
+	expected := [][]*NetworkStrategy{
+		{{Strategy: "rate", Rate: 1000}, {Strategy: "delay", Delay: 50}},
+		{{Strategy: "rate", Rate: 1000}, {Strategy: "delay", Delay: 50}},
+		{{Strategy: "loss", Loss: 100}},
+	}
+	if len(steps) != len(expected) {
+		t.Fatalf("expect %v steps, actual %v", len(expected), steps)
+	}
+	for i, step := range steps {
+		if step.length() != time.Second || !reflect.DeepEqual(step.Strategies, expected[i]) {
+			t.Errorf("step %v: expect %v, actual %v", i, expected[i], step)
+		}
+	}
+}
+
+func TestScenarioTraceStepsError(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		trace *ScenarioTrace
+	}{
+		{"no content", &ScenarioTrace{Format: "csv"}},
+		{"format", &ScenarioTrace{Format: "json", Content: "0,1000\n"}},
+		{"negative interval", &ScenarioTrace{Format: "csv", Content: "0,1000\n", Interval: -1}},
+		{"small interval", &ScenarioTrace{Format: "csv", Content: "0,1000\n", Interval: 10}},
+		{"too many steps", &ScenarioTrace{Format: "csv", Content: "0,1000\n100000000,0\n", Interval: 100}},
+	} {
+		if steps, err := c.trace.Steps(); err == nil {
+			t.Errorf("%v: expect error, actual %v", c.name, steps)
+		}
+	}
+}
+
+func TestScenarioTraceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatalf("err %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(path.Join(dir, "lte.down"), []byte("0\n500\n1000\n"), 0644); err != nil {
+		t.Fatalf("err %+v", err)
+	}
+
+	previous := os.Getenv("TC_DATA_DIR")
+	os.Setenv("TC_DATA_DIR", dir)
+	defer os.Setenv("TC_DATA_DIR", previous)
+
+	if steps, err := (&ScenarioTrace{Format: "mahimahi", File: "lte.down"}).Steps(); err != nil || len(steps) != 1 {
+		t.Errorf("expect 1 step, actual %v, err %v", steps, err)
+	}
+
+	// Only the name of file in data directory is allowed.
+	for _, file := range []string{"/etc/passwd", "../lte.down", path.Join(dir, "lte.down"), ".", "..", "a\\b"} {
+		if _, err := (&ScenarioTrace{Format: "mahimahi", File: file}).Steps(); err == nil {
+			t.Errorf("%v: expect error", file)
+		}
+	}
+}
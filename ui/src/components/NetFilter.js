@@ -47,6 +47,9 @@ export default function NetFilter({gIfaces,
             <Form.Select required defaultValue={protocol} onChange={(e) => setProtocol(e.target.value)}>
               <option value="">--请选择--</option>
               <option value="ip">IP</option>
+              <option value="udp">UDP</option>
+              <option value="tcp">TCP</option>
+              <option value="icmp">ICMP</option>
             </Form.Select>
             <Form.Control.Feedback type='invalid' tooltip>请选择协议</Form.Control.Feedback>
           </InputGroup>
@@ -17,7 +17,7 @@ export default function Scan({appendNewScan, executing, setExecuting, gIfaces})
 
     setExecuting(true);
     setSelfExecuting(true);
-    axios.get(`/tc/api/v1/scan?ifaces=${activeIfaces.join(',')}&timeout=15&exp=ip`).then(res => {
+    axios.get(`/tc/api/v1/scan?ifaces=${activeIfaces.join(',')}&timeout=15&exp=${encodeURIComponent('ip or ip6')}`).then(res => {
       const db = res?.data?.data;
       if (db?.ifaces) db.ifaces2 = Object.keys(db.ifaces).map(k => db.ifaces[k]);
       setDb(db);